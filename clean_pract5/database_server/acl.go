@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// file with the users allowed to connect, empty leaves the server open
+// to everybody
+var USERS_FILE = ""
+
+// credentials a replica logs in to its primary with
+var PRIMARY_USER = ""
+var PRIMARY_PASSWORD = ""
+
+// PBKDF2 rounds for new password hashes, every AUTH pays for them
+const passwordHashRounds = 10000
+
+// The users file has one user per line:
+//
+//	user <name> <password hash> [db:<pattern>]... [+read] [+write] [+admin] [+all]
+//
+// Patterns are globs over database names, the categories say which kind of
+// commands the user may run. Lines starting with "#" are comments.
+// -hash-password prints the hash for a password.
+type aclUser struct {
+	name       string
+	hash       string
+	databases  []string
+	categories map[string]bool
+}
+
+// nil while USERS_FILE is not set, read only once loaded
+var aclUsers map[string]*aclUser
+
+// the user of every connection when there is no users file
+var unrestrictedUser = &aclUser{
+	name:       "default",
+	databases:  []string{"*"},
+	categories: map[string]bool{"read": true, "write": true, "admin": true},
+}
+
+// commands that work on the server as a whole
+var adminCommands = map[string]bool{
+	"SAVE":         true,
+	"BGSAVE":       true,
+	"BGREWRITEAOF": true,
+	"LASTSAVE":     true,
+	"INFO":         true,
+	"REPLICAOF":    true,
+	"SYNC":         true,
+	"REPLCONF":     true,
+	"DBLIST":       true,
+	"DBDROP":       true,
+	"DBRENAME":     true,
+}
+
+// commands any logged in user may run, what they queue or select is
+// checked on its own
+var aclFreeCommands = map[string]bool{
+	"AUTH":    true,
+	"HELLO":   true,
+	"QUIT":    true,
+	"PING":    true,
+	"ECHO":    true,
+	"SELECT":  true,
+	"COMMAND": true,
+	"CLIENT":  true,
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"UNWATCH": true,
+}
+
+func commandCategory(action string) string {
+	if adminCommands[action] {
+		return "admin"
+	}
+	if writeCommands[action] || action == "PUBLISH" {
+		return "write"
+	}
+	return "read"
+}
+
+func loadUsers(filename string) (map[string]*aclUser, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	users := map[string]*aclUser{}
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) < 3 || fields[0] != "user" {
+			return nil, fmt.Errorf("%s:%d: expected user <name> <password hash> [rules]", filename, number)
+		}
+
+		user := &aclUser{name: fields[1], hash: fields[2], categories: map[string]bool{}}
+		if _, _, _, err := parsePasswordHash(user.hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, number, err)
+		}
+		for _, rule := range fields[3:] {
+			switch {
+			case strings.HasPrefix(rule, "db:"):
+				user.databases = append(user.databases, strings.TrimPrefix(rule, "db:"))
+			case rule == "+read" || rule == "+write" || rule == "+admin":
+				user.categories[strings.TrimPrefix(rule, "+")] = true
+			case rule == "+all":
+				user.categories["read"] = true
+				user.categories["write"] = true
+				user.categories["admin"] = true
+			default:
+				return nil, fmt.Errorf("%s:%d: unknown rule %q", filename, number, rule)
+			}
+		}
+		users[user.name] = user
+	}
+
+	return users, scanner.Err()
+}
+
+// pbkdf2 is PBKDF2 with HMAC-SHA256 as in RFC 8018
+func pbkdf2(password []byte, salt []byte, rounds int, keyLength int) []byte {
+	prf := hmac.New(sha256.New, password)
+	hashLength := prf.Size()
+	blocks := (keyLength + hashLength - 1) / hashLength
+
+	key := make([]byte, 0, blocks*hashLength)
+	u := make([]byte, hashLength)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		prf.Write([]byte{byte(block >> 24), byte(block >> 16), byte(block >> 8), byte(block)})
+		key = prf.Sum(key)
+		t := key[len(key)-hashLength:]
+		copy(u, t)
+
+		for round := 2; round <= rounds; round++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range u {
+				t[i] ^= u[i]
+			}
+		}
+	}
+	return key[:keyLength]
+}
+
+// hashPassword gives "pbkdf2-sha256$<rounds>$<salt>$<key>" with a new salt
+func hashPassword(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key := pbkdf2([]byte(password), salt, passwordHashRounds, sha256.Size)
+	return "pbkdf2-sha256$" + strconv.Itoa(passwordHashRounds) + "$" +
+		base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+}
+
+func parsePasswordHash(hash string) (int, []byte, []byte, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return 0, nil, nil, errors.New("password hash is not pbkdf2-sha256, make one with -hash-password")
+	}
+	rounds, err := strconv.Atoi(parts[1])
+	if err != nil || rounds < 1 {
+		return 0, nil, nil, errors.New("bad rounds in password hash")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, errors.New("bad salt in password hash")
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return 0, nil, nil, errors.New("bad key in password hash")
+	}
+	return rounds, salt, key, nil
+}
+
+func checkPassword(hash string, password string) bool {
+	rounds, salt, key, err := parsePasswordHash(hash)
+	if err != nil {
+		return false
+	}
+	computed := pbkdf2([]byte(password), salt, rounds, len(key))
+	return subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+// authState is who a connection is logged in as, nobody until AUTH when
+// there is a users file
+type authState struct {
+	user *aclUser
+}
+
+func newAuthState() *authState {
+	if aclUsers == nil {
+		return &authState{user: unrestrictedUser}
+	}
+	return &authState{}
+}
+
+// authenticate runs AUTH [user] password, a lone password is for the user
+// called "default". It returns nil once the connection is logged in.
+func (auth *authState) authenticate(args []string) *commandError {
+	if len(args) < 2 || len(args) > 3 {
+		return wrongArguments(args[0])
+	}
+	name, password := "default", args[1]
+	if len(args) == 3 {
+		name, password = args[1], args[2]
+	}
+
+	if aclUsers == nil {
+		return &commandError{codeError, "AUTH called without any password configured"}
+	}
+	user := aclUsers[name]
+	if user == nil || !checkPassword(user.hash, password) {
+		return &commandError{codeWrongPass, "invalid username-password pair"}
+	}
+	auth.user = user
+	return nil
+}
+
+// check returns the error when the connection may not run the command
+// against databaseName, or nil
+func (auth *authState) check(action string, databaseName string) *commandError {
+	if action == "AUTH" || action == "QUIT" || action == "HELLO" {
+		return nil
+	}
+	if auth.user == nil {
+		return &commandError{codeNoAuth, "Authentication required."}
+	}
+	if aclFreeCommands[action] {
+		return nil
+	}
+
+	category := commandCategory(action)
+	if !auth.user.categories[category] {
+		return &commandError{codeNoPerm, "this user has no permissions to run the '" + strings.ToLower(action) + "' command"}
+	}
+	if category == "admin" || action == "PUBLISH" || subscribeCommands[action] {
+		return nil
+	}
+	for _, pattern := range auth.user.databases {
+		if matchPattern(pattern, databaseName) {
+			return nil
+		}
+	}
+	return &commandError{codeNoPerm, "this user has no permissions to access the '" + databaseName + "' database"}
+}
+
+// commandDatabase is the database a command works on, DUMP names it
+func commandDatabase(action string, args []string, current string) string {
+	if action == "DUMP" && len(args) > 1 {
+		return args[1]
+	}
+	return current
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// useTestUsers writes a users file with the given lines, each one
+// followed by the hash of the password "secret", and loads it
+func useTestUsers(t *testing.T, users map[string]string) {
+	t.Helper()
+	content := "# users of the test\n"
+	for name, rules := range users {
+		content += "user " + name + " " + hashPassword("secret") + " " + rules + "\n"
+	}
+	filename := filepath.Join(t.TempDir(), "users.acl")
+	if err := os.WriteFile(filename, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadUsers(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aclUsers = loaded
+}
+
+func TestACLLogin(t *testing.T) {
+	address := startTestServer(t)
+	useTestUsers(t, map[string]string{"web": "db:siteDB +read +write"})
+
+	client := dialTestClient(t, address)
+	client.expectError("NOAUTH", "HGET", "table", "key")
+	client.expectError("WRONGPASS", "AUTH", "web", "wrong")
+	client.expectError("WRONGPASS", "AUTH", "nobody", "secret")
+	client.expectError("WRONGPASS", "AUTH", "secret")
+	client.expectError("NOAUTH", "HGET", "table", "key")
+
+	client.expect("OK", "AUTH", "web", "secret")
+	client.expect("OK", "SELECT", "siteDB")
+	client.expect("OK", "HSET", "table", "key", "value")
+	client.expect("value", "HGET", "table", "key")
+}
+
+func TestACLCategories(t *testing.T) {
+	address := startTestServer(t)
+	useTestUsers(t, map[string]string{
+		"reader": "db:* +read",
+		"writer": "db:* +read +write",
+		"admin":  "db:* +all",
+	})
+
+	admin := dialTestClient(t, address)
+	admin.expect("OK", "AUTH", "admin", "secret")
+	admin.expect("OK", "SELECT", "shared")
+
+	writer := dialTestClient(t, address)
+	writer.expect("OK", "AUTH", "writer", "secret")
+	writer.expect("OK", "SELECT", "shared")
+	writer.expect("OK", "HSET", "table", "key", "value")
+	writer.expect("OK", "QPUSH", "queue", "item")
+	writer.expectError("NOPERM", "DBLIST")
+	writer.expectError("NOPERM", "SAVE")
+	writer.expectError("NOPERM", "DBDROP", "shared")
+
+	reader := dialTestClient(t, address)
+	reader.expect("OK", "AUTH", "reader", "secret")
+	reader.expect("OK", "SELECT", "shared")
+	reader.expect("value", "HGET", "table", "key")
+	reader.expectError("NOPERM", "HSET", "table", "key", "other")
+	reader.expectError("NOPERM", "QPOP", "queue")
+	reader.expectError("NOPERM", "PUBLISH", "channel", "message")
+	reader.expectError("NOPERM", "FLUSHDB")
+	reader.expectError("NOPERM", "DBLIST")
+
+	// a transaction can not smuggle a command past its category
+	reader.expect("OK", "MULTI")
+	reader.expectError("NOPERM", "HSET", "table", "key", "other")
+	reader.expectError("EXECABORT", "EXEC")
+
+	admin.expect([]string{"shared"}, "DBLIST")
+	admin.expect("value", "HGET", "table", "key")
+	admin.expect("item", "QPOP", "queue")
+}
+
+func TestACLDatabases(t *testing.T) {
+	address := startTestServer(t)
+	useTestUsers(t, map[string]string{
+		"site":  "db:site* +read +write",
+		"admin": "db:* +all",
+	})
+
+	admin := dialTestClient(t, address)
+	admin.expect("OK", "AUTH", "admin", "secret")
+	admin.expect("OK", "SELECT", "private")
+	admin.expect("OK", "HSET", "table", "key", "secret value")
+
+	client := dialTestClient(t, address)
+	client.expect("OK", "AUTH", "site", "secret")
+	client.expect("OK", "SELECT", "siteDB")
+	client.expect("OK", "HSET", "table", "key", "value")
+	client.expect("OK", "SELECT", "siteStats")
+	client.expect("OK", "HSET", "table", "key", "value")
+
+	// selecting is free, every command on the database is checked
+	client.expect("OK", "SELECT", "private")
+	client.expectError("NOPERM", "HGET", "table", "key")
+	client.expectError("NOPERM", "HSET", "table", "key", "mine")
+	client.expectError("NOPERM", "SCAN", "0")
+	client.expectError("NOPERM", "DUMP", "private")
+
+	// DUMP names its database, the selected one does not count
+	client.expect("OK", "SELECT", "siteDB")
+	client.expectError("NOPERM", "DUMP", "private")
+
+	admin.expect("secret value", "HGET", "table", "key")
+}
@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var APPEND_ONLY = true
+var APPEND_FILE = "data/appendonly.aof"
+var APPEND_FSYNC = "everysec"
+
+// automatic rewrite starts when the log doubled since the last rewrite
+// and is bigger than APPEND_REWRITE_MIN_SIZE
+var APPEND_REWRITE_PERCENTAGE int64 = 100
+var APPEND_REWRITE_MIN_SIZE int64 = 1 << 20
+
+const (
+	fsyncAlways   = "always"
+	fsyncEverySec = "everysec"
+	fsyncNo       = "no"
+)
+
+// one line of the log
+type appendRecord struct {
+	Database string   `json:"db"`
+	Args     []string `json:"args"`
+}
+
+type appendOnlyLog struct {
+	filename string
+	policy   string
+	file     *os.File
+	size     int64
+	baseSize int64
+	unsynced bool
+
+	// commands that arrived while a rewrite was writing its file, once
+	// buffering starts only databases still pending a copy are not buffered
+	rewriting     bool
+	buffering     bool
+	pending       map[string]bool
+	rewriteBuffer [][]byte
+
+	mutex sync.Mutex
+}
+
+var aof *appendOnlyLog
+
+func validFsyncPolicy(policy string) bool {
+	return policy == fsyncAlways || policy == fsyncEverySec || policy == fsyncNo
+}
+
+func openAppendOnlyLog(filename string, policy string) (*appendOnlyLog, error) {
+	if !validFsyncPolicy(policy) {
+		return nil, fmt.Errorf("unknown fsync policy %q", policy)
+	}
+
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	appendLog := &appendOnlyLog{
+		filename: filename,
+		policy:   policy,
+		file:     file,
+		size:     info.Size(),
+		baseSize: info.Size(),
+	}
+
+	if policy == fsyncEverySec {
+		go appendLog.syncLoop()
+	}
+
+	return appendLog, nil
+}
+
+func encodeAppendRecord(databaseName string, args []string) ([]byte, error) {
+	line, err := json.Marshal(appendRecord{Database: databaseName, Args: args})
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// append writes one command to the log, caller must hold the lock of the
+// database so the log order is the same as the execution order
+func (appendLog *appendOnlyLog) append(databaseName string, args []string) error {
+	line, err := encodeAppendRecord(databaseName, args)
+	if err != nil {
+		return err
+	}
+
+	appendLog.mutex.Lock()
+	defer appendLog.mutex.Unlock()
+
+	if appendLog.buffering && !appendLog.pending[databaseName] {
+		appendLog.rewriteBuffer = append(appendLog.rewriteBuffer, line)
+	}
+
+	n, err := appendLog.file.Write(line)
+	appendLog.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	if appendLog.policy == fsyncAlways {
+		return appendLog.file.Sync()
+	}
+	appendLog.unsynced = true
+	return nil
+}
+
+func (appendLog *appendOnlyLog) syncLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		appendLog.mutex.Lock()
+		if appendLog.unsynced {
+			err := appendLog.file.Sync()
+			if err != nil {
+				fmt.Println("Append only log fsync failed: ", err)
+			} else {
+				appendLog.unsynced = false
+			}
+		}
+		appendLog.mutex.Unlock()
+	}
+}
+
+func (appendLog *appendOnlyLog) close() error {
+	appendLog.mutex.Lock()
+	defer appendLog.mutex.Unlock()
+
+	err := appendLog.file.Sync()
+	closeErr := appendLog.file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// rewriteIfNeeded starts an automatic rewrite once the log grew enough,
+// called after commands were recorded
+func rewriteIfNeeded() {
+	if aof == nil || !aof.needsRewrite() {
+		return
+	}
+	err := aof.startRewrite()
+	if err != nil {
+		fmt.Println("Automatic append only file rewrite failed: ", err)
+	}
+}
+
+// needsRewrite tells whether the log grew enough for an automatic rewrite
+func (appendLog *appendOnlyLog) needsRewrite() bool {
+	appendLog.mutex.Lock()
+	defer appendLog.mutex.Unlock()
+
+	if appendLog.rewriting || appendLog.size < APPEND_REWRITE_MIN_SIZE {
+		return false
+	}
+	growth := (appendLog.size - appendLog.baseSize) * 100 / (appendLog.baseSize + 1)
+	return growth >= APPEND_REWRITE_PERCENTAGE
+}
+
+// rewriteRecords turns a database into the shortest list of commands
+// that builds it again, caller must hold its lock.
+// Empty structures have no command that creates them and are skipped.
+func (base *DatabaseStruct) rewriteRecords() []appendRecord {
+	records := []appendRecord{}
+
+	for i := range base.HashTables {
+		table := &base.HashTables[i]
+		for _, element := range table.entries() {
+			records = append(records, appendRecord{base.Name, []string{"HSET", table.Name, element.Key, element.Value}})
+			if at, ok := table.expires[element.Key]; ok {
+				records = append(records, appendRecord{base.Name, []string{"PEXPIREAT", table.Name, element.Key, strconv.FormatInt(at, 10)}})
+			}
+		}
+	}
+	for i := range base.Stacks {
+		items := base.Stacks[i].items()
+		for j := len(items) - 1; j >= 0; j-- {
+			records = append(records, appendRecord{base.Name, []string{"SPUSH", base.Stacks[i].Name, items[j]}})
+		}
+	}
+	for i := range base.Queues {
+		queue := &base.Queues[i]
+		// items in flight first, each one reserved again right after it
+		// is pushed while it is the only item of the queue
+		for _, id := range queue.reservationIDs() {
+			item := queue.inFlight[id]
+			records = append(records, appendRecord{base.Name, queuePushArgs(queue.Name, item.value, item.attempts-1)})
+			records = append(records, appendRecord{base.Name, []string{"QRESERVEAT", queue.Name, id, strconv.FormatInt(item.deadline, 10)}})
+		}
+		for node := queue.head; node != nil; node = node.next {
+			records = append(records, appendRecord{base.Name, queuePushArgs(queue.Name, node.data, node.attempts)})
+		}
+		for _, item := range queue.delayedItems() {
+			args := []string{"QPUSHAT", queue.Name, item.value, formatUnixTime(item.at)}
+			if item.attempts > 0 {
+				args = append(args, "ATTEMPTS", strconv.Itoa(item.attempts))
+			}
+			records = append(records, appendRecord{base.Name, args})
+		}
+	}
+	for i := range base.Sets {
+		for _, element := range base.Sets[i].ht.entries() {
+			records = append(records, appendRecord{base.Name, []string{"SADD", base.Sets[i].Name, element.Key}})
+		}
+	}
+	for i := range base.SortedSets {
+		for _, node := range base.SortedSets[i].entries() {
+			records = append(records, appendRecord{base.Name, []string{"ZADD", base.SortedSets[i].Name, formatScore(node.score), node.member}})
+		}
+	}
+	for name, at := range base.expires {
+		records = append(records, appendRecord{base.Name, []string{"PEXPIREAT", name, strconv.FormatInt(at, 10)}})
+	}
+
+	return records
+}
+
+func queuePushArgs(name string, value string, attempts int) []string {
+	if attempts > 0 {
+		return []string{"QPUSH", name, value, "ATTEMPTS", strconv.Itoa(attempts)}
+	}
+	return []string{"QPUSH", name, value}
+}
+
+// collectRewrite copies the databases one at a time. Right after a
+// database is copied, while its lock is still held, its later commands
+// start going to the rewrite buffer, so every command ends up either in
+// the copy or in the buffer and never in both.
+func (appendLog *appendOnlyLog) collectRewrite() []appendRecord {
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	appendLog.mutex.Lock()
+	appendLog.pending = map[string]bool{}
+	for _, base := range db.databasesList {
+		appendLog.pending[base.Name] = true
+	}
+	appendLog.buffering = true
+	appendLog.mutex.Unlock()
+
+	records := []appendRecord{}
+	for _, base := range db.databasesList {
+		base.mutex.RLock()
+		records = append(records, base.rewriteRecords()...)
+		appendLog.mutex.Lock()
+		delete(appendLog.pending, base.Name)
+		appendLog.mutex.Unlock()
+		base.mutex.RUnlock()
+	}
+
+	return records
+}
+
+// startRewrite writes a new log in the background. Commands executed
+// meanwhile go both to the old log and to the rewrite buffer, which is
+// appended to the new file before it replaces the old one.
+func (appendLog *appendOnlyLog) startRewrite() error {
+	appendLog.mutex.Lock()
+	if appendLog.rewriting {
+		appendLog.mutex.Unlock()
+		return errors.New("Background append only file rewriting already in progress")
+	}
+	appendLog.rewriting = true
+	appendLog.mutex.Unlock()
+
+	go func() {
+		err := appendLog.rewrite(appendLog.collectRewrite())
+		if err != nil {
+			fmt.Println("Append only file rewrite failed: ", err)
+		} else {
+			fmt.Println("Append only file rewritten")
+		}
+	}()
+
+	return nil
+}
+
+func (appendLog *appendOnlyLog) rewrite(records []appendRecord) error {
+	tmpFile, size, err := writeRewriteFile(filepath.Dir(appendLog.filename), records)
+	if err != nil {
+		appendLog.abortRewrite()
+		return err
+	}
+
+	err = appendLog.finishRewrite(tmpFile, size)
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		appendLog.abortRewrite()
+		return err
+	}
+
+	return nil
+}
+
+func writeRewriteFile(dir string, records []appendRecord) (*os.File, int64, error) {
+	tmpFile, err := os.CreateTemp(dir, "appendonly-*.tmp")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var size int64
+	writer := bufio.NewWriter(tmpFile)
+	for _, record := range records {
+		line, err := encodeAppendRecord(record.Database, record.Args)
+		if err == nil {
+			_, err = writer.Write(line)
+		}
+		if err != nil {
+			tmpFile.Close()
+			os.Remove(tmpFile.Name())
+			return nil, 0, err
+		}
+		size += int64(len(line))
+	}
+
+	err = writer.Flush()
+	if err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, 0, err
+	}
+
+	return tmpFile, size, nil
+}
+
+// finishRewrite adds the buffered commands and swaps the files while
+// appends are blocked
+func (appendLog *appendOnlyLog) finishRewrite(tmpFile *os.File, size int64) error {
+	appendLog.mutex.Lock()
+	defer appendLog.mutex.Unlock()
+
+	for _, line := range appendLog.rewriteBuffer {
+		n, err := tmpFile.Write(line)
+		size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tmpFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpFile.Name(), appendLog.filename)
+	if err != nil {
+		return err
+	}
+
+	// the renamed temp file is the log from now on
+	appendLog.file.Close()
+	appendLog.file = tmpFile
+	appendLog.size = size
+	appendLog.baseSize = size
+	appendLog.unsynced = false
+	appendLog.rewriting = false
+	appendLog.buffering = false
+	appendLog.pending = nil
+	appendLog.rewriteBuffer = nil
+
+	return nil
+}
+
+func (appendLog *appendOnlyLog) abortRewrite() {
+	appendLog.mutex.Lock()
+	defer appendLog.mutex.Unlock()
+
+	appendLog.rewriting = false
+	appendLog.buffering = false
+	appendLog.pending = nil
+	appendLog.rewriteBuffer = nil
+}
+
+// rewriteNow replaces the log synchronously, used at startup when the
+// data came from a snapshot and the log does not have it yet
+func (appendLog *appendOnlyLog) rewriteNow() error {
+	appendLog.mutex.Lock()
+	appendLog.rewriting = true
+	appendLog.mutex.Unlock()
+
+	return appendLog.rewrite(appendLog.collectRewrite())
+}
+
+// replayAppendOnlyLog executes every logged command again. A last line
+// without its newline is what a crash in the middle of a write leaves
+// behind, so it is cut off instead of failing the whole load.
+func replayAppendOnlyLog(filename string) (bool, error) {
+	file, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	lineNumber := 0
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fmt.Println("Append only file ends with an incomplete command, truncating at", offset)
+				err = file.Truncate(offset)
+				if err != nil {
+					return true, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			return true, err
+		}
+		lineNumber++
+
+		var record appendRecord
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			return true, fmt.Errorf("bad append only file line %d: %v", lineNumber, err)
+		}
+		if len(record.Args) == 0 {
+			return true, fmt.Errorf("bad append only file line %d: empty command", lineNumber)
+		}
+
+		executeCommand(&replyBuffer{}, record.Database, record.Args, fromLog)
+		offset += int64(len(line))
+	}
+
+	return true, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BQPOP and BSPOP take one or more names and a timeout in seconds, 0
+// waits forever. The first name with an item wins. When all of them are
+// empty the client waits in line on every name, and a push hands its
+// item straight to the client that has waited longest.
+var blockingCommands = map[string]bool{
+	"BQPOP": true,
+	"BSPOP": true,
+}
+
+type blockKey struct {
+	queue bool
+	name  string
+}
+
+type blockedClient struct {
+	keys  []string
+	queue bool
+	// name and item, filled once by the push that serves the client,
+	// closed when the database is dropped, renamed or replaced by a full
+	// sync
+	result chan [2]string
+	served bool
+}
+
+func findStack(base *DatabaseStruct, name string) *Stack {
+	for i := range base.Stacks {
+		if base.Stacks[i].Name == name {
+			return &base.Stacks[i]
+		}
+	}
+	return nil
+}
+
+func findQueue(base *DatabaseStruct, name string) *Queue {
+	for i := range base.Queues {
+		if base.Queues[i].Name == name {
+			return &base.Queues[i]
+		}
+	}
+	return nil
+}
+
+func popCommand(queue bool) string {
+	if queue {
+		return "QPOP"
+	}
+	return "SPOP"
+}
+
+// popFrom takes the next item of a queue or the top of a stack, caller
+// must hold the database exclusively
+func (base *DatabaseStruct) popFrom(queue bool, name string) (string, bool) {
+	var value string
+	var err error
+	if queue {
+		structure := findQueue(base, name)
+		if structure == nil {
+			return "", false
+		}
+		value, err = structure.pop()
+	} else {
+		structure := findStack(base, name)
+		if structure == nil {
+			return "", false
+		}
+		value, err = structure.pop()
+	}
+	if err != nil {
+		return "", false
+	}
+
+	base.touch(name, "")
+	return value, true
+}
+
+// popFirst pops from the first of keys that has an item and records it
+// as a plain pop
+func (base *DatabaseStruct) popFirst(queue bool, keys []string, source commandSource) (string, string, bool) {
+	now := nowMillis()
+	for _, key := range keys {
+		base.expireIfNeeded(key, now)
+		if queue && source == fromClient {
+			due := base.releaseDue(key, now)
+			if len(due) > 0 {
+				base.record(due)
+			}
+		}
+		value, ok := base.popFrom(queue, key)
+		if ok {
+			if source != fromLog {
+				base.record([][]string{{popCommand(queue), key}})
+			}
+			return key, value, true
+		}
+	}
+	return "", "", false
+}
+
+func (base *DatabaseStruct) block(client *blockedClient) {
+	if base.blocked == nil {
+		base.blocked = map[blockKey][]*blockedClient{}
+	}
+	for _, key := range client.keys {
+		index := blockKey{client.queue, key}
+		base.blocked[index] = append(base.blocked[index], client)
+	}
+}
+
+func (base *DatabaseStruct) unblock(client *blockedClient) {
+	for _, key := range client.keys {
+		index := blockKey{client.queue, key}
+		waiting := base.blocked[index][:0]
+		for _, other := range base.blocked[index] {
+			if other != client {
+				waiting = append(waiting, other)
+			}
+		}
+		if len(waiting) == 0 {
+			delete(base.blocked, index)
+		} else {
+			base.blocked[index] = waiting
+		}
+	}
+}
+
+// serveBlocked hands the items of a structure that was just pushed to to
+// its waiting clients, oldest first, and returns the pops to record
+func (base *DatabaseStruct) serveBlocked(queue bool, name string) [][]string {
+	index := blockKey{queue, name}
+	commands := [][]string{}
+
+	for len(base.blocked[index]) > 0 {
+		value, ok := base.popFrom(queue, name)
+		if !ok {
+			break
+		}
+		client := base.blocked[index][0]
+		base.unblock(client)
+		client.served = true
+		client.result <- [2]string{name, value}
+		commands = append(commands, []string{popCommand(queue), name})
+	}
+
+	return commands
+}
+
+// popNow is BQPOP and BSPOP without waiting, as they run inside EXEC.
+// The caller holds db.mutex.
+func (base *DatabaseStruct) popNow(out reply, args []string, source commandSource) bool {
+	_, err := parseBlockingTimeout(args[len(args)-1])
+	if err != nil {
+		writeError(out, codeSyntax, err.Error())
+		return false
+	}
+
+	base.mutex.Lock()
+	key, value, ok := base.popFirst(strings.ToUpper(args[0]) == "BQPOP", args[1:len(args)-1], source)
+	base.mutex.Unlock()
+
+	if ok {
+		out.array([]string{key, value})
+	} else {
+		out.timedOut()
+	}
+	return ok
+}
+
+func parseBlockingTimeout(value string) (time.Duration, error) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 {
+		return 0, errors.New("Invalid timeout")
+	}
+	return time.Duration(seconds * float64(time.Second)), nil
+}
+
+// executeBlocking runs BQPOP and BSPOP. The reply is the name and the
+// item, or that it timed out. Without a closed channel, inside EXEC or
+// for replayed commands, it never waits.
+func executeBlocking(out reply, databaseName string, args []string, source commandSource, closed <-chan struct{}) {
+	timeout, err := parseBlockingTimeout(args[len(args)-1])
+	if err != nil {
+		writeError(out, codeSyntax, err.Error())
+		return
+	}
+	client := &blockedClient{
+		keys:   args[1 : len(args)-1],
+		queue:  strings.ToUpper(args[0]) == "BQPOP",
+		result: make(chan [2]string, 1),
+	}
+
+	db.mutex.RLock()
+	base := db.findDatabase(databaseName)
+	for base == nil {
+		db.mutex.RUnlock()
+		db.createDatabase(databaseName)
+		db.mutex.RLock()
+		base = db.findDatabase(databaseName)
+	}
+
+	base.mutex.Lock()
+	key, value, ok := base.popFirst(client.queue, client.keys, source)
+	if !ok && closed != nil {
+		base.block(client)
+	}
+	base.mutex.Unlock()
+	db.mutex.RUnlock()
+
+	if ok {
+		rewriteIfNeeded()
+		out.array([]string{key, value})
+		return
+	}
+	if closed == nil {
+		out.timedOut()
+		return
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case result, ok := <-client.result:
+		writeBlockingResult(out, result, ok)
+		return
+	case <-expired:
+	case <-closed:
+	}
+
+	// a push may have served the client right before it gave up
+	db.mutex.RLock()
+	base.mutex.Lock()
+	if !client.served {
+		base.unblock(client)
+	}
+	base.mutex.Unlock()
+	db.mutex.RUnlock()
+
+	select {
+	case result, ok := <-client.result:
+		writeBlockingResult(out, result, ok)
+	default:
+		out.timedOut()
+	}
+}
+
+func writeBlockingResult(out reply, result [2]string, ok bool) {
+	if !ok {
+		writeError(out, codeError, "Database was dropped, renamed or replaced")
+		return
+	}
+	out.array(result[:])
+}
+
+// watchDisconnect notices a client that goes away while it waits, so no
+// item is handed to a dead connection. Stopping it interrupts the read
+// with a deadline, whatever the client sent meanwhile stays buffered.
+func watchDisconnect(conn net.Conn, reader *bufio.Reader) (<-chan struct{}, func()) {
+	closed := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		_, err := reader.Peek(1)
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			close(closed)
+		}
+	}()
+
+	stop := func() {
+		conn.SetReadDeadline(time.Now())
+		<-done
+		conn.SetReadDeadline(time.Time{})
+	}
+	return closed, stop
+}
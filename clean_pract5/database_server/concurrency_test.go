@@ -0,0 +1,187 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestConcurrentDatabases runs hash and queue traffic on several databases
+// at once, with snapshots and dumps reading all of them in between. Run it
+// with -race.
+func TestConcurrentDatabases(t *testing.T) {
+	address := startTestServer(t)
+
+	const databases = 4
+	const workers = 3
+	const rounds = 200
+
+	var wait sync.WaitGroup
+	var popMutex sync.Mutex
+	popped := map[string][]string{}
+
+	for d := 0; d < databases; d++ {
+		database := "db" + strconv.Itoa(d)
+		for w := 0; w < workers; w++ {
+			client := dialTestClient(t, address)
+			worker := strconv.Itoa(w)
+			wait.Add(1)
+			go func() {
+				defer wait.Done()
+				if _, err := client.call("SELECT", database); err != nil {
+					t.Error(err)
+					return
+				}
+				for i := 0; i < rounds; i++ {
+					key := worker + ":" + strconv.Itoa(i)
+					if _, err := client.call("HSET", "table", key, "value "+key); err != nil {
+						t.Errorf("%s HSET: %v", database, err)
+						return
+					}
+					if reply, err := client.call("HGET", "table", key); err != nil || reply != "value "+key {
+						t.Errorf("%s HGET %s = %#v, %v", database, key, reply, err)
+						return
+					}
+					if _, err := client.call("QPUSH", "queue", key); err != nil {
+						t.Errorf("%s QPUSH: %v", database, err)
+						return
+					}
+					reply, err := client.call("QPOP", "queue")
+					if err != nil {
+						t.Errorf("%s QPOP: %v", database, err)
+						return
+					}
+					// another worker may have taken this item, then this
+					// one takes another, the queue is never empty here
+					item, ok := reply.(string)
+					if !ok {
+						t.Errorf("%s QPOP = %#v", database, reply)
+						return
+					}
+					popMutex.Lock()
+					popped[database] = append(popped[database], item)
+					popMutex.Unlock()
+				}
+			}()
+		}
+	}
+
+	// readers of every database at once
+	reader := dialTestClient(t, address)
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		for i := 0; i < 50; i++ {
+			for _, command := range [][]string{{"SAVE"}, {"DBLIST"}, {"DUMP", "db0"}, {"DUMP", "db1", "FORMAT", "text"}} {
+				// DUMP of a database no worker created yet fails, only a
+				// broken connection counts
+				_, err := reader.call(command...)
+				if _, failed := err.(respError); err != nil && !failed {
+					t.Errorf("%v: %v", command, err)
+					return
+				}
+			}
+		}
+	}()
+
+	wait.Wait()
+
+	client := dialTestClient(t, address)
+	for d := 0; d < databases; d++ {
+		database := "db" + strconv.Itoa(d)
+		client.expect("OK", "SELECT", database)
+
+		// every pushed item was popped exactly once
+		items := popped[database]
+		sort.Strings(items)
+		want := []string{}
+		for w := 0; w < workers; w++ {
+			for i := 0; i < rounds; i++ {
+				want = append(want, strconv.Itoa(w)+":"+strconv.Itoa(i))
+			}
+		}
+		sort.Strings(want)
+		if len(items) != len(want) {
+			t.Fatalf("%s: %d items popped, want %d", database, len(items), len(want))
+		}
+		for i := range want {
+			if items[i] != want[i] {
+				t.Fatalf("%s: popped %q where %q was expected", database, items[i], want[i])
+			}
+		}
+		client.expect(nil, "QPOP", "queue")
+
+		for w := 0; w < workers; w++ {
+			for i := 0; i < rounds; i += 37 {
+				key := strconv.Itoa(w) + ":" + strconv.Itoa(i)
+				client.expect("value "+key, "HGET", "table", key)
+			}
+		}
+	}
+	checkMemoryCount(t, "after the workers")
+}
+
+// TestLegacyDumpKeepsServing is the dump path of the legacy protocol that
+// once returned with the global lock held. The server has to keep
+// answering on every connection afterwards.
+func TestLegacyDumpKeepsServing(t *testing.T) {
+	address := startTestServer(t)
+
+	setup := dialTestClient(t, address)
+	setup.expect("OK", "SELECT", "shared")
+	setup.expect("OK", "HSET", "table", "key", "value")
+
+	var wait sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		legacy := dialLegacyTestClient(t, address)
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for round := 0; round < 50; round++ {
+				if err := legacy.send("dump shared"); err != nil {
+					t.Error(err)
+					return
+				}
+				// the text dump of one table with one entry
+				dump, err := legacy.readReply()
+				text, _ := dump.(string)
+				if err != nil || !strings.HasPrefix(text, "database shared\n") {
+					t.Errorf("dump = %#v, %v", dump, err)
+					return
+				}
+				if err := legacy.send(`--file shared --query "HGET table key"`); err != nil {
+					t.Error(err)
+					return
+				}
+				value, err := legacy.readReply()
+				if err != nil || value != "value" {
+					t.Errorf("HGET after dump = %#v, %v", value, err)
+					return
+				}
+			}
+		}()
+	}
+
+	writer := dialTestClient(t, address)
+	wait.Add(1)
+	go func() {
+		defer wait.Done()
+		if _, err := writer.call("SELECT", "other"); err != nil {
+			t.Error(err)
+			return
+		}
+		for i := 0; i < 200; i++ {
+			if _, err := writer.call("HSET", "table", strconv.Itoa(i), "x"); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	wait.Wait()
+
+	setup.expect("value", "HGET", "table", "key")
+	setup.expect("OK", "SELECT", "other")
+	setup.expect("x", "HGET", "table", "199")
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"container/heap"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Delayed items wait in a heap ordered by the time they become visible,
+// next to the linked list of the queue. QPUSH ... DELAY <seconds> is
+// executed and recorded as QPUSHAT with an absolute unix time, and moving
+// the due items to the list is recorded as QPROMOTE, so replaying the log
+// gives the same order no matter when it runs.
+type delayedItem struct {
+	value    string
+	at       int64
+	attempts int
+	// keeps items with the same deadline in push order
+	sequence int64
+}
+
+type delayedHeap []*delayedItem
+
+func (items delayedHeap) Len() int { return len(items) }
+
+func (items delayedHeap) Less(i, j int) bool {
+	if items[i].at != items[j].at {
+		return items[i].at < items[j].at
+	}
+	return items[i].sequence < items[j].sequence
+}
+
+func (items delayedHeap) Swap(i, j int) { items[i], items[j] = items[j], items[i] }
+
+func (items *delayedHeap) Push(item interface{}) {
+	*items = append(*items, item.(*delayedItem))
+}
+
+func (items *delayedHeap) Pop() interface{} {
+	old := *items
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*items = old[:len(old)-1]
+	return item
+}
+
+type queuePushOptions struct {
+	attempts int
+	// milliseconds, zero pushes right away
+	delay int64
+}
+
+// parseQueuePush reads the "DELAY <seconds>" and "ATTEMPTS <n>" options
+// starting at args[first]. Anything else is ignored like before, the
+// legacy format splits values with spaces into several arguments.
+func parseQueuePush(args []string, first int) (queuePushOptions, error) {
+	options := queuePushOptions{}
+
+	for i := first; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "DELAY":
+			seconds, err := strconv.ParseFloat(args[i+1], 64)
+			if err != nil || seconds < 0 || math.IsInf(seconds, 0) {
+				return options, errors.New("Invalid delay")
+			}
+			options.delay = int64(math.Round(seconds * 1000))
+		case "ATTEMPTS":
+			attempts, err := strconv.Atoi(args[i+1])
+			if err != nil || attempts < 0 {
+				return options, errors.New("Invalid attempts")
+			}
+			options.attempts = attempts
+		default:
+			return options, nil
+		}
+	}
+
+	return options, nil
+}
+
+// formatUnixTime writes milliseconds as unix seconds with a fraction
+func formatUnixTime(at int64) string {
+	return strconv.FormatFloat(float64(at)/1000, 'f', 3, 64)
+}
+
+func parseUnixTime(value string) (int64, error) {
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || seconds < 0 || math.IsInf(seconds, 0) {
+		return 0, errors.New("Invalid time")
+	}
+	return int64(math.Round(seconds * 1000)), nil
+}
+
+// delayCommand turns a QPUSH with a delay into the QPUSHAT that is
+// executed and recorded, other commands come back unchanged
+func delayCommand(args []string) ([]string, error) {
+	options, err := parseQueuePush(args, 3)
+	if err != nil || options.delay == 0 {
+		return args, err
+	}
+
+	converted := []string{"QPUSHAT", args[1], args[2], formatUnixTime(nowMillis() + options.delay)}
+	if options.attempts > 0 {
+		converted = append(converted, "ATTEMPTS", strconv.Itoa(options.attempts))
+	}
+	return converted, nil
+}
+
+func (queue *Queue) pushDelayed(value string, at int64, attempts int) {
+	queue.sequence++
+	addMemory(&queue.memory, delayedItemSize(value))
+	heap.Push(&queue.delayed, &delayedItem{value: value, at: at, attempts: attempts, sequence: queue.sequence})
+}
+
+// promote moves the items due at upto to the tail of the list
+func (queue *Queue) promote(upto int64) int {
+	moved := 0
+	for len(queue.delayed) > 0 && queue.delayed[0].at <= upto {
+		item := heap.Pop(&queue.delayed).(*delayedItem)
+		addMemory(&queue.memory, -delayedItemSize(item.value))
+		queue.pushAttempts(item.value, item.attempts)
+		moved++
+	}
+	return moved
+}
+
+// delayedItems lists the waiting items in the order they become visible
+func (queue *Queue) delayedItems() []*delayedItem {
+	items := make(delayedHeap, len(queue.delayed))
+	copy(items, queue.delayed)
+
+	sorted := []*delayedItem{}
+	for len(items) > 0 {
+		sorted = append(sorted, heap.Pop(&items).(*delayedItem))
+	}
+	return sorted
+}
+
+// promoteDue makes the due items of a queue visible and returns the
+// commands to record, with the pops of the clients that were waiting
+func (base *DatabaseStruct) promoteDue(name string, now int64) [][]string {
+	queue := findQueue(base, name)
+	if queue == nil || len(queue.delayed) == 0 || queue.delayed[0].at > now {
+		return nil
+	}
+
+	queue.promote(now)
+	base.touch(name, "")
+	commands := [][]string{{"QPROMOTE", name, strconv.FormatInt(now, 10)}}
+	return append(commands, base.serveBlocked(true, name)...)
+}
+
+// executeDelayed runs QPUSHAT and QPROMOTE, returning the pops done for
+// waiting clients
+func executeDelayed(out reply, base *DatabaseStruct, action string, args []string) [][]string {
+	switch action {
+	case "QPUSHAT":
+		at, err := parseUnixTime(args[3])
+		if err != nil {
+			writeError(out, codeSyntax, err.Error())
+			return nil
+		}
+		options, err := parseQueuePush(args, 4)
+		if err != nil {
+			writeError(out, codeSyntax, err.Error())
+			return nil
+		}
+		queue := findQueue(base, args[1])
+		if queue == nil {
+			base.Queues = append(base.Queues, *NewQueue(args[1]))
+			queue = &base.Queues[len(base.Queues)-1]
+		}
+		queue.pushDelayed(args[2], at, options.attempts)
+	case "QPROMOTE":
+		upto, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			writeError(out, codeSyntax, "Invalid time")
+			return nil
+		}
+		moved := 0
+		queue := findQueue(base, args[1])
+		if queue != nil {
+			moved = queue.promote(upto)
+		}
+		out.integer(int64(moved))
+		return base.serveBlocked(true, args[1])
+	}
+
+	return nil
+}
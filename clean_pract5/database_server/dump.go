@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DUMP <db> [FORMAT json|text] replies everything one database holds
+// without changing it. JSON has the layout of a database in the snapshot
+// file, text is meant for reading in a terminal. Structures that expired
+// but were not removed yet are left out.
+func executeDump(out reply, args []string) {
+	format := "json"
+	if len(args) > 2 {
+		if len(args) != 4 || strings.ToUpper(args[2]) != "FORMAT" {
+			writeError(out, codeSyntax, "Syntax error")
+			return
+		}
+		format = strings.ToLower(args[3])
+		if format != "json" && format != "text" {
+			writeError(out, codeSyntax, "Unknown format, expected json or text")
+			return
+		}
+	}
+
+	// db.mutex is held by the caller
+	base := db.findDatabase(args[1])
+	if base == nil {
+		writeError(out, codeNoSuchKey, "Database doesnt exist")
+		return
+	}
+	base.mutex.RLock()
+	saved := base.snapshot()
+	base.mutex.RUnlock()
+	saved.dropExpired(nowMillis())
+
+	if format == "text" {
+		writeDumpText(out, saved)
+		return
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		writeError(out, codeError, err.Error())
+		return
+	}
+	out.bulk(string(data))
+}
+
+func (saved *snapshotDatabase) dropExpired(now int64) {
+	expired := func(name string) bool {
+		at, ok := saved.Expires[name]
+		return ok && at <= now
+	}
+
+	hashTables := saved.HashTables[:0]
+	for _, table := range saved.HashTables {
+		if !expired(table.Name) {
+			hashTables = append(hashTables, table)
+		}
+	}
+	saved.HashTables = hashTables
+
+	stacks := saved.Stacks[:0]
+	for _, stack := range saved.Stacks {
+		if !expired(stack.Name) {
+			stacks = append(stacks, stack)
+		}
+	}
+	saved.Stacks = stacks
+
+	queues := saved.Queues[:0]
+	for _, queue := range saved.Queues {
+		if !expired(queue.Name) {
+			queues = append(queues, queue)
+		}
+	}
+	saved.Queues = queues
+
+	sets := saved.Sets[:0]
+	for _, set := range saved.Sets {
+		if !expired(set.Name) {
+			sets = append(sets, set)
+		}
+	}
+	saved.Sets = sets
+
+	sortedSets := saved.SortedSets[:0]
+	for _, zset := range saved.SortedSets {
+		if !expired(zset.Name) {
+			sortedSets = append(sortedSets, zset)
+		}
+	}
+	saved.SortedSets = sortedSets
+
+	for name := range saved.Expires {
+		if expired(name) {
+			delete(saved.Expires, name)
+		}
+	}
+}
+
+// writeDumpText writes one header line per structure with its contents
+// indented below, times are unix milliseconds
+func writeDumpText(out reply, saved snapshotDatabase) {
+	lines := []string{"database " + saved.Name}
+
+	for _, table := range saved.HashTables {
+		lines = append(lines, "hash "+table.Name+" ("+strconv.Itoa(len(table.Entries))+")")
+		sort.Slice(table.Entries, func(i, j int) bool { return table.Entries[i].Key < table.Entries[j].Key })
+		for _, element := range table.Entries {
+			line := "  " + element.Key + " = " + element.Value
+			if at, ok := table.Expires[element.Key]; ok {
+				line += " (expires " + strconv.FormatInt(at, 10) + ")"
+			}
+			lines = append(lines, line)
+		}
+	}
+	for _, stack := range saved.Stacks {
+		lines = append(lines, "stack "+stack.Name+" ("+strconv.Itoa(len(stack.Items))+", top first)")
+		for _, item := range stack.Items {
+			lines = append(lines, "  "+item)
+		}
+	}
+	for _, queue := range saved.Queues {
+		lines = append(lines, "queue "+queue.Name+" ("+strconv.Itoa(len(queue.Items))+", head first)")
+		for _, item := range queue.Items {
+			lines = append(lines, "  "+item)
+		}
+		for _, item := range queue.InFlight {
+			lines = append(lines, "  in flight "+item.ID+": "+item.Value+" (attempt "+strconv.Itoa(item.Attempts)+", lease until "+strconv.FormatInt(item.Deadline, 10)+")")
+		}
+		for _, item := range queue.Delayed {
+			lines = append(lines, "  delayed: "+item.Value+" (visible at "+strconv.FormatInt(item.At, 10)+")")
+		}
+	}
+	for _, set := range saved.Sets {
+		lines = append(lines, "set "+set.Name+" ("+strconv.Itoa(len(set.Items))+")")
+		sort.Strings(set.Items)
+		for _, member := range set.Items {
+			lines = append(lines, "  "+member)
+		}
+	}
+	for _, zset := range saved.SortedSets {
+		lines = append(lines, "zset "+zset.Name+" ("+strconv.Itoa(len(zset.Members))+", lowest score first)")
+		for _, member := range zset.Members {
+			lines = append(lines, "  "+member.Member+" "+member.Score)
+		}
+	}
+
+	if len(saved.Expires) > 0 {
+		names := []string{}
+		for name := range saved.Expires {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		lines = append(lines, "expires")
+		for _, name := range names {
+			lines = append(lines, "  "+name+" "+strconv.FormatInt(saved.Expires[name], 10))
+		}
+	}
+
+	out.bulk(strings.Join(lines, "\n"))
+}
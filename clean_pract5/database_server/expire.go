@@ -0,0 +1,466 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how often the background sampler looks for expired keys
+var EXPIRE_CYCLE_INTERVAL = 100 * time.Millisecond
+
+// keys checked per database and per hash table in one sampler round,
+// the round repeats while more than a quarter of the sample had expired
+const expireSampleSize = 20
+const expireCycleRepeats = 16
+
+// expiration times are unix milliseconds
+func nowMillis() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func parseExpireSeconds(value string) (int64, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0, errors.New("Invalid expire time")
+	}
+	return nowMillis() + seconds*1000, nil
+}
+
+// hash fields
+
+func (ht *HashTable) expired(key string, now int64) bool {
+	at, ok := ht.expires[key]
+	return ok && at <= now
+}
+
+// SetExpire gives an existing field a deadline, false if there is no such field
+func (ht *HashTable) SetExpire(key string, at int64) bool {
+	if _, err := ht.Get(key); err != nil {
+		return false
+	}
+	ht.setDeadline(key, at)
+	if at <= nowMillis() {
+		ht.Delete(key)
+	}
+	return true
+}
+
+func (ht *HashTable) Persist(key string) bool {
+	if _, err := ht.Get(key); err != nil {
+		return false
+	}
+	return ht.dropDeadline(key)
+}
+
+// setDeadline stores the deadline of a field, a new one takes memory
+func (ht *HashTable) setDeadline(key string, at int64) {
+	if ht.expires == nil {
+		ht.expires = map[string]int64{}
+	}
+	if _, ok := ht.expires[key]; !ok {
+		trackMemory(deadlineOverhead)
+	}
+	ht.expires[key] = at
+}
+
+// dropDeadline forgets the deadline of a field and tells whether it had one
+func (ht *HashTable) dropDeadline(key string) bool {
+	if _, ok := ht.expires[key]; !ok {
+		return false
+	}
+	delete(ht.expires, key)
+	trackMemory(-deadlineOverhead)
+	return true
+}
+
+// TTL follows redis: -2 for a missing field, -1 for a field without
+// deadline, otherwise the milliseconds left
+func (ht *HashTable) TTL(key string) int64 {
+	if _, err := ht.Get(key); err != nil {
+		return -2
+	}
+	at, ok := ht.expires[key]
+	if !ok {
+		return -1
+	}
+	return at - nowMillis()
+}
+
+// removeExpired checks up to limit fields with a deadline and deletes the
+// expired ones, it returns how many were checked and deleted
+func (ht *HashTable) removeExpired(now int64, limit int) (int, int) {
+	checked, removed := 0, 0
+	for key, at := range ht.expires {
+		if checked >= limit {
+			break
+		}
+		checked++
+		if at <= now {
+			ht.Delete(key)
+			removed++
+		}
+	}
+	return checked, removed
+}
+
+// named structures
+
+func (base *DatabaseStruct) exists(name string) bool {
+	for i := range base.HashTables {
+		if base.HashTables[i].Name == name {
+			return true
+		}
+	}
+	for i := range base.Stacks {
+		if base.Stacks[i].Name == name {
+			return true
+		}
+	}
+	for i := range base.Queues {
+		if base.Queues[i].Name == name {
+			return true
+		}
+	}
+	for i := range base.Sets {
+		if base.Sets[i].Name == name {
+			return true
+		}
+	}
+	for i := range base.SortedSets {
+		if base.SortedSets[i].Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// removeStructures drops every structure called name, whatever its type
+func (base *DatabaseStruct) removeStructures(name string) int {
+	removed := 0
+
+	// what the removed structures took, see memory.go
+	freed := int64(0)
+
+	hashTables := base.HashTables[:0]
+	for _, table := range base.HashTables {
+		if table.Name == name {
+			removed++
+			freed += table.memoryUsage()
+		} else {
+			hashTables = append(hashTables, table)
+		}
+	}
+	base.HashTables = hashTables
+
+	stacks := base.Stacks[:0]
+	for _, stack := range base.Stacks {
+		if stack.Name == name {
+			removed++
+			freed += stack.memoryUsage()
+		} else {
+			stacks = append(stacks, stack)
+		}
+	}
+	base.Stacks = stacks
+
+	queues := base.Queues[:0]
+	for _, queue := range base.Queues {
+		if queue.Name == name {
+			removed++
+			freed += queue.memoryUsage()
+		} else {
+			queues = append(queues, queue)
+		}
+	}
+	base.Queues = queues
+
+	sets := base.Sets[:0]
+	for _, set := range base.Sets {
+		if set.Name == name {
+			removed++
+			freed += set.ht.memoryUsage()
+		} else {
+			sets = append(sets, set)
+		}
+	}
+	base.Sets = sets
+
+	sortedSets := base.SortedSets[:0]
+	for _, zset := range base.SortedSets {
+		if zset.Name == name {
+			removed++
+			freed += zset.memoryUsage()
+		} else {
+			sortedSets = append(sortedSets, zset)
+		}
+	}
+	base.SortedSets = sortedSets
+
+	trackMemory(-freed)
+	base.dropDeadline(name)
+	base.touch(name, "")
+	return removed
+}
+
+// nameExpired only looks, so it is safe under the read lock
+func (base *DatabaseStruct) nameExpired(name string, now int64) bool {
+	at, ok := base.expires[name]
+	return ok && at <= now
+}
+
+// expireIfNeeded is the lazy half of expiration, every command calls it
+// for the structure it touches
+func (base *DatabaseStruct) expireIfNeeded(name string, now int64) bool {
+	at, ok := base.expires[name]
+	if !ok || at > now {
+		return false
+	}
+	base.removeStructures(name)
+	return true
+}
+
+func (base *DatabaseStruct) setExpire(name string, at int64) bool {
+	if !base.exists(name) {
+		return false
+	}
+	base.setDeadline(name, at)
+	base.expireIfNeeded(name, nowMillis())
+	return true
+}
+
+// setDeadline stores the deadline of a structure, a new one takes memory
+func (base *DatabaseStruct) setDeadline(name string, at int64) {
+	if base.expires == nil {
+		base.expires = map[string]int64{}
+	}
+	if _, ok := base.expires[name]; !ok {
+		trackMemory(deadlineOverhead)
+	}
+	base.expires[name] = at
+}
+
+// dropDeadline forgets the deadline of a structure and tells whether it
+// had one
+func (base *DatabaseStruct) dropDeadline(name string) bool {
+	if _, ok := base.expires[name]; !ok {
+		return false
+	}
+	delete(base.expires, name)
+	trackMemory(-deadlineOverhead)
+	return true
+}
+
+// activeExpireCycle is the background half of expiration, it samples keys
+// with a deadline so memory is reclaimed even if nobody reads them again
+func (mainDb *MainDatabaseStructure) activeExpireCycle() {
+	now := nowMillis()
+
+	// replicas wait for the primary to give leases back and promote
+	// delayed items
+	replica := replication.isReplica()
+
+	mainDb.mutex.RLock()
+	defer mainDb.mutex.RUnlock()
+
+	for _, base := range mainDb.databasesList {
+		base.mutex.Lock()
+
+		if !replica {
+			base.releaseAllDue(now)
+		}
+
+		for repeat := 0; repeat < expireCycleRepeats; repeat++ {
+			checked, removed := 0, 0
+			for name, at := range base.expires {
+				if checked >= expireSampleSize {
+					break
+				}
+				checked++
+				if at <= now {
+					base.removeStructures(name)
+					removed++
+				}
+			}
+			if removed*4 <= checked {
+				break
+			}
+		}
+
+		for j := range base.HashTables {
+			for repeat := 0; repeat < expireCycleRepeats; repeat++ {
+				checked, removed := base.HashTables[j].removeExpired(now, expireSampleSize)
+				if removed*4 <= checked {
+					break
+				}
+			}
+		}
+
+		base.mutex.Unlock()
+	}
+}
+
+func (mainDb *MainDatabaseStructure) expireLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		mainDb.activeExpireCycle()
+	}
+}
+
+func findHashTable(base *DatabaseStruct, name string) *HashTable {
+	for i := range base.HashTables {
+		if base.HashTables[i].Name == name {
+			return &base.HashTables[i]
+		}
+	}
+	return nil
+}
+
+// executeExpire runs PEXPIREAT, PERSIST and TTL, EXPIRE arrives here as
+// PEXPIREAT. With one name they work on the whole structure, with a name
+// and a field on one field of a hash table.
+func executeExpire(out reply, base *DatabaseStruct, action string, args []string) {
+	name := args[1]
+	var field string
+	hasField := false
+
+	switch action {
+	case "PEXPIREAT":
+		if len(args) > 3 {
+			field, hasField = args[2], true
+		}
+	default:
+		if len(args) > 2 {
+			field, hasField = args[2], true
+		}
+	}
+
+	var table *HashTable
+	if hasField {
+		table = findHashTable(base, name)
+		if table == nil {
+			writeError(out, codeNoSuchKey, "Hashtable doesnt exist :(")
+			return
+		}
+	}
+
+	switch action {
+	case "PEXPIREAT":
+		at, err := strconv.ParseInt(args[len(args)-1], 10, 64)
+		if err != nil {
+			writeError(out, codeSyntax, "Invalid expire time")
+			return
+		}
+
+		var done bool
+		if hasField {
+			done = table.SetExpire(field, at)
+		} else {
+			done = base.setExpire(name, at)
+		}
+		out.integer(boolToInt(done))
+	case "PERSIST":
+		var done bool
+		if hasField {
+			done = table.Persist(field)
+		} else {
+			done = base.dropDeadline(name)
+		}
+		out.integer(boolToInt(done))
+	case "TTL":
+		var ttl int64
+		if hasField {
+			ttl = table.TTL(field)
+		} else if !base.exists(name) {
+			ttl = -2
+		} else if at, ok := base.expires[name]; ok {
+			ttl = at - nowMillis()
+		} else {
+			ttl = -1
+		}
+		if ttl > 0 {
+			// round up like redis, a key with 1ms left still has 1 second
+			ttl = (ttl + 999) / 1000
+		}
+		out.integer(ttl)
+	}
+}
+
+func boolToInt(value bool) int64 {
+	if value {
+		return 1
+	}
+	return 0
+}
+
+// hashSetExpire reads the optional "EX <seconds>" or "PXAT <unix ms>"
+// tail of HSET
+func hashSetExpire(args []string) (int64, bool, error) {
+	if len(args) <= 4 {
+		return 0, false, nil
+	}
+	option := ""
+	if len(args) == 6 {
+		option = strings.ToUpper(args[4])
+	}
+	switch option {
+	case "EX":
+		at, err := parseExpireSeconds(args[5])
+		return at, err == nil, err
+	case "PXAT":
+		at, err := strconv.ParseInt(args[5], 10, 64)
+		if err != nil {
+			return 0, false, errors.New("Invalid expire time")
+		}
+		return at, true, nil
+	}
+	return 0, false, errors.New("Syntax error, expected HSET <table> <key> <value> [EX <seconds> | PXAT <unix ms>]")
+}
+
+// deadlineCommand turns the relative expire time of EXPIRE and of HSET
+// with EX into an absolute one before the command runs. The deadline is
+// computed once, the command applies and records the same one.
+func deadlineCommand(args []string) ([]string, error) {
+	switch strings.ToUpper(args[0]) {
+	case "EXPIRE":
+		at, err := parseExpireSeconds(args[len(args)-1])
+		if err != nil {
+			return nil, err
+		}
+		converted := append([]string{"PEXPIREAT"}, args[1:len(args)-1]...)
+		return append(converted, strconv.FormatInt(at, 10)), nil
+	case "HSET":
+		if len(args) != 6 || strings.ToUpper(args[4]) != "EX" {
+			return args, nil
+		}
+		at, err := parseExpireSeconds(args[5])
+		if err != nil {
+			return nil, err
+		}
+		return []string{args[0], args[1], args[2], args[3], "PXAT", strconv.FormatInt(at, 10)}, nil
+	}
+	return args, nil
+}
+
+// persistentCommands gives what a command is recorded as in the append
+// only log. Deadlines are already absolute, see deadlineCommand, HSET with
+// one is recorded as HSET and PEXPIREAT.
+func persistentCommands(args []string) [][]string {
+	action := strings.ToUpper(args[0])
+
+	switch action {
+	case "HSET":
+		if len(args) != 6 || strings.ToUpper(args[4]) != "PXAT" {
+			break
+		}
+		return [][]string{
+			{"HSET", args[1], args[2], args[3]},
+			{"PEXPIREAT", args[1], args[2], args[5]},
+		}
+	}
+
+	return [][]string{args}
+}
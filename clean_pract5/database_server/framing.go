@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+)
+
+// biggest legacy command accepted, longer frames are rejected
+var MAX_COMMAND_SIZE = 64 * 1024
+
+// A legacy frame is either one line ending with "\n" or, for values with
+// line breaks, "$<length>\n" followed by exactly length bytes.
+type frameError struct {
+	message string
+	// the stream can not be resynchronized after a fatal error
+	fatal bool
+}
+
+func (err *frameError) Error() string {
+	return err.message
+}
+
+type frameReader struct {
+	reader  *bufio.Reader
+	maxSize int
+}
+
+func newFrameReader(reader *bufio.Reader, maxSize int) *frameReader {
+	return &frameReader{reader: reader, maxSize: maxSize}
+}
+
+// next returns the following command without its terminator, empty lines
+// are skipped. A last line without "\n" before EOF still counts.
+func (frames *frameReader) next() (string, error) {
+	for {
+		line, err := frames.readLine()
+		if err != nil {
+			return "", err
+		}
+
+		if len(line) > 0 && line[0] == '$' {
+			return frames.readPrefixed(line[1:])
+		}
+		if len(line) > 0 {
+			return line, nil
+		}
+	}
+}
+
+func (frames *frameReader) readLine() (string, error) {
+	var line []byte
+
+	for {
+		chunk, err := frames.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+
+		if len(line) > frames.maxSize+2 {
+			if err == bufio.ErrBufferFull {
+				err = frames.skipLine()
+				if err != nil && err != io.EOF {
+					return "", err
+				}
+			}
+			return "", &frameError{message: "Command is too long, limit is " + strconv.Itoa(frames.maxSize) + " bytes"}
+		}
+
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	if len(line) > frames.maxSize {
+		return "", &frameError{message: "Command is too long, limit is " + strconv.Itoa(frames.maxSize) + " bytes"}
+	}
+
+	return string(line), nil
+}
+
+// skipLine drops the rest of an oversized line
+func (frames *frameReader) skipLine() error {
+	for {
+		_, err := frames.reader.ReadSlice('\n')
+		if err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+func (frames *frameReader) readPrefixed(lengthText string) (string, error) {
+	length, err := strconv.Atoi(lengthText)
+	if err != nil || length < 0 {
+		return "", &frameError{message: "Malformed frame: bad length '" + lengthText + "'", fatal: true}
+	}
+
+	if length > frames.maxSize {
+		_, err = io.CopyN(io.Discard, frames.reader, int64(length))
+		if err != nil {
+			return "", &frameError{message: "Malformed frame: connection closed inside a frame", fatal: true}
+		}
+		return "", &frameError{message: "Command is too long, limit is " + strconv.Itoa(frames.maxSize) + " bytes"}
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(frames.reader, data)
+	if err != nil {
+		return "", &frameError{message: "Malformed frame: connection closed inside a frame", fatal: true}
+	}
+	frames.skipLineBreak()
+
+	return string(data), nil
+}
+
+// skipLineBreak drops a line break that already arrived right after a
+// frame, otherwise it would look like another command waiting and the
+// reply would not be flushed
+func (frames *frameReader) skipLineBreak() {
+	for _, terminator := range []string{"\n", "\r\n"} {
+		if frames.reader.Buffered() < len(terminator) {
+			continue
+		}
+		next, _ := frames.reader.Peek(len(terminator))
+		if string(next) == terminator {
+			frames.reader.Discard(len(terminator))
+			return
+		}
+	}
+}
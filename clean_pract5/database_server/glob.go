@@ -0,0 +1,90 @@
+package main
+
+// matchPattern is redis style glob matching: "*" is any run of characters,
+// "?" one character, "[abc]", "[^abc]" and "[a-z]" classes, and "\" makes
+// the next character literal. Unlike path.Match "*" crosses "/" and ".".
+func matchPattern(pattern string, text string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(text); i++ {
+				if matchPattern(pattern[1:], text[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(text) == 0 {
+				return false
+			}
+			pattern, text = pattern[1:], text[1:]
+		case '[':
+			if len(text) == 0 {
+				return false
+			}
+			rest, matched := matchClass(pattern[1:], text[0])
+			if !matched {
+				return false
+			}
+			pattern, text = rest, text[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(text) == 0 || pattern[0] != text[0] {
+				return false
+			}
+			pattern, text = pattern[1:], text[1:]
+		}
+	}
+	return len(text) == 0
+}
+
+// matchClass checks c against the class at the start of pattern, which
+// comes without its "[", and returns the pattern after the closing "]"
+func matchClass(pattern string, c byte) (string, bool) {
+	negate := false
+	if len(pattern) > 0 && pattern[0] == '^' {
+		negate = true
+		pattern = pattern[1:]
+	}
+
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		if pattern[0] == '\\' && len(pattern) > 1 {
+			pattern = pattern[1:]
+			if pattern[0] == c {
+				matched = true
+			}
+			pattern = pattern[1:]
+		} else if len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']' {
+			low, high := pattern[0], pattern[2]
+			if low > high {
+				low, high = high, low
+			}
+			if c >= low && c <= high {
+				matched = true
+			}
+			pattern = pattern[3:]
+		} else {
+			if pattern[0] == c {
+				matched = true
+			}
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		// the closing "]"
+		pattern = pattern[1:]
+	}
+
+	return pattern, matched != negate
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+// hashTableStates counts what a run went through, so a test can tell that
+// it reached the paths it is meant for
+type hashTableStates struct {
+	grown           int
+	shrunk          int
+	cleaned         int
+	rehashingWrites int
+	maxTombstones   int
+}
+
+// hashTableRun drives one table and a map with the same operations and
+// compares them after every step
+type hashTableRun struct {
+	t      *testing.T
+	random *rand.Rand
+	ht     *HashTable
+	model  map[string]string
+	states hashTableStates
+	step   int
+
+	// the keys of model in a stable order and their positions, so a
+	// seed always picks the same ones
+	stored    []string
+	positions map[string]int
+	peak      int
+}
+
+func newHashTableRun(t *testing.T, seed int64, capacity int) *hashTableRun {
+	return &hashTableRun{
+		t:      t,
+		random: rand.New(rand.NewSource(seed)),
+		ht:     NewHashTable("test", capacity),
+		model:  map[string]string{},
+
+		positions: map[string]int{},
+	}
+}
+
+// storedKey picks one of the keys in the table
+func (run *hashTableRun) storedKey() string {
+	return run.stored[run.random.Intn(len(run.stored))]
+}
+
+// key picks one of keys names, small key spaces make the same keys come
+// back after they were deleted
+func (run *hashTableRun) key(keys int) string {
+	return "key:" + strconv.Itoa(run.random.Intn(keys))
+}
+
+func (run *hashTableRun) add(key string) {
+	value := "value:" + strconv.Itoa(run.step) + ":" + strconv.Itoa(run.random.Intn(1000))
+	run.apply(func() {
+		run.ht.Add(key, value)
+	})
+	if _, ok := run.model[key]; !ok {
+		run.positions[key] = len(run.stored)
+		run.stored = append(run.stored, key)
+	}
+	run.model[key] = value
+	run.check(key)
+}
+
+func (run *hashTableRun) delete(key string) {
+	var result string
+	var err error
+	run.apply(func() {
+		result, err = run.ht.Delete(key)
+	})
+
+	_, ok := run.model[key]
+	if ok && (err != nil || result != "Successfully removed") {
+		run.t.Fatalf("step %d: Delete(%q) of a stored key gave %q, %v", run.step, key, result, err)
+	}
+	if !ok && err == nil {
+		run.t.Fatalf("step %d: Delete(%q) of a missing key gave %q", run.step, key, result)
+	}
+	if position, ok := run.positions[key]; ok {
+		last := run.stored[len(run.stored)-1]
+		run.stored[position] = last
+		run.positions[last] = position
+		run.stored = run.stored[:len(run.stored)-1]
+		delete(run.positions, key)
+	}
+	delete(run.model, key)
+	run.check(key)
+}
+
+// apply runs one write and records how the table changed under it
+func (run *hashTableRun) apply(write func()) {
+	run.step++
+	capacity, rehashing := run.ht.capacity, run.ht.isRehashing()
+	write()
+
+	if rehashing {
+		run.states.rehashingWrites++
+	}
+	if run.ht.capacity > capacity {
+		run.states.grown++
+	} else if run.ht.capacity < capacity {
+		run.states.shrunk++
+	} else if !rehashing && run.ht.isRehashing() {
+		run.states.cleaned++
+	}
+	if run.ht.capacity > run.peak {
+		run.peak = run.ht.capacity
+	}
+	if run.ht.tombstones > run.states.maxTombstones {
+		run.states.maxTombstones = run.ht.tombstones
+	}
+}
+
+// check compares the written key, the counters and every few steps the
+// whole content with the model
+func (run *hashTableRun) check(key string) {
+	t, ht := run.t, run.ht
+
+	want, ok := run.model[key]
+	got, err := ht.Get(key)
+	if ok && (err != nil || got != want) {
+		t.Fatalf("step %d: Get(%q) = %q, %v, want %q", run.step, key, got, err, want)
+	}
+	if !ok && err == nil {
+		t.Fatalf("step %d: Get(%q) = %q for a deleted key", run.step, key, got)
+	}
+
+	if ht.Len() != len(run.model) {
+		t.Fatalf("step %d: Len() = %d, want %d", run.step, ht.Len(), len(run.model))
+	}
+	if ht.capacity != len(ht.Table) {
+		t.Fatalf("step %d: capacity %d for %d slots", run.step, ht.capacity, len(ht.Table))
+	}
+	if ht.count+ht.tombstones > ht.capacity {
+		t.Fatalf("step %d: %d entries and %d tombstones in %d slots", run.step, ht.count, ht.tombstones, ht.capacity)
+	}
+
+	if run.step%97 == 0 {
+		run.checkAll()
+	}
+}
+
+// checkAll compares every entry, the tombstone count and the memory count
+func (run *hashTableRun) checkAll() {
+	t, ht := run.t, run.ht
+
+	entries := ht.entries()
+	if len(entries) != len(run.model) {
+		t.Fatalf("step %d: %d entries, want %d", run.step, len(entries), len(run.model))
+	}
+	memory := int64(0)
+	for _, entry := range entries {
+		if run.model[entry.Key] != entry.Value {
+			t.Fatalf("step %d: entry %q = %q, want %q", run.step, entry.Key, entry.Value, run.model[entry.Key])
+		}
+		memory += hashEntrySize(entry.Key, entry.Value)
+	}
+	if ht.memory != memory {
+		t.Fatalf("step %d: memory %d, entries take %d", run.step, ht.memory, memory)
+	}
+
+	for _, key := range run.stored {
+		if got, err := ht.Get(key); err != nil || got != run.model[key] {
+			t.Fatalf("step %d: Get(%q) = %q, %v, want %q", run.step, key, got, err, run.model[key])
+		}
+	}
+
+	tombstones := 0
+	for _, node := range ht.Table {
+		if node == deletedNode {
+			tombstones++
+		}
+	}
+	if tombstones != ht.tombstones {
+		t.Fatalf("step %d: %d tombstones counted as %d", run.step, tombstones, ht.tombstones)
+	}
+}
+
+func TestHashTableGrowAndShrink(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		run := newHashTableRun(t, seed, 8)
+
+		// mostly adds until the table grew several times
+		for len(run.model) < 5000 {
+			if run.random.Intn(10) < 8 {
+				run.add(run.key(20000))
+			} else {
+				run.delete(run.key(20000))
+			}
+		}
+		// mostly deletes down to the minimum size
+		for len(run.model) > 10 {
+			if run.random.Intn(10) < 8 {
+				run.delete(run.storedKey())
+			} else {
+				run.add(run.key(20000))
+			}
+		}
+		run.checkAll()
+
+		if run.states.grown == 0 || run.states.shrunk == 0 || run.states.rehashingWrites == 0 {
+			t.Fatalf("seed %d: missed a state: %+v", seed, run.states)
+		}
+		// every halving waits until less than a tenth is used
+		if run.ht.capacity > run.peak/16 {
+			t.Fatalf("seed %d: capacity %d of %d with %d entries", seed, run.ht.capacity, run.peak, run.ht.Len())
+		}
+	}
+}
+
+func TestHashTableTombstones(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		run := newHashTableRun(t, seed, 64)
+
+		// a steady size with many different keys coming and going leaves
+		// tombstones behind until a same size resize cleans them up
+		for i := 0; i < 20000; i++ {
+			if len(run.model) < 300 || run.random.Intn(2) == 0 {
+				run.add("churn:" + strconv.Itoa(run.step))
+			} else {
+				run.delete(run.storedKey())
+			}
+		}
+		run.checkAll()
+
+		if run.states.cleaned == 0 || run.states.maxTombstones == 0 {
+			t.Fatalf("seed %d: tombstones were never cleaned up: %+v", seed, run.states)
+		}
+	}
+}
+
+func TestHashTableRehashInterleaved(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		run := newHashTableRun(t, seed, 8)
+
+		// a small key space gives overwrites and deletes of keys that are
+		// still in the old table while a resize runs
+		for i := 0; i < 30000; i++ {
+			key := run.key(3000)
+			switch run.random.Intn(3) {
+			case 0, 1:
+				run.add(key)
+			case 2:
+				run.delete(key)
+			}
+			if run.ht.isRehashing() && run.random.Intn(4) == 0 {
+				run.check(run.key(3000))
+			}
+		}
+		run.checkAll()
+
+		if run.states.rehashingWrites < 100 {
+			t.Fatalf("seed %d: only %d writes during a rehash", seed, run.states.rehashingWrites)
+		}
+	}
+}
+
+func TestHashTableMissingKeys(t *testing.T) {
+	ht := NewHashTable("test", 8)
+	if _, err := ht.Get("missing"); err == nil {
+		t.Fatal("Get of an empty table found a key")
+	}
+	if _, err := ht.Delete("missing"); err == nil {
+		t.Fatal("Delete of an empty table removed a key")
+	}
+
+	ht.Add("key", "first")
+	ht.Add("key", "second")
+	if got, _ := ht.Get("key"); got != "second" || ht.Len() != 1 {
+		t.Fatalf("overwrite gave %q with %d entries", got, ht.Len())
+	}
+	if ht.memory != hashEntrySize("key", "second") {
+		t.Fatalf("memory %d after an overwrite", ht.memory)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
+// Keyspace commands work on names whatever the kind of structure behind
+// them. One name can be used by a hash table, a stack, a queue, a set and
+// a sorted set at the same time, DEL and RENAME always take all of them.
+var keyspaceCommands = map[string]bool{
+	"EXISTS":  true,
+	"DEL":     true,
+	"TYPE":    true,
+	"RENAME":  true,
+	"KEYS":    true,
+	"FLUSHDB": true,
+}
+
+// commands that add, drop or rename whole databases, they need db.mutex
+// exclusively
+var databaseCommands = map[string]bool{
+	"DBDROP":   true,
+	"DBRENAME": true,
+}
+
+// kinds lists what name is used by, in the order TYPE replies them
+func (base *DatabaseStruct) kinds(name string, now int64) []string {
+	kinds := []string{}
+	if base.nameExpired(name, now) {
+		return kinds
+	}
+	if findHashTable(base, name) != nil {
+		kinds = append(kinds, "hash")
+	}
+	if findStack(base, name) != nil {
+		kinds = append(kinds, "stack")
+	}
+	if findQueue(base, name) != nil {
+		kinds = append(kinds, "queue")
+	}
+	if findSet(base, name) != nil {
+		kinds = append(kinds, "set")
+	}
+	if findSortedSet(base, name) != nil {
+		kinds = append(kinds, "zset")
+	}
+	return kinds
+}
+
+// the kind of structure commands that read or take from one expect, SPOP
+// also takes from sets
+var commandKinds = map[string]string{
+	"HGET":  "hash",
+	"HDEL":  "hash",
+	"HSCAN": "hash",
+
+	"SPOP": "stack",
+
+	"QPOP":       "queue",
+	"QRESERVEAT": "queue",
+	"QACK":       "queue",
+	"QREQUEUE":   "queue",
+	"QDEAD":      "queue",
+	"QPROMOTE":   "queue",
+
+	"SREM":        "set",
+	"SISMEMBER":   "set",
+	"SMEMBERS":    "set",
+	"SCARD":       "set",
+	"SRANDMEMBER": "set",
+	"SSCAN":       "set",
+
+	"ZSCORE":           "zset",
+	"ZRANK":            "zset",
+	"ZREVRANK":         "zset",
+	"ZRANGE":           "zset",
+	"ZREVRANGE":        "zset",
+	"ZRANGEBYSCORE":    "zset",
+	"ZREVRANGEBYSCORE": "zset",
+	"ZREM":             "zset",
+	"ZCARD":            "zset",
+	"ZSCAN":            "zset",
+}
+
+const wrongTypeReply = "Operation against a name holding the wrong kind of structure"
+
+// wrongKind tells that the command expects a kind of structure its name
+// is not used by while other kinds use it. Commands that create what they
+// need never get the kind wrong.
+func (base *DatabaseStruct) wrongKind(action string, args []string, now int64) bool {
+	kind := commandKinds[action]
+	if action == "SPOP" && base.popsSet(args, now) {
+		kind = "set"
+	}
+	if kind == "" {
+		return false
+	}
+	kinds := base.kinds(args[1], now)
+	for _, other := range kinds {
+		if other == kind {
+			return false
+		}
+	}
+	return len(kinds) > 0
+}
+
+// rename moves every structure called from to to, with its deadline,
+// after dropping what to held. Caller must hold the database exclusively.
+func (base *DatabaseStruct) rename(from string, to string) {
+	base.removeStructures(to)
+
+	// the names are part of what structures take, see memory.go
+	longer := int64(len(to) - len(from))
+
+	for i := range base.HashTables {
+		if base.HashTables[i].Name == from {
+			base.HashTables[i].Name = to
+			trackMemory(longer)
+		}
+	}
+	for i := range base.Stacks {
+		if base.Stacks[i].Name == from {
+			base.Stacks[i].Name = to
+			trackMemory(longer)
+		}
+	}
+	for i := range base.Queues {
+		if base.Queues[i].Name == from {
+			base.Queues[i].Name = to
+			trackMemory(longer)
+		}
+	}
+	for i := range base.Sets {
+		if base.Sets[i].Name == from {
+			base.Sets[i].Name = to
+			base.Sets[i].ht.Name = to
+			trackMemory(longer)
+		}
+	}
+	for i := range base.SortedSets {
+		if base.SortedSets[i].Name == from {
+			base.SortedSets[i].Name = to
+			trackMemory(longer)
+		}
+	}
+
+	if at, ok := base.expires[from]; ok {
+		base.expires[to] = at
+		delete(base.expires, from)
+	}
+	base.touch(from, "")
+	base.touch(to, "")
+}
+
+// flush drops every structure and marks every watching transaction,
+// caller must hold the database exclusively
+func (base *DatabaseStruct) flush() {
+	trackMemory(-base.memoryUsage())
+	base.HashTables = nil
+	base.Stacks = nil
+	base.Queues = nil
+	base.Sets = nil
+	base.SortedSets = nil
+	base.expires = nil
+
+	for name := range base.watchers {
+		base.touch(name, "")
+	}
+}
+
+// wakeBlocked ends the wait of every client blocked in the database, they
+// reply that the database is gone. Caller must hold it exclusively.
+func (base *DatabaseStruct) wakeBlocked() {
+	for _, clients := range base.blocked {
+		for _, client := range clients {
+			if client.served {
+				continue
+			}
+			client.served = true
+			close(client.result)
+		}
+	}
+	base.blocked = nil
+}
+
+// executeKeyspace runs EXISTS, DEL, TYPE, RENAME, KEYS and FLUSHDB. It
+// returns the pops done for clients waiting on a renamed stack or queue so
+// the caller records them.
+func executeKeyspace(out reply, base *DatabaseStruct, action string, args []string) [][]string {
+	now := nowMillis()
+
+	switch action {
+	case "EXISTS":
+		found := 0
+		for _, name := range args[1:] {
+			if !base.nameExpired(name, now) && base.exists(name) {
+				found++
+			}
+		}
+		out.integer(int64(found))
+	case "DEL":
+		removed := 0
+		for _, name := range args[1:] {
+			if base.expireIfNeeded(name, now) {
+				continue
+			}
+			if base.removeStructures(name) > 0 {
+				removed++
+			}
+		}
+		out.integer(int64(removed))
+	case "TYPE":
+		kinds := base.kinds(args[1], now)
+		if len(kinds) == 0 {
+			out.status("none")
+			return nil
+		}
+		out.status(strings.Join(kinds, " "))
+	case "RENAME":
+		// an expired source is already gone, runCommand removed it
+		if !base.exists(args[1]) {
+			writeError(out, codeNoSuchKey, "No such key")
+			return nil
+		}
+		if args[1] != args[2] {
+			base.rename(args[1], args[2])
+		}
+		out.status("OK")
+		served := base.serveBlocked(true, args[2])
+		return append(served, base.serveBlocked(false, args[2])...)
+	case "KEYS":
+		// a page as large as there are slots takes every name
+		items, _ := base.structurePage(0, math.MaxInt32, now)
+		names := []string{}
+		for _, item := range items {
+			if matchPattern(args[1], item.name) {
+				names = append(names, item.name)
+			}
+		}
+		sort.Strings(names)
+		out.array(names)
+	case "FLUSHDB":
+		base.flush()
+		out.status("OK")
+	}
+
+	return nil
+}
+
+// executeDatabaseCommand runs DBDROP and DBRENAME, caller must hold
+// db.mutex exclusively. Clients blocked in the database are woken, the
+// name they wait on does not lead to it anymore. It tells whether the
+// command was recorded.
+func executeDatabaseCommand(out reply, action string, args []string, source commandSource) bool {
+	base := db.findDatabase(args[1])
+	if base == nil {
+		writeError(out, codeNoSuchKey, "Database doesnt exist")
+		return false
+	}
+	if action == "DBRENAME" && db.findDatabase(args[2]) != nil {
+		writeError(out, codeError, "Database already exists")
+		return false
+	}
+
+	base.mutex.Lock()
+	defer base.mutex.Unlock()
+
+	switch action {
+	case "DBDROP":
+		base.flush()
+		databases := db.databasesList[:0]
+		for _, other := range db.databasesList {
+			if other != base {
+				databases = append(databases, other)
+			}
+		}
+		db.databasesList = databases
+	case "DBRENAME":
+		for name := range base.watchers {
+			base.touch(name, "")
+		}
+		base.Name = args[2]
+	}
+	base.wakeBlocked()
+	out.status("OK")
+
+	if source == fromLog {
+		return false
+	}
+	base.record([][]string{args})
+	return true
+}
+
+// executeDatabaseList replies the name of every database
+func executeDatabaseList(out reply) {
+	names := []string{}
+	for _, base := range db.databasesList {
+		names = append(names, base.Name)
+	}
+	sort.Strings(names)
+	out.array(names)
+}
@@ -1,24 +1,43 @@
 package main
 
 import (
+	"bufio"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math/rand"
 	"net"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // stack
 type Node struct {
 	data string
 	next *Node
+	// deliveries by QRESERVE so far, queues only
+	attempts int
 }
 
 type Stack struct {
 	Name string
 	head *Node
+	// bytes of the items, see memory.go
+	memory int64
+}
+
+func NewStack(name string) *Stack {
+	trackMemory(structureSize(name))
+	return &Stack{Name: name}
 }
 
 func (stack *Stack) pop() (string, error) {
@@ -27,11 +46,13 @@ func (stack *Stack) pop() (string, error) {
 	} else {
 		x := stack.head.data
 		stack.head = stack.head.next
+		addMemory(&stack.memory, -listItemSize(x))
 		return x, nil
 	}
 }
 
 func (stack *Stack) push(val string) {
+	addMemory(&stack.memory, listItemSize(val))
 	newNode := &Node{data: val}
 	if stack.head == nil {
 		stack.head = newNode
@@ -48,9 +69,22 @@ type Queue struct {
 	Name string
 	head *Node
 	tail *Node
+	// items taken by QRESERVE and not acknowledged yet, by id
+	inFlight map[string]*reservation
+	// items pushed with a delay, by the time they become visible
+	delayed  delayedHeap
+	sequence int64
+	// bytes of the items in all three places, see memory.go
+	memory int64
+}
+
+func NewQueue(name string) *Queue {
+	trackMemory(structureSize(name))
+	return &Queue{Name: name}
 }
 
 func (queue *Queue) push(val string) {
+	addMemory(&queue.memory, listItemSize(val))
 	newNode := &Node{data: val}
 	if queue.head == nil {
 		queue.head = newNode
@@ -67,6 +101,7 @@ func (queue *Queue) pop() (string, error) {
 	} else {
 		data := queue.head.data
 		queue.head = queue.head.next
+		addMemory(&queue.memory, -listItemSize(data))
 		return data, nil
 	}
 }
@@ -75,101 +110,319 @@ func (queue *Queue) pop() (string, error) {
 type HashTableNode struct {
 	Key   string
 	Value string
+
+	// last access in unix milliseconds and the access counter, for
+	// eviction. Reads share the database lock, so both go through
+	// sync/atomic.
+	accessed int64
+	hits     uint32
 }
 
+// tables never shrink below this size on their own
+const hashTableMinCapacity = 512
+
+// grow when more than 3/4 of the slots are used
+const hashTableMaxLoad = 0.75
+
+// shrink when less than 1/10 of the slots are used
+const hashTableMinLoad = 0.1
+
+// old slots moved to the new table by every write while rehashing
+const hashTableRehashStep = 16
+
+var HASHTABLE_SHRINK = true
+
+// deletedNode is the tombstone left in a slot whose entry was deleted or
+// moved away by a rehash. Lookups probe past it like past any used slot so
+// keys stored further along the probe sequence stay reachable, inserts
+// may reuse it.
+var deletedNode = &HashTableNode{}
+
 type HashTable struct {
-	Name     string
-	Table    []*HashTableNode
-	capacity int
+	Name        string
+	Table       []*HashTableNode
+	capacity    int
+	count       int
+	tombstones  int
+	minCapacity int
+
+	// while a resize is in progress the entries move from oldTable to
+	// Table a few slots per write, rehashIndex is the next old slot to move
+	oldTable    []*HashTableNode
+	rehashIndex int
+
+	// deadlines of fields that expire, unix milliseconds
+	expires map[string]int64
+
+	// bytes of the entries, see memory.go
+	memory int64
 }
 
-func (ht *HashTable) hashFunc(key string) int {
-	hash := 0
-	for _, c := range key {
-		hash += int(c)
-	}
-	return hash % ht.capacity
+func hashFunc(key string, capacity int) int {
+	return int(hashKey(key) % uint32(capacity))
 }
 
-func (ht *HashTable) doubleHashFunc(key string) int {
-	seed := 31
-	hash := 0
-	for _, c := range key {
-		hash = (hash*seed + int(c)) % ht.capacity
-	}
-	return hash
+// hashKey is the full hash slots are picked from, SCAN walks by its low
+// bits
+func hashKey(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32()
 }
 
 func NewHashTable(name string, capacity int) *HashTable {
+	capacity = roundCapacity(capacity)
+	minCapacity := capacity
+	if minCapacity > hashTableMinCapacity {
+		minCapacity = hashTableMinCapacity
+	}
+	trackMemory(structureSize(name) + int64(capacity)*hashSlotSize)
 	return &HashTable{
-		Name:     name,
-		Table:    make([]*HashTableNode, capacity),
-		capacity: capacity,
+		Name:        name,
+		Table:       make([]*HashTableNode, capacity),
+		capacity:    capacity,
+		minCapacity: minCapacity,
+	}
+}
+
+// roundCapacity gives the next power of two
+func roundCapacity(capacity int) int {
+	result := 1
+	for result < capacity {
+		result *= 2
+	}
+	return result
+}
+
+// probe looks for key in table and returns its slot. When the key is not
+// there it returns the slot an insert should use: the first tombstone on
+// the way or else the empty slot that ended the probe.
+//
+// Probing goes on to the next slot, so a key always sits in the run of
+// used slots that starts at its home slot. SCAN finds the keys of a slot
+// that way, see scanSlot.
+func probe(table []*HashTableNode, key string) (int, bool) {
+	capacity := len(table)
+	index := hashFunc(key, capacity)
+	free := -1
+
+	for i := 0; i < capacity; i++ {
+		node := table[index]
+		if node == nil {
+			if free == -1 {
+				free = index
+			}
+			return free, false
+		}
+		if node == deletedNode {
+			if free == -1 {
+				free = index
+			}
+		} else if node.Key == key {
+			return index, true
+		}
+		index = (index + 1) % capacity
+	}
+
+	return free, false
+}
+
+// place stores node in a free slot of Table found by probe
+func (ht *HashTable) place(index int, node *HashTableNode) {
+	if ht.Table[index] == deletedNode {
+		ht.tombstones--
+	}
+	ht.Table[index] = node
+}
+
+func (ht *HashTable) isRehashing() bool {
+	return ht.oldTable != nil
+}
+
+// resize starts moving everything into a table of newCapacity slots,
+// a resize that is still running is finished first. Tombstones are not
+// copied, so resizing to the same capacity just cleans them up.
+func (ht *HashTable) resize(newCapacity int) {
+	for ht.isRehashing() {
+		ht.rehashStep()
+	}
+
+	ht.oldTable = ht.Table
+	ht.rehashIndex = 0
+	ht.Table = make([]*HashTableNode, newCapacity)
+	trackMemory(int64(newCapacity) * hashSlotSize)
+	ht.capacity = newCapacity
+	ht.tombstones = 0
+}
+
+// rehashStep moves up to hashTableRehashStep entries and looks at no more
+// than ten times as many slots, so one call never costs the whole copy
+func (ht *HashTable) rehashStep() {
+	if !ht.isRehashing() {
+		return
+	}
+
+	moved := 0
+	for visited := 0; visited < hashTableRehashStep*10 && moved < hashTableRehashStep; visited++ {
+		if ht.rehashIndex >= len(ht.oldTable) {
+			break
+		}
+
+		node := ht.oldTable[ht.rehashIndex]
+		if node != nil {
+			if node != deletedNode {
+				index, _ := probe(ht.Table, node.Key)
+				ht.place(index, node)
+				moved++
+			}
+			ht.oldTable[ht.rehashIndex] = deletedNode
+		}
+		ht.rehashIndex++
+	}
+
+	if ht.rehashIndex >= len(ht.oldTable) {
+		trackMemory(-int64(len(ht.oldTable)) * hashSlotSize)
+		ht.oldTable = nil
+		ht.rehashIndex = 0
 	}
 }
 
+func (ht *HashTable) Len() int {
+	return ht.count
+}
+
 func (ht *HashTable) Add(key, value string) {
-	entry := &HashTableNode{
-		Key:   key,
-		Value: value,
+	ht.rehashStep()
+
+	// a new value starts without deadline
+	ht.dropDeadline(key)
+
+	now := nowMillis()
+	index, found := probe(ht.Table, key)
+	if found {
+		//rewrite if found that key
+		node := ht.Table[index]
+		addMemory(&ht.memory, int64(len(value)-len(node.Value)))
+		node.Value = value
+		node.access(now)
+		return
 	}
-	index := ht.hashFunc(key)
 
-	if ht.Table[index] == nil {
-		ht.Table[index] = entry
-	} else {
-		if ht.Table[index].Key == key {
-			//rewrite if found that key
-			ht.Table[index].Value = value
+	if ht.isRehashing() {
+		oldIndex, oldFound := probe(ht.oldTable, key)
+		if oldFound {
+			// rewrite and move it to the new table at once
+			node := ht.oldTable[oldIndex]
+			addMemory(&ht.memory, int64(len(value)-len(node.Value)))
+			node.Value = value
+			node.access(now)
+			ht.oldTable[oldIndex] = deletedNode
+			ht.place(index, node)
+			return
+		}
+	}
+
+	// tombstones make probes as long as live entries do, so they count
+	// for the load too
+	if ht.Table[index] == nil && float64(ht.count+ht.tombstones+1) > float64(ht.capacity)*hashTableMaxLoad {
+		if float64(ht.count+1) > float64(ht.capacity)*hashTableMaxLoad/2 {
+			ht.resize(ht.capacity * 2)
 		} else {
-			offset := ht.doubleHashFunc(key)
-			for ht.Table[(index+offset)%ht.capacity] != nil {
-				if ht.Table[(index+offset)%ht.capacity].Key == key {
-					// rewrite if found too
-					ht.Table[(index+offset)%ht.capacity].Value = value
-					return
-				}
-				offset = (offset + ht.doubleHashFunc(key)) % ht.capacity
-			}
-			ht.Table[(index+offset)%ht.capacity] = entry
+			ht.resize(ht.capacity)
 		}
+		index, _ = probe(ht.Table, key)
 	}
+
+	ht.place(index, &HashTableNode{Key: key, Value: value, accessed: now, hits: lfuInitial})
+	ht.count++
+	addMemory(&ht.memory, hashEntrySize(key, value))
 }
 
 func (ht *HashTable) Get(key string) (string, error) {
-	index := ht.hashFunc(key)
-	if ht.Table[index] != nil && ht.Table[index].Key == key {
-		return ht.Table[index].Value, nil
-	} else {
-		offset := ht.doubleHashFunc(key)
-		for ht.Table[(index+offset)%ht.capacity] != nil && ht.Table[(index+offset)%ht.capacity].Key != key {
-			offset = (offset + ht.doubleHashFunc(key)) % ht.capacity
-		}
-		if ht.Table[(index+offset)%ht.capacity] != nil {
-			return ht.Table[(index+offset)%ht.capacity].Value, nil
+	now := nowMillis()
+	if ht.expired(key, now) {
+		return "", errors.New("Key not found")
+	}
+
+	node := ht.lookup(key)
+	if node == nil {
+		return "", errors.New("Key not found")
+	}
+	node.access(now)
+	return node.Value, nil
+}
+
+// lookup finds the entry of key in either table, nil when there is none
+func (ht *HashTable) lookup(key string) *HashTableNode {
+	index, found := probe(ht.Table, key)
+	if found {
+		return ht.Table[index]
+	}
+
+	if ht.isRehashing() {
+		index, found = probe(ht.oldTable, key)
+		if found {
+			return ht.oldTable[index]
 		}
 	}
-	return "", errors.New("Key not found")
+
+	return nil
 }
 
 func (ht *HashTable) Delete(key string) (string, error) {
-	index := ht.hashFunc(key)
-
-	if ht.Table[index] != nil && ht.Table[index].Key == key {
-		ht.Table[index] = nil
-		return "Successfully removed", nil
-	} else {
-		offset := ht.doubleHashFunc(key)
-		for ht.Table[(index+offset)%ht.capacity] != nil && ht.Table[(index+offset)%ht.capacity].Key != key {
-			offset = (offset + ht.doubleHashFunc(key)) % ht.capacity
+	ht.rehashStep()
+
+	expired := ht.expired(key, nowMillis())
+	ht.dropDeadline(key)
+
+	var node *HashTableNode
+	index, found := probe(ht.Table, key)
+	if found {
+		node = ht.Table[index]
+		ht.Table[index] = deletedNode
+		ht.tombstones++
+	} else if ht.isRehashing() {
+		index, found = probe(ht.oldTable, key)
+		if found {
+			node = ht.oldTable[index]
+			ht.oldTable[index] = deletedNode
 		}
-		if ht.Table[(index+offset)%ht.capacity] != nil && ht.Table[(index+offset)%ht.capacity].Key == key {
-			ht.Table[(index+offset)%ht.capacity] = nil
-			return "Successfully removed", nil
+	}
+
+	if !found {
+		return "", errors.New("Key not found")
+	}
+
+	ht.count--
+	addMemory(&ht.memory, -hashEntrySize(node.Key, node.Value))
+	if !ht.isRehashing() {
+		if HASHTABLE_SHRINK && ht.capacity > ht.minCapacity && float64(ht.count) < float64(ht.capacity)*hashTableMinLoad {
+			ht.resize(ht.capacity / 2)
+		} else if float64(ht.tombstones) > float64(ht.capacity)*hashTableMaxLoad/2 {
+			ht.resize(ht.capacity)
 		}
 	}
 
-	return "", errors.New("Key not found")
+	if expired {
+		return "", errors.New("Key not found")
+	}
+	return "Successfully removed", nil
+}
+
+// entries lists every stored pair, including the ones not yet rehashed
+// and leaving out the expired ones
+func (ht *HashTable) entries() []HashTableNode {
+	result := []HashTableNode{}
+	now := nowMillis()
+	for _, table := range [][]*HashTableNode{ht.Table, ht.oldTable} {
+		for _, element := range table {
+			if element != nil && element != deletedNode && !ht.expired(element.Key, now) {
+				// the access counters stay behind, readers update them
+				result = append(result, HashTableNode{Key: element.Key, Value: element.Value})
+			}
+		}
+	}
+	return result
 }
 
 // set
@@ -212,60 +465,259 @@ type DatabaseStruct struct {
 	Stacks     []Stack
 	Queues     []Queue
 	Sets       []Set
+	SortedSets []SortedSet
+
+	// deadlines of whole structures by name, unix milliseconds
+	expires map[string]int64
+
+	// transactions watching a structure ("" field) or one hash field
+	watchers map[string]map[string]map[*transaction]bool
+	// clients waiting in BQPOP and BSPOP
+	blocked map[blockKey][]*blockedClient
+
+	// writes hold it exclusively, reads share it
+	mutex sync.RWMutex
 }
 
+// Locking goes from the outside in: db.mutex, then the mutex of one
+// database, then the persistence locks. Every command holds db.mutex for
+// reading while it runs, so only adding a database or shutting down has
+// to wait for all of them.
 type MainDatabaseStructure struct {
-	databasesList []DatabaseStruct
-	mutex         sync.Mutex
+	databasesList []*DatabaseStruct
+	mutex         sync.RWMutex
+
+	// changes since the last snapshot, updated atomically
+	dirty int64
+
+	saveMutex        sync.Mutex
+	lastSave         time.Time
+	bgsaveInProgress bool
 }
 
-func (db *DatabaseStruct) dump() {
-	fmt.Println("--- HashTables: ")
-	for _, table := range db.HashTables {
-		fmt.Print(table.Name, ": ")
-		for _, element := range table.Table {
-			fmt.Print(element, " ")
-		}
-		fmt.Println()
-	}
+// commands that work on the whole server instead of one database
+var serverCommands = map[string]bool{
+	"SAVE":         true,
+	"BGSAVE":       true,
+	"BGREWRITEAOF": true,
+	"LASTSAVE":     true,
+	"INFO":         true,
+	"REPLICAOF":    true,
+	"PUBLISH":      true,
+	"DUMP":         true,
+	"DBLIST":       true,
+}
 
-	fmt.Println("--- Stacks: ")
+// commands that change data and have to reach the next snapshot
+var writeCommands = map[string]bool{
+	"SPUSH": true,
+	"SPOP":  true,
+	"QPUSH": true,
+	"QPOP":  true,
+	"HSET":  true,
+	"HDEL":  true,
+	"SADD":  true,
+	"SREM":  true,
+
+	"EXPIRE":    true,
+	"PEXPIREAT": true,
+	"PERSIST":   true,
+
+	"BQPOP": true,
+	"BSPOP": true,
+
+	"QRESERVE":   true,
+	"QRESERVEAT": true,
+	"QACK":       true,
+	"QREQUEUE":   true,
+	"QDEAD":      true,
+	"QPUSHAT":    true,
+	"QPROMOTE":   true,
+
+	"SUNIONSTORE": true,
+	"SINTERSTORE": true,
+	"SDIFFSTORE":  true,
+
+	"ZADD":    true,
+	"ZINCRBY": true,
+	"ZREM":    true,
+
+	"DEL":      true,
+	"RENAME":   true,
+	"FLUSHDB":  true,
+	"DBDROP":   true,
+	"DBRENAME": true,
+}
 
-	for _, st := range db.Stacks {
-		fmt.Print(st.Name, ": ")
+// smallest number of arguments including the command itself
+var commandArity = map[string]int{
+	"SPUSH":     3,
+	"SPOP":      2,
+	"QPUSH":     3,
+	"QPOP":      2,
+	"HSET":      4,
+	"HGET":      3,
+	"HDEL":      3,
+	"SADD":      3,
+	"SREM":      3,
+	"SISMEMBER": 3,
+	"EXPIRE":    3,
+	"PEXPIREAT": 3,
+	"PERSIST":   2,
+	"TTL":       2,
+	"REPLICAOF": 3,
+	"PUBLISH":   3,
+	"BQPOP":     3,
+	"BSPOP":     3,
+
+	"QRESERVE":   3,
+	"QRESERVEAT": 4,
+	"QACK":       3,
+	"QREQUEUE":   3,
+	"QDEAD":      3,
+	"QPUSHAT":    4,
+	"QPROMOTE":   3,
+
+	"SMEMBERS":    2,
+	"SCARD":       2,
+	"SUNION":      2,
+	"SINTER":      2,
+	"SDIFF":       2,
+	"SUNIONSTORE": 3,
+	"SINTERSTORE": 3,
+	"SDIFFSTORE":  3,
+	"SRANDMEMBER": 2,
+
+	"ZADD":             4,
+	"ZINCRBY":          4,
+	"ZSCORE":           3,
+	"ZRANK":            3,
+	"ZREVRANK":         3,
+	"ZRANGE":           4,
+	"ZREVRANGE":        4,
+	"ZRANGEBYSCORE":    4,
+	"ZREVRANGEBYSCORE": 4,
+	"ZREM":             3,
+	"ZCARD":            2,
+
+	"SCAN":  2,
+	"HSCAN": 3,
+	"SSCAN": 3,
+	"ZSCAN": 3,
+
+	"DUMP": 2,
+
+	"EXISTS":   2,
+	"DEL":      2,
+	"TYPE":     2,
+	"RENAME":   3,
+	"KEYS":     2,
+	"FLUSHDB":  1,
+	"DBLIST":   1,
+	"DBDROP":   2,
+	"DBRENAME": 3,
+}
 
-		some := st
+var LISTEN_ADDRESS = ":6379"
 
-		for {
-			result, err := some.pop()
-			if err == nil {
-				fmt.Print(result, " ")
-			} else {
-				break
-			}
-		}
-		fmt.Println()
+var db MainDatabaseStructure
+
+func main() {
+	flag.StringVar(&SNAPSHOT_FILE, "snapshot", SNAPSHOT_FILE, "path of the snapshot file")
+	flag.DurationVar(&SNAPSHOT_INTERVAL, "snapshot-interval", SNAPSHOT_INTERVAL, "how often changed data is saved, 0 disables periodic saves")
+	flag.BoolVar(&APPEND_ONLY, "appendonly", APPEND_ONLY, "log every write command and replay the log on start")
+	flag.StringVar(&APPEND_FILE, "appendfile", APPEND_FILE, "path of the append only log")
+	flag.StringVar(&APPEND_FSYNC, "appendfsync", APPEND_FSYNC, "when the log is flushed to disk: always, everysec or no")
+	flag.BoolVar(&HASHTABLE_SHRINK, "hashtable-shrink", HASHTABLE_SHRINK, "give memory back when hash tables get mostly empty")
+	flag.IntVar(&MAX_COMMAND_SIZE, "max-command-size", MAX_COMMAND_SIZE, "biggest legacy command in bytes")
+	flag.IntVar(&CLIENT_OUTPUT_BUFFER, "client-output-buffer", CLIENT_OUTPUT_BUFFER, "reply bytes a connection collects before it waits for the client to read them")
+	flag.DurationVar(&CLIENT_OUTPUT_TIMEOUT, "client-output-timeout", CLIENT_OUTPUT_TIMEOUT, "how long a client may take to read its replies before it is disconnected, 0 waits forever")
+	flag.Int64Var(&MAX_MEMORY, "maxmemory", MAX_MEMORY, "approximate bytes the stored data may take, 0 for no limit")
+	flag.StringVar(&MAX_MEMORY_POLICY, "maxmemory-policy", MAX_MEMORY_POLICY, "what a write over -maxmemory does: noeviction refuses it, allkeys-lru, volatile-ttl and allkeys-lfu evict hash entries")
+	flag.StringVar(&LISTEN_ADDRESS, "listen", LISTEN_ADDRESS, "address the server accepts connections on")
+	flag.IntVar(&QUEUE_MAX_ATTEMPTS, "queue-max-attempts", QUEUE_MAX_ATTEMPTS, "deliveries of a reserved queue item before it goes to the dead letter queue")
+	flag.StringVar(&REPLICA_OF, "replicaof", REPLICA_OF, "host:port of a primary to replicate, empty to be a primary")
+	flag.StringVar(&USERS_FILE, "users", USERS_FILE, "file with the users and their permissions, empty lets everybody in")
+	flag.StringVar(&PRIMARY_USER, "primary-user", PRIMARY_USER, "user a replica logs in to its primary as")
+	flag.StringVar(&PRIMARY_PASSWORD, "primary-password", PRIMARY_PASSWORD, "password a replica logs in to its primary with")
+	flag.StringVar(&TLS_LISTEN_ADDRESS, "tls-listen", TLS_LISTEN_ADDRESS, "address of an additional TLS listener, empty for plaintext only")
+	flag.StringVar(&TLS_CERT_FILE, "tls-cert", TLS_CERT_FILE, "PEM file with the certificate of the TLS listener")
+	flag.StringVar(&TLS_KEY_FILE, "tls-key", TLS_KEY_FILE, "PEM file with the key of the TLS listener")
+	flag.StringVar(&TLS_CLIENT_CA_FILE, "tls-client-ca", TLS_CLIENT_CA_FILE, "PEM file with the CAs client certificates are checked against, empty accepts clients without one")
+	passwordToHash := flag.String("hash-password", "", "print the hash of a password for the users file and exit")
+	flag.Parse()
+
+	if *passwordToHash != "" {
+		fmt.Println(hashPassword(*passwordToHash))
+		return
+	}
+	if !validEvictionPolicy(MAX_MEMORY_POLICY) {
+		fmt.Println("Unknown -maxmemory-policy", MAX_MEMORY_POLICY)
+		return
 	}
-	fmt.Println(db.Stacks)
 
-	fmt.Println("--- Sets: ")
+	rand.Seed(time.Now().UnixNano())
 
-	fmt.Println(db.Sets)
+	if USERS_FILE != "" {
+		users, err := loadUsers(USERS_FILE)
+		if err != nil {
+			fmt.Println("Could not load users: ", err)
+			return
+		}
+		aclUsers = users
+		fmt.Println("Loaded", len(users), "users from", USERS_FILE)
+	}
 
-}
+	err := loadData()
+	if err != nil {
+		fmt.Println("Could not load data: ", err)
+		return
+	}
+	db.saveMutex.Lock()
+	db.lastSave = time.Now()
+	db.saveMutex.Unlock()
 
-var db MainDatabaseStructure
+	if SNAPSHOT_INTERVAL > 0 {
+		go db.snapshotLoop(SNAPSHOT_INTERVAL)
+	}
+	go db.expireLoop(EXPIRE_CYCLE_INTERVAL)
+	go saveOnShutdown()
+	go replication.pingLoop()
 
-func main() {
-	db = MainDatabaseStructure{}
-	listener, err := net.Listen("tcp", ":6379")
+	listener, err := net.Listen("tcp", LISTEN_ADDRESS)
 	if err != nil {
 		fmt.Println("Something went wrong: ", err)
 		return
 	}
 	defer listener.Close()
 
-	fmt.Println("Server up on 6379")
+	fmt.Println("Server up on", LISTEN_ADDRESS)
+
+	if TLS_LISTEN_ADDRESS != "" {
+		config, err := loadTLSConfig()
+		if err != nil {
+			fmt.Println("Could not set up TLS: ", err)
+			return
+		}
+		tlsListener, err := tls.Listen("tcp", TLS_LISTEN_ADDRESS, config)
+		if err != nil {
+			fmt.Println("Something went wrong: ", err)
+			return
+		}
+		defer tlsListener.Close()
+
+		fmt.Println("TLS up on", TLS_LISTEN_ADDRESS)
+		go serveTLS(tlsListener)
+	}
+
+	if REPLICA_OF != "" {
+		host, port, err := net.SplitHostPort(REPLICA_OF)
+		if err != nil {
+			fmt.Println("Bad -replicaof address: ", err)
+			return
+		}
+		replication.replicaOf(host, port)
+	}
 
 	for {
 		conn, err := listener.Accept()
@@ -278,14 +730,105 @@ func main() {
 	}
 }
 
+// loadData restores the databases before any client can connect. The
+// append only log is the complete history when it exists, otherwise the
+// snapshot is loaded and written into a fresh log.
+func loadData() error {
+	if APPEND_ONLY {
+		found, err := replayAppendOnlyLog(APPEND_FILE)
+		if err != nil {
+			return err
+		}
+		if found {
+			fmt.Println("Loaded", len(db.databasesList), "databases from", APPEND_FILE)
+		}
+
+		aof, err = openAppendOnlyLog(APPEND_FILE, APPEND_FSYNC)
+		if err != nil {
+			return err
+		}
+		if found {
+			return nil
+		}
+	}
+
+	databases, err := loadSnapshot(SNAPSHOT_FILE)
+	if err != nil {
+		return err
+	}
+	if databases != nil {
+		db.mutex.Lock()
+		db.databasesList = databases
+		recountMemory()
+		db.mutex.Unlock()
+		fmt.Println("Loaded", len(databases), "databases from", SNAPSHOT_FILE)
+
+		if aof != nil {
+			return aof.rewriteNow()
+		}
+	}
+
+	return nil
+}
+
+// saveOnShutdown makes the last snapshot when docker stops the container
+func saveOnShutdown() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+
+	// waits for the running commands and keeps new ones out
+	db.mutex.Lock()
+	if aof != nil {
+		err := aof.close()
+		if err != nil {
+			fmt.Println("Could not close append only file: ", err)
+		}
+	}
+	err := db.save()
+	if err != nil {
+		fmt.Println("Could not save on shutdown: ", err)
+		os.Exit(1)
+	}
+	fmt.Println("Saved to", SNAPSHOT_FILE)
+	os.Exit(0)
+}
+
 func handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	buffer := make([]byte, 1024)
+	// RESP clients always start with an array, the legacy format never does
+	reader := bufio.NewReaderSize(conn, clientInputBuffer)
+	first, err := reader.Peek(1)
+	if err == nil && first[0] == '*' {
+		handleRespConnection(conn, reader)
+		return
+	}
+
+	frames := newFrameReader(reader, MAX_COMMAND_SIZE)
+	output := newClientOutput(conn)
+	defer output.Flush()
+	tx := &transaction{}
+	defer tx.close()
+	auth := newAuthState()
 
 	for {
-		n, err := conn.Read(buffer)
+		err := flushReplies(output, reader)
+		if err != nil {
+			fmt.Println("Error while writing replies: ", err)
+			break
+		}
+
+		command, err := frames.next()
 		if err != nil {
+			var frameErr *frameError
+			if errors.As(err, &frameErr) {
+				writeLegacyError(output, codeSyntax, frameErr.Error())
+				if frameErr.fatal {
+					break
+				}
+				continue
+			}
 			if err == io.EOF {
 				fmt.Println("Connection closed for", conn.LocalAddr())
 			} else {
@@ -294,11 +837,11 @@ func handleConnection(conn net.Conn) {
 			break
 		}
 
-		db.mutex.Lock()
-
-		command := string(buffer[:n])
-
 		parts := strings.Split(command, " ")
+		if len(parts) < 2 || (parts[0] != "dump" && len(parts) < 4) {
+			writeLegacyError(output, codeSyntax, "Malformed command, expected --file <database> --query \"<command>\"")
+			continue
+		}
 
 		// if len(parts) < 5 {
 		// 	fmt.Println("incorrecy amount of arguments")
@@ -309,18 +852,14 @@ func handleConnection(conn net.Conn) {
 		file := parts[0]
 
 		if file == "dump" {
-			flagFoundDatabaseWhenDumping := 0
-			for _, v := range db.databasesList {
-				// fmt.Println("comparing ", v.Name, " with ", parts[1], "result is ", v.Name == parts[1])
-				if v.Name == strings.TrimSpace(parts[1]) {
-					v.dump()
-					flagFoundDatabaseWhenDumping = 1
-				}
-			}
-
-			if flagFoundDatabaseWhenDumping == 1 {
-				continue
+			reply := &replyBuffer{}
+			if err := auth.check("DUMP", strings.TrimSpace(parts[1])); err != nil {
+				writeCommandError(reply, err)
+			} else {
+				executeCommand(reply, "", []string{"DUMP", strings.TrimSpace(parts[1]), "FORMAT", "text"}, fromClient)
 			}
+			reply.writeLegacy(output)
+			continue
 		}
 
 		databaseName := strings.TrimSpace(parts[1])
@@ -349,176 +888,562 @@ func handleConnection(conn net.Conn) {
 
 		// lets go
 
-		foundBase := 0
-		baseIndex := -1
+		action := strings.ToUpper(args[0])
 
-		for i := range db.databasesList {
-			if db.databasesList[i].Name == databaseName {
-				baseIndex = i
-				foundBase = 1
+		// The reply is collected first and written once the command
+		// released its locks, a full output buffer waits for the client.
+		reply := &replyBuffer{}
+		if action == "AUTH" {
+			if err := auth.authenticate(args); err != nil {
+				writeCommandError(reply, err)
+			} else {
+				reply.status("OK")
 			}
+		} else if err := auth.check(action, commandDatabase(action, args, databaseName)); err != nil {
+			if tx.active {
+				tx.failed = true
+			}
+			writeCommandError(reply, err)
+		} else if action == "EXEC" {
+			// every queued command has a reply of its own
+			tx.writeExec(output)
+			continue
+		} else if transactionCommands[action] {
+			tx.control(reply, databaseName, action, args)
+		} else if tx.active {
+			tx.queue(reply, databaseName, args)
+		} else if blockingCommands[action] && checkCommand(args, fromClient) == nil {
+			// the replies so far must not wait with it
+			output.Flush()
+			closed, stop := watchDisconnect(conn, reader)
+			executeBlocking(reply, databaseName, args, fromClient, closed)
+			stop()
+		} else {
+			executeCommand(reply, databaseName, args, fromClient)
 		}
-		if foundBase == 0 {
-			newBase := DatabaseStruct{Name: databaseName}
-			db.databasesList = append(db.databasesList, newBase)
-			baseIndex = len(db.databasesList) - 1
+		reply.writeLegacy(output)
+	}
+}
+
+// Every error reply starts with a code clients can switch on, the rest
+// of the line is for people. The code is chosen where the error happens,
+// so rewording a message never changes it.
+const (
+	// the command or one of its arguments is malformed
+	codeSyntax = "SYNTAX"
+	// the structure, field, member or database is not there
+	codeNoSuchKey = "NOSUCHKEY"
+	// the structure is there but has nothing to take
+	codeEmpty = "EMPTY"
+	// the name only holds structures of other kinds
+	codeWrongType = "WRONGTYPE"
+	// a replica refuses writes of its clients
+	codeReadOnly = "READONLY"
+	// the connection has to log in first
+	codeNoAuth = "NOAUTH"
+	// the user may not run the command or use the database
+	codeNoPerm = "NOPERM"
+	// the login failed
+	codeWrongPass = "WRONGPASS"
+	// EXEC of a transaction that had an error while queuing
+	codeExecAbort = "EXECABORT"
+	// the data is over -maxmemory and nothing can be evicted
+	codeOOM = "OOM"
+	// HELLO asked for a protocol version the server does not speak
+	codeNoProto = "NOPROTO"
+	// anything else
+	codeError = "ERR"
+)
+
+// commandError is a failure found before a command runs, with its code
+type commandError struct {
+	code    string
+	message string
+}
+
+func (err *commandError) Error() string {
+	return err.code + " " + err.message
+}
+
+// where a command comes from decides whether it may write and whether it
+// is recorded
+type commandSource int
+
+const (
+	fromClient commandSource = iota
+	// the replication stream of our primary
+	fromPrimary
+	// replaying the append only log, nothing is recorded again
+	fromLog
+)
+
+// checkCommand returns the error for a command that can not run at all,
+// or nil
+func checkCommand(args []string, source commandSource) *commandError {
+	if len(args) == 0 || args[0] == "" {
+		return &commandError{codeSyntax, "empty command"}
+	}
+	action := strings.ToUpper(args[0])
+	if len(args) < commandArity[action] {
+		return wrongArguments(args[0])
+	}
+	if source == fromClient && writeCommands[action] && replication.isReplica() {
+		return &commandError{codeReadOnly, "You can't write against a read only replica."}
+	}
+	return nil
+}
+
+func wrongArguments(command string) *commandError {
+	return &commandError{codeSyntax, "wrong number of arguments for '" + strings.ToLower(command) + "' command"}
+}
+
+// executeCommand checks the arguments, takes the locks the command needs
+// and runs it
+func executeCommand(out reply, databaseName string, args []string, source commandSource) {
+	if err := checkCommand(args, source); err != nil {
+		writeCommandError(out, err)
+		return
+	}
+	action := strings.ToUpper(args[0])
+
+	if blockingCommands[action] {
+		// only connections can wait, see executeBlocking
+		executeBlocking(out, databaseName, args, source, nil)
+		return
+	}
+
+	if databaseCommands[action] {
+		db.mutex.Lock()
+		record := executeDatabaseCommand(out, action, args, source)
+		db.mutex.Unlock()
+		if record {
+			rewriteIfNeeded()
 		}
+		return
+	}
 
-		action := strings.ToUpper(args[0])
+	db.mutex.RLock()
 
-		switch action {
-		case "SPUSH":
-			foundStruct := 0
-			for i := range db.databasesList[baseIndex].Stacks {
-				if db.databasesList[baseIndex].Stacks[i].Name == args[1] {
-					db.databasesList[baseIndex].Stacks[i].push(args[2])
-					foundStruct = 1
-				}
-			}
-			if foundStruct == 0 {
-				newStack := Stack{Name: args[1]}
-				newStack.push(args[2])
-				db.databasesList[baseIndex].Stacks = append(db.databasesList[baseIndex].Stacks, newStack)
-			}
-		case "SPOP":
-			foundStruct := 0
-			for i := range db.databasesList[baseIndex].Stacks {
-
-				if db.databasesList[baseIndex].Stacks[i].Name == args[1] {
-					result, err := db.databasesList[baseIndex].Stacks[i].pop()
-					if err == nil {
-						conn.Write([]byte(result + "\n"))
-					} else {
-						conn.Write([]byte(err.Error() + "\n"))
-					}
-					foundStruct = 1
-				}
-			}
-			if foundStruct == 0 {
-				conn.Write([]byte("Stack doesnt exist" + "\n"))
-			}
-		case "QPUSH":
-			foundStruct := 0
-			for i := range db.databasesList[baseIndex].Queues {
-				if db.databasesList[baseIndex].Queues[i].Name == args[1] {
-					db.databasesList[baseIndex].Queues[i].push(args[2])
-					foundStruct = 1
-				}
-			}
-			if foundStruct == 0 {
-				newQueue := Queue{Name: args[1]}
-				newQueue.push(args[2])
-				db.databasesList[baseIndex].Queues = append(db.databasesList[baseIndex].Queues, newQueue)
-			}
-		case "QPOP":
-			foundStruct := 0
-			for i := range db.databasesList[baseIndex].Queues {
-
-				if db.databasesList[baseIndex].Queues[i].Name == args[1] {
-					result, err := db.databasesList[baseIndex].Queues[i].pop()
-					if err == nil {
-						conn.Write([]byte(result + "\n"))
-					} else {
-						conn.Write([]byte(err.Error() + "\n"))
-					}
-					foundStruct = 1
-				}
-			}
-			if foundStruct == 0 {
-				conn.Write([]byte("Queue doesnt exist" + "\n"))
-			}
-		case "HSET":
-			foundStruct := 0
-			for i := range db.databasesList[baseIndex].HashTables {
-				if db.databasesList[baseIndex].HashTables[i].Name == args[1] {
-					db.databasesList[baseIndex].HashTables[i].Add(args[2], args[3])
-					foundStruct = 1
-				}
+	if serverCommands[action] {
+		executeServerCommand(out, action, args)
+		db.mutex.RUnlock()
+		return
+	}
+
+	if source == fromClient && memoryCommands[action] && !freeMemory() {
+		db.mutex.RUnlock()
+		writeError(out, codeOOM, oomReply)
+		return
+	}
+
+	base := db.findDatabase(databaseName)
+	for base == nil {
+		// adding a database needs the exclusive lock
+		db.mutex.RUnlock()
+		db.createDatabase(databaseName)
+		db.mutex.RLock()
+		base = db.findDatabase(databaseName)
+	}
+
+	record := base.runCommand(out, action, args, source)
+	db.mutex.RUnlock()
+
+	if record {
+		rewriteIfNeeded()
+	}
+}
+
+// runCommand executes one checked command against the database, caller
+// must hold db.mutex. Writes hold the database exclusively until they are
+// in the append only log and the replication stream, so both have them in
+// execution order. It tells whether the command was recorded.
+func (base *DatabaseStruct) runCommand(out reply, action string, args []string, source commandSource) bool {
+	if action == "QRESERVE" {
+		converted, err := reserveCommand(args)
+		if err != nil {
+			writeError(out, codeSyntax, err.Error())
+			return false
+		}
+		action, args = "QRESERVEAT", converted
+	}
+	if action == "QPUSH" {
+		converted, err := delayCommand(args)
+		if err != nil {
+			writeError(out, codeSyntax, err.Error())
+			return false
+		}
+		action, args = strings.ToUpper(converted[0]), converted
+	}
+	if action == "EXPIRE" || action == "HSET" {
+		converted, err := deadlineCommand(args)
+		if err != nil {
+			writeError(out, codeSyntax, err.Error())
+			return false
+		}
+		action, args = strings.ToUpper(converted[0]), converted
+	}
+
+	write := writeCommands[action]
+	if write {
+		base.mutex.Lock()
+	} else {
+		base.mutex.RLock()
+		if len(args) > 1 && base.nameExpired(args[1], nowMillis()) {
+			// removing the expired structure is a write
+			base.mutex.RUnlock()
+			base.mutex.Lock()
+			write = true
+		}
+	}
+
+	if write && len(args) > 1 {
+		base.expireIfNeeded(args[1], nowMillis())
+	}
+
+	// what time changed on the queue goes first, recorded before the command
+	var due [][]string
+	if source == fromClient && queueDueCommands[action] {
+		due = base.releaseDue(args[1], nowMillis())
+	}
+
+	// replays repeat what already ran, only clients can get the kind wrong
+	wrongType := source == fromClient && base.wrongKind(action, args, nowMillis())
+
+	// a set pop picks at random, only the members it took are recorded
+	setPop := action == "SPOP" && base.popsSet(args, nowMillis())
+
+	// writes done on the side, recorded after the command
+	var effects [][]string
+	if wrongType {
+		writeError(out, codeWrongType, wrongTypeReply)
+	} else if setPop {
+		effects = executeSetPop(out, base, args)
+	} else {
+		effects = base.dispatch(out, action, args)
+	}
+
+	record := source != fromLog && writeCommands[action] && !wrongType
+	if writeCommands[action] && len(args) > 1 && !wrongType {
+		base.touch(args[1], commandField(action, args))
+	}
+	if record {
+		commands := due
+		if !setPop {
+			commands = append(commands, persistentCommands(args)...)
+		}
+		if action == "QPUSH" || action == "SPUSH" {
+			effects = base.serveBlocked(action == "QPUSH", args[1])
+		}
+		base.record(append(commands, effects...))
+	}
+
+	if write {
+		base.mutex.Unlock()
+	} else {
+		base.mutex.RUnlock()
+	}
+
+	return record
+}
+
+// dispatch hands a command to the file implementing it and returns the
+// writes it did on the side
+func (base *DatabaseStruct) dispatch(out reply, action string, args []string) [][]string {
+	switch action {
+	case "QRESERVEAT", "QACK", "QREQUEUE", "QDEAD":
+		return executeReliable(out, base, action, args)
+	case "QPUSHAT", "QPROMOTE":
+		return executeDelayed(out, base, action, args)
+	}
+
+	if setCommands[action] {
+		return executeSets(out, base, action, args)
+	} else if sortedSetCommands[action] {
+		executeSortedSet(out, base, action, args)
+	} else if scanCommands[action] {
+		executeScan(out, base, action, args)
+	} else if keyspaceCommands[action] {
+		return executeKeyspace(out, base, action, args)
+	} else {
+		executeQuery(out, base, action, args)
+	}
+	return nil
+}
+
+// record sends executed writes to the append only log and the replicas,
+// caller must hold the database exclusively
+func (base *DatabaseStruct) record(commands [][]string) {
+	if len(commands) == 0 {
+		return
+	}
+	atomic.AddInt64(&db.dirty, 1)
+	if aof != nil {
+		for _, command := range commands {
+			err := aof.append(base.Name, command)
+			if err != nil {
+				fmt.Println("Could not write to append only file: ", err)
 			}
-			if foundStruct == 0 {
-				newTable := NewHashTable(args[1], 512)
-				newTable.Add(args[2], args[3])
-				db.databasesList[baseIndex].HashTables = append(db.databasesList[baseIndex].HashTables, *newTable)
+		}
+	}
+	replication.feed(base.Name, commands)
+}
+
+// findDatabase needs db.mutex held
+func (mainDb *MainDatabaseStructure) findDatabase(name string) *DatabaseStruct {
+	for _, base := range mainDb.databasesList {
+		if base.Name == name {
+			return base
+		}
+	}
+	return nil
+}
+
+func (mainDb *MainDatabaseStructure) createDatabase(name string) {
+	mainDb.mutex.Lock()
+	defer mainDb.mutex.Unlock()
+
+	if mainDb.findDatabase(name) == nil {
+		mainDb.databasesList = append(mainDb.databasesList, &DatabaseStruct{Name: name})
+	}
+}
+
+func executeServerCommand(out reply, action string, args []string) {
+	switch action {
+	case "SAVE":
+		err := db.save()
+		if err == nil {
+			out.status("OK")
+		} else {
+			writeError(out, codeError, err.Error())
+		}
+	case "BGSAVE":
+		err := db.bgsave()
+		if err == nil {
+			out.status("Background saving started")
+		} else {
+			writeError(out, codeError, err.Error())
+		}
+	case "BGREWRITEAOF":
+		if aof == nil {
+			writeError(out, codeError, "Append only file is disabled")
+			break
+		}
+		err := aof.startRewrite()
+		if err == nil {
+			out.status("Background append only file rewriting started")
+		} else {
+			writeError(out, codeError, err.Error())
+		}
+	case "LASTSAVE":
+		db.saveMutex.Lock()
+		lastSave := db.lastSave
+		db.saveMutex.Unlock()
+		out.integer(lastSave.Unix())
+	case "INFO":
+		section := ""
+		if len(args) > 1 {
+			section = strings.ToLower(args[1])
+		}
+		sections := []string{}
+		if section == "" || section == "replication" {
+			sections = append(sections, replication.info())
+		}
+		if section == "" || section == "memory" {
+			sections = append(sections, memoryInfo())
+		}
+		out.bulk(strings.Join(sections, "\r\n\r\n"))
+	case "REPLICAOF":
+		if strings.ToUpper(args[1]) == "NO" && strings.ToUpper(args[2]) == "ONE" {
+			replication.replicaOf("", "")
+		} else if _, err := strconv.Atoi(args[2]); err == nil {
+			replication.replicaOf(args[1], args[2])
+		} else {
+			writeError(out, codeSyntax, "Invalid port")
+			break
+		}
+		out.status("OK")
+	case "PUBLISH":
+		// the legacy format splits the message on spaces, put it back together
+		message := strings.Join(args[2:], " ")
+		receivers := pubsub.publish(args[1], message)
+		replication.feedCommand([]string{"PUBLISH", args[1], message})
+		out.integer(int64(receivers))
+	case "DUMP":
+		executeDump(out, args)
+	case "DBLIST":
+		executeDatabaseList(out)
+	}
+}
+
+// executeQuery runs one command against a database and writes the reply
+// to out, caller must hold the database lock
+func executeQuery(out reply, base *DatabaseStruct, action string, args []string) {
+	switch action {
+	case "SPUSH":
+		foundStruct := 0
+		for i := range base.Stacks {
+			if base.Stacks[i].Name == args[1] {
+				base.Stacks[i].push(args[2])
+				foundStruct = 1
 			}
-		case "HGET":
-			foundStruct := 0
-			for i := range db.databasesList[baseIndex].HashTables {
-				if db.databasesList[baseIndex].HashTables[i].Name == args[1] {
-					result, err := db.databasesList[baseIndex].HashTables[i].Get(args[2])
-					if err == nil {
-						conn.Write([]byte(result + "\n"))
-					} else {
-						conn.Write([]byte(err.Error() + "\n"))
-					}
-					foundStruct = 1
+		}
+		if foundStruct == 0 {
+			newStack := NewStack(args[1])
+			newStack.push(args[2])
+			base.Stacks = append(base.Stacks, *newStack)
+		}
+	case "SPOP":
+		foundStruct := 0
+		for i := range base.Stacks {
+
+			if base.Stacks[i].Name == args[1] {
+				result, err := base.Stacks[i].pop()
+				if err == nil {
+					out.bulk(result)
+				} else {
+					writeError(out, codeEmpty, err.Error())
 				}
+				foundStruct = 1
 			}
-			if foundStruct == 0 {
-				conn.Write([]byte("Hashtable doesnt exist :(" + "\n"))
+		}
+		if foundStruct == 0 {
+			writeError(out, codeNoSuchKey, "Stack doesnt exist")
+		}
+	case "QPUSH":
+		options, err := parseQueuePush(args, 3)
+		if err != nil {
+			writeError(out, codeSyntax, err.Error())
+			break
+		}
+		attempts := options.attempts
+		foundStruct := 0
+		for i := range base.Queues {
+			if base.Queues[i].Name == args[1] {
+				base.Queues[i].pushAttempts(args[2], attempts)
+				foundStruct = 1
 			}
-		case "HDEL":
-			foundStruct := 0
-			for i := range db.databasesList[baseIndex].HashTables {
-				if db.databasesList[baseIndex].HashTables[i].Name == args[1] {
-					result, err := db.databasesList[baseIndex].HashTables[i].Delete(args[2])
-					if err == nil {
-						conn.Write([]byte(result + "\n"))
-					} else {
-						conn.Write([]byte(err.Error() + "\n"))
-					}
-					foundStruct = 1
+		}
+		if foundStruct == 0 {
+			newQueue := NewQueue(args[1])
+			newQueue.pushAttempts(args[2], attempts)
+			base.Queues = append(base.Queues, *newQueue)
+		}
+	case "QPOP":
+		foundStruct := 0
+		for i := range base.Queues {
+
+			if base.Queues[i].Name == args[1] {
+				result, err := base.Queues[i].pop()
+				if err == nil {
+					out.bulk(result)
+				} else {
+					writeError(out, codeEmpty, err.Error())
 				}
+				foundStruct = 1
 			}
-			if foundStruct == 0 {
-				conn.Write([]byte("Hashtable doesnt exist :(" + "\n"))
+		}
+		if foundStruct == 0 {
+			writeError(out, codeNoSuchKey, "Queue doesnt exist")
+		}
+	case "HSET":
+		expireAt, hasExpire, err := hashSetExpire(args)
+		if err != nil {
+			writeError(out, codeSyntax, err.Error())
+			break
+		}
+		foundStruct := 0
+		for i := range base.HashTables {
+			if base.HashTables[i].Name == args[1] {
+				base.HashTables[i].Add(args[2], args[3])
+				foundStruct = 1
 			}
-		case "SADD":
-			foundStruct := 0
-			for i := range db.databasesList[baseIndex].Sets {
-				if db.databasesList[baseIndex].Sets[i].Name == args[1] {
-					db.databasesList[baseIndex].Sets[i].Add(args[2])
-					foundStruct = 1
+		}
+		if foundStruct == 0 {
+			newTable := NewHashTable(args[1], 512)
+			newTable.Add(args[2], args[3])
+			base.HashTables = append(base.HashTables, *newTable)
+		}
+		if hasExpire {
+			findHashTable(base, args[1]).SetExpire(args[2], expireAt)
+		}
+	case "HGET":
+		foundStruct := 0
+		for i := range base.HashTables {
+			if base.HashTables[i].Name == args[1] {
+				result, err := base.HashTables[i].Get(args[2])
+				if err == nil {
+					out.bulk(result)
+				} else {
+					writeError(out, codeNoSuchKey, err.Error())
 				}
+				foundStruct = 1
 			}
-			if foundStruct == 0 {
-				// fmt.Println("Adding new set with name<", args[1], ">")
-				newSetVar := NewSet(args[1], 512)
-				// fmt.Println(newSetVar)
-				newSetVar.Add(args[2])
-				db.databasesList[baseIndex].Sets = append(db.databasesList[baseIndex].Sets, *newSetVar)
-			}
-		case "SREM":
-			foundStruct := 0
-			for i := range db.databasesList[baseIndex].Sets {
-				if db.databasesList[baseIndex].Sets[i].Name == args[1] {
-					result, err := db.databasesList[baseIndex].Sets[i].Remove(args[2])
-					if err == nil {
-						conn.Write([]byte(result + "\n"))
-					} else {
-						conn.Write([]byte(err.Error() + "\n"))
-					}
-					foundStruct = 1
+		}
+		if foundStruct == 0 {
+			writeError(out, codeNoSuchKey, "Hashtable doesnt exist :(")
+		}
+	case "HDEL":
+		foundStruct := 0
+		for i := range base.HashTables {
+			if base.HashTables[i].Name == args[1] {
+				result, err := base.HashTables[i].Delete(args[2])
+				if err == nil {
+					out.removed(result)
+				} else {
+					writeError(out, codeNoSuchKey, err.Error())
 				}
+				foundStruct = 1
 			}
-			if foundStruct == 0 {
-				conn.Write([]byte("Set doesnt exist :(" + "\n"))
+		}
+		if foundStruct == 0 {
+			writeError(out, codeNoSuchKey, "Hashtable doesnt exist :(")
+		}
+	case "SADD":
+		foundStruct := 0
+		for i := range base.Sets {
+			if base.Sets[i].Name == args[1] {
+				base.Sets[i].Add(args[2])
+				foundStruct = 1
 			}
-		case "SISMEMBER":
-			foundStruct := 0
-			for i := range db.databasesList[baseIndex].Sets {
-				if db.databasesList[baseIndex].Sets[i].Name == args[1] {
-					result := db.databasesList[baseIndex].Sets[i].IsMember(args[2])
-					conn.Write([]byte(strconv.FormatBool(result) + "\n"))
-					foundStruct = 1
+		}
+		if foundStruct == 0 {
+			// fmt.Println("Adding new set with name<", args[1], ">")
+			newSetVar := NewSet(args[1], 512)
+			// fmt.Println(newSetVar)
+			newSetVar.Add(args[2])
+			base.Sets = append(base.Sets, *newSetVar)
+		}
+	case "SREM":
+		foundStruct := 0
+		for i := range base.Sets {
+			if base.Sets[i].Name == args[1] {
+				result, err := base.Sets[i].Remove(args[2])
+				if err == nil {
+					out.removed(result)
+				} else {
+					writeError(out, codeNoSuchKey, err.Error())
 				}
+				foundStruct = 1
 			}
-			if foundStruct == 0 {
-				conn.Write([]byte("Set doesnt exist :(" + "\n"))
+		}
+		if foundStruct == 0 {
+			writeError(out, codeNoSuchKey, "Set doesnt exist :(")
+		}
+	case "SISMEMBER":
+		foundStruct := 0
+		for i := range base.Sets {
+			if base.Sets[i].Name == args[1] {
+				result := base.Sets[i].IsMember(args[2])
+				out.boolean(result)
+				foundStruct = 1
 			}
-		default:
-			conn.Write([]byte("Unknown query command" + "\n"))
 		}
-
-		db.mutex.Unlock()
+		if foundStruct == 0 {
+			writeError(out, codeNoSuchKey, "Set doesnt exist :(")
+		}
+	case "EXPIRE", "PEXPIREAT", "PERSIST", "TTL":
+		executeExpire(out, base, action, args)
+	default:
+		writeError(out, codeSyntax, "unknown command '"+args[0]+"'")
 	}
 }
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Memory limit: every structure keeps a rough count of the bytes it
+// holds and adds what it grows or shrinks by to usedMemoryBytes, which is
+// compared with MAX_MEMORY before a client command that lets the data
+// grow. Over the limit the server evicts hash entries picked by
+// MAX_MEMORY_POLICY until the data fits again, or refuses the command
+// when the policy is noeviction or nothing can be evicted.
+//
+// Evictions are recorded as HDEL, replicas and the append only log follow
+// them and never evict on their own. Commands that only take data away
+// run even over the limit.
+
+// approximate bytes the stored data may take, 0 for no limit
+var MAX_MEMORY int64 = 0
+
+// what to do when a write would go over MAX_MEMORY
+var MAX_MEMORY_POLICY = "noeviction"
+
+const (
+	// refuse the write
+	policyNoEviction = "noeviction"
+	// evict the hash entry that was not used for the longest time
+	policyAllKeysLRU = "allkeys-lru"
+	// evict the hash entry that expires first, only entries with a
+	// deadline of their own or of their table are taken
+	policyVolatileTTL = "volatile-ttl"
+	// evict the hash entry that is used the least often
+	policyAllKeysLFU = "allkeys-lfu"
+)
+
+func validEvictionPolicy(policy string) bool {
+	return policy == policyNoEviction || policy == policyAllKeysLRU ||
+		policy == policyVolatileTTL || policy == policyAllKeysLFU
+}
+
+// hash entries sampled for one eviction, the best of them goes
+const evictionSamples = 5
+
+const oomReply = "command not allowed when used memory > 'maxmemory'."
+
+// commands that can make the data grow
+var memoryCommands = map[string]bool{
+	"SPUSH":       true,
+	"QPUSH":       true,
+	"QPUSHAT":     true,
+	"HSET":        true,
+	"SADD":        true,
+	"ZADD":        true,
+	"ZINCRBY":     true,
+	"SUNIONSTORE": true,
+	"SINTERSTORE": true,
+	"SDIFFSTORE":  true,
+}
+
+// bytes the databases take, the sum of their memoryUsage kept up to date
+// by addMemory and trackMemory. Loading whole databases counts again, see
+// recountMemory.
+var usedMemoryBytes int64
+
+// one eviction run at a time, a writer that waited for another one finds
+// the room already made. Writes under the limit never take it.
+var evictionMutex sync.Mutex
+
+// hash entries evicted since the start, updated atomically
+var evictedEntries int64
+
+// Rough sizes on a 64 bit build of what is kept around every stored
+// string, the strings themselves count with their length
+const (
+	// a structure and its place in the database
+	structureOverhead = 128
+	// a hash table or set entry, its slot is counted with the table
+	hashEntryOverhead = 48
+	hashSlotSize      = 8
+	// a deadline in one of the expires maps
+	deadlineOverhead = 40
+	// a stack or queue item
+	listItemOverhead = 32
+	// a queue item in flight, with its place in the map
+	reservationOverhead = 64
+	// a delayed queue item, with its place in the heap
+	delayedItemOverhead = 56
+	// a sorted set member, its skip list node and its score
+	sortedSetMemberOverhead = 128
+)
+
+// addMemory changes the byte count of a structure and the total with it
+func addMemory(count *int64, delta int64) {
+	*count += delta
+	atomic.AddInt64(&usedMemoryBytes, delta)
+}
+
+// trackMemory changes the total by what structures do not count in their
+// memory field: themselves, their slots and deadlines
+func trackMemory(delta int64) {
+	atomic.AddInt64(&usedMemoryBytes, delta)
+}
+
+func structureSize(name string) int64 {
+	return structureOverhead + int64(len(name))
+}
+
+func hashEntrySize(key string, value string) int64 {
+	return int64(hashEntryOverhead + len(key) + len(value))
+}
+
+func listItemSize(value string) int64 {
+	return int64(listItemOverhead + len(value))
+}
+
+func reservationSize(id string, value string) int64 {
+	return int64(reservationOverhead + len(id) + len(value))
+}
+
+func delayedItemSize(value string) int64 {
+	return int64(delayedItemOverhead + len(value))
+}
+
+func sortedSetMemberSize(member string) int64 {
+	return int64(sortedSetMemberOverhead + len(member))
+}
+
+func (ht *HashTable) memoryUsage() int64 {
+	slots := int64(len(ht.Table) + len(ht.oldTable))
+	return structureSize(ht.Name) + ht.memory +
+		slots*hashSlotSize + int64(len(ht.expires))*deadlineOverhead
+}
+
+func (stack *Stack) memoryUsage() int64 {
+	return structureSize(stack.Name) + stack.memory
+}
+
+func (queue *Queue) memoryUsage() int64 {
+	return structureSize(queue.Name) + queue.memory
+}
+
+func (zset *SortedSet) memoryUsage() int64 {
+	return structureSize(zset.Name) + zset.memory
+}
+
+// memoryUsage of any structure needs the database lock held
+func (base *DatabaseStruct) memoryUsage() int64 {
+	used := int64(len(base.expires)) * deadlineOverhead
+	for i := range base.HashTables {
+		used += base.HashTables[i].memoryUsage()
+	}
+	for i := range base.Sets {
+		used += base.Sets[i].ht.memoryUsage()
+	}
+	for i := range base.Stacks {
+		used += base.Stacks[i].memoryUsage()
+	}
+	for i := range base.Queues {
+		used += base.Queues[i].memoryUsage()
+	}
+	for i := range base.SortedSets {
+		used += base.SortedSets[i].memoryUsage()
+	}
+	return used
+}
+
+// recountMemory sets usedMemoryBytes from scratch after whole databases
+// were loaded or replaced, caller must hold db.mutex exclusively
+func recountMemory() {
+	used := int64(0)
+	for _, base := range db.databasesList {
+		used += base.memoryUsage()
+	}
+	atomic.StoreInt64(&usedMemoryBytes, used)
+}
+
+// evictionCandidates gives the number of hash entries the policy may evict
+// in every database, caller must hold db.mutex
+func evictionCandidates() map[*DatabaseStruct]int {
+	candidates := map[*DatabaseStruct]int{}
+	for _, base := range db.databasesList {
+		base.mutex.RLock()
+		_, counts := base.evictionTables()
+		for _, count := range counts {
+			candidates[base] += count
+		}
+		base.mutex.RUnlock()
+	}
+	return candidates
+}
+
+// freeMemory makes room for a command in memoryCommands and tells whether
+// the data fits into MAX_MEMORY now. Caller holds db.mutex and no lock
+// of a database.
+func freeMemory() bool {
+	if MAX_MEMORY <= 0 || atomic.LoadInt64(&usedMemoryBytes) <= MAX_MEMORY {
+		return true
+	}
+	if MAX_MEMORY_POLICY == policyNoEviction {
+		return false
+	}
+	evictionMutex.Lock()
+	defer evictionMutex.Unlock()
+
+	candidates := evictionCandidates()
+	for atomic.LoadInt64(&usedMemoryBytes) > MAX_MEMORY {
+		base := pickDatabase(candidates)
+		if base == nil {
+			return false
+		}
+
+		base.mutex.Lock()
+		ok := base.evict(nowMillis())
+		base.mutex.Unlock()
+
+		if !ok {
+			delete(candidates, base)
+			continue
+		}
+		candidates[base]--
+	}
+	return true
+}
+
+// pickDatabase chooses a database by chance, weighted by its candidates
+func pickDatabase(candidates map[*DatabaseStruct]int) *DatabaseStruct {
+	total := 0
+	for _, count := range candidates {
+		if count > 0 {
+			total += count
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	pick := rand.Intn(total)
+	for base, count := range candidates {
+		if count <= 0 {
+			continue
+		}
+		if pick < count {
+			return base
+		}
+		pick -= count
+	}
+	return nil
+}
+
+// evictionTables lists the hash tables the policy may take entries from
+// and how many entries each one offers, caller must hold the database lock
+func (base *DatabaseStruct) evictionTables() ([]*HashTable, []int) {
+	tables := []*HashTable{}
+	counts := []int{}
+	if MAX_MEMORY_POLICY == policyNoEviction {
+		return tables, counts
+	}
+
+	for i := range base.HashTables {
+		table := &base.HashTables[i]
+		count := table.Len()
+		if MAX_MEMORY_POLICY == policyVolatileTTL && !base.hasDeadline(table.Name) {
+			count = len(table.expires)
+		}
+		if count > 0 {
+			tables = append(tables, table)
+			counts = append(counts, count)
+		}
+	}
+	return tables, counts
+}
+
+func (base *DatabaseStruct) hasDeadline(name string) bool {
+	_, ok := base.expires[name]
+	return ok
+}
+
+// evict deletes the best of a few sampled hash entries and records it as
+// HDEL, it tells whether there was one. When there are no more candidates
+// than samples all of them are looked at. Caller must hold the database
+// exclusively.
+func (base *DatabaseStruct) evict(now int64) bool {
+	tables, counts := base.evictionTables()
+	total := 0
+	for _, count := range counts {
+		total += count
+	}
+	if total == 0 {
+		return false
+	}
+
+	var bestTable *HashTable
+	var bestNode *HashTableNode
+	bestScore := int64(0)
+	consider := func(table *HashTable, node *HashTableNode, deadline int64) {
+		if node == nil {
+			return
+		}
+		score := evictionScore(node, deadline, now)
+		if bestNode == nil || score > bestScore {
+			bestTable, bestNode, bestScore = table, node, score
+		}
+	}
+
+	if total <= evictionSamples {
+		for _, table := range tables {
+			base.eachCandidate(table, func(node *HashTableNode, deadline int64) {
+				consider(table, node, deadline)
+			})
+		}
+	} else {
+		for i := 0; i < evictionSamples; i++ {
+			pick := rand.Intn(total)
+			table := tables[0]
+			for j, count := range counts {
+				if pick < count {
+					table = tables[j]
+					break
+				}
+				pick -= count
+			}
+			node, deadline := base.sampleEntry(table)
+			consider(table, node, deadline)
+		}
+	}
+	if bestNode == nil {
+		return false
+	}
+
+	name, key := bestTable.Name, bestNode.Key
+	bestTable.Delete(key)
+	base.touch(name, key)
+	base.record([][]string{{"HDEL", name, key}})
+	atomic.AddInt64(&evictedEntries, 1)
+	return true
+}
+
+// sampleEntry picks an entry of table by chance. Under volatile-ttl it
+// also gives the deadline of the entry, the earlier one of the entry and
+// of the table.
+func (base *DatabaseStruct) sampleEntry(table *HashTable) (*HashTableNode, int64) {
+	if MAX_MEMORY_POLICY != policyVolatileTTL {
+		return table.randomEntry(), 0
+	}
+
+	if at, ok := base.expires[table.Name]; ok {
+		node := table.randomEntry()
+		if node == nil {
+			return nil, 0
+		}
+		if fieldAt, ok := table.expires[node.Key]; ok && fieldAt < at {
+			at = fieldAt
+		}
+		return node, at
+	}
+
+	// map iteration starts at a random place
+	for key, at := range table.expires {
+		return table.lookup(key), at
+	}
+	return nil, 0
+}
+
+// eachCandidate calls visit for every entry of table the policy may
+// evict, with its deadline like sampleEntry
+func (base *DatabaseStruct) eachCandidate(table *HashTable, visit func(node *HashTableNode, deadline int64)) {
+	if MAX_MEMORY_POLICY != policyVolatileTTL {
+		table.eachNode(func(node *HashTableNode) { visit(node, 0) })
+		return
+	}
+
+	if at, ok := base.expires[table.Name]; ok {
+		table.eachNode(func(node *HashTableNode) {
+			deadline := at
+			if fieldAt, ok := table.expires[node.Key]; ok && fieldAt < deadline {
+				deadline = fieldAt
+			}
+			visit(node, deadline)
+		})
+		return
+	}
+	for key, at := range table.expires {
+		visit(table.lookup(key), at)
+	}
+}
+
+// randomEntry goes through the slots from a random one on and gives the
+// first entry it finds, nil for an empty table
+func (ht *HashTable) randomEntry() *HashTableNode {
+	if ht.count == 0 {
+		return nil
+	}
+
+	slots := len(ht.Table) + len(ht.oldTable)
+	start := rand.Intn(slots)
+	for i := 0; i < slots; i++ {
+		index := (start + i) % slots
+		var node *HashTableNode
+		if index < len(ht.Table) {
+			node = ht.Table[index]
+		} else {
+			node = ht.oldTable[index-len(ht.Table)]
+		}
+		if node != nil && node != deletedNode {
+			return node
+		}
+	}
+	return nil
+}
+
+// eachNode calls visit for every stored node of both tables, expired
+// ones included
+func (ht *HashTable) eachNode(visit func(node *HashTableNode)) {
+	for _, table := range [][]*HashTableNode{ht.Table, ht.oldTable} {
+		for _, node := range table {
+			if node != nil && node != deletedNode {
+				visit(node)
+			}
+		}
+	}
+}
+
+// evictionScore is higher for the entries the policy wants to see gone
+func evictionScore(node *HashTableNode, deadline int64, now int64) int64 {
+	switch MAX_MEMORY_POLICY {
+	case policyVolatileTTL:
+		return -deadline
+	case policyAllKeysLFU:
+		return lfuMaxCounter - int64(node.frequency(now))
+	}
+	return now - atomic.LoadInt64(&node.accessed)
+}
+
+// The access counter of an entry grows logarithmically: a hit adds one
+// with a chance of 1/((counter-lfuInitial)*lfuLogFactor+1), so it takes
+// about a million hits to reach the top. Every minute without an access
+// takes one off again. New entries start at lfuInitial, a few hits above
+// those that are never read.
+const (
+	lfuInitial     = 5
+	lfuLogFactor   = 10
+	lfuMaxCounter  = 255
+	lfuDecayPeriod = 60 * 1000
+)
+
+// access records a read or write of the entry
+func (node *HashTableNode) access(now int64) {
+	counter := node.frequency(now)
+	if counter < lfuMaxCounter {
+		above := float64(counter) - lfuInitial
+		if above < 0 {
+			above = 0
+		}
+		if rand.Float64() < 1/(above*lfuLogFactor+1) {
+			counter++
+		}
+	}
+	atomic.StoreUint32(&node.hits, counter)
+	atomic.StoreInt64(&node.accessed, now)
+}
+
+// frequency is the access counter less what it lost since the last access
+func (node *HashTableNode) frequency(now int64) uint32 {
+	counter := atomic.LoadUint32(&node.hits)
+	periods := (now - atomic.LoadInt64(&node.accessed)) / lfuDecayPeriod
+	if periods >= int64(counter) {
+		return 0
+	}
+	return counter - uint32(periods)
+}
+
+// memoryInfo is the memory section of INFO
+func memoryInfo() string {
+	lines := []string{
+		"# Memory",
+		"used_memory:" + strconv.FormatInt(atomic.LoadInt64(&usedMemoryBytes), 10),
+		"maxmemory:" + strconv.FormatInt(MAX_MEMORY, 10),
+		"maxmemory_policy:" + MAX_MEMORY_POLICY,
+		"evicted_keys:" + strconv.FormatInt(atomic.LoadInt64(&evictedEntries), 10),
+	}
+	return strings.Join(lines, "\r\n")
+}
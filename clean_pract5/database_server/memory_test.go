@@ -0,0 +1,206 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// checkMemoryCount fails the test when the running count of used memory
+// is not what the databases add up to
+func checkMemoryCount(t *testing.T, step string) {
+	t.Helper()
+	db.mutex.RLock()
+	used := int64(0)
+	for _, base := range db.databasesList {
+		base.mutex.RLock()
+		used += base.memoryUsage()
+		base.mutex.RUnlock()
+	}
+	counted := atomic.LoadInt64(&usedMemoryBytes)
+	db.mutex.RUnlock()
+
+	if counted != used {
+		t.Fatalf("%s: %d bytes counted, the databases take %d", step, counted, used)
+	}
+}
+
+// limitMemory lets the data take just less than it does now, the next
+// write that lets it grow evicts first
+func limitMemory(policy string) {
+	MAX_MEMORY_POLICY = policy
+	MAX_MEMORY = atomic.LoadInt64(&usedMemoryBytes) - 1
+}
+
+func TestMemoryCount(t *testing.T) {
+	address := startTestServer(t)
+	client := dialTestClient(t, address)
+	checkMemoryCount(t, "empty")
+
+	client.expect("OK", "SELECT", "counted")
+	soon := strconv.FormatInt(nowMillis()+20, 10)
+	client.expect("OK", "HSET", "table", "short", "lived", "PXAT", soon)
+	client.expect("OK", "HSET", "table", "key", "value", "EX", "100")
+	client.expect("OK", "HSET", "table", "key", "longer value")
+	client.expect(1, "EXPIRE", "table", "key", "50")
+	client.expect(1, "PERSIST", "table", "key")
+	client.expect(1, "EXPIRE", "table", "100")
+	checkMemoryCount(t, "hash")
+
+	// a table that grows over several resizes and shrinks again
+	for i := 0; i < 2000; i++ {
+		client.expect("OK", "HSET", "big", strconv.Itoa(i), "value")
+	}
+	checkMemoryCount(t, "grown")
+	for i := 0; i < 1990; i++ {
+		client.expect(1, "HDEL", "big", strconv.Itoa(i))
+	}
+	checkMemoryCount(t, "shrunk")
+
+	client.expect("OK", "SPUSH", "stack", "a")
+	client.expect("OK", "SPUSH", "stack", "b")
+	client.expect("b", "SPOP", "stack")
+	client.expect("OK", "QPUSH", "queue", "a")
+	client.expect("OK", "QPUSH", "queue", "b")
+	client.expect("a", "QPOP", "queue")
+	reserved, ok := client.do("QRESERVE", "queue", "30").([]interface{})
+	if !ok || len(reserved) != 2 {
+		t.Fatalf("QRESERVE = %#v", reserved)
+	}
+	client.expect(1, "QACK", "queue", reserved[0].(string))
+	client.expect("OK", "QPUSHAT", "queue", "later", formatUnixTime(nowMillis()+100000))
+	client.expect("OK", "SADD", "set", "a")
+	client.expect("OK", "SADD", "set", "b")
+	client.expect(1, "SREM", "set", "a")
+	client.expect(1, "ZADD", "zset", "1", "a")
+	client.expect(1, "ZADD", "zset", "2", "b")
+	client.expect(1, "ZREM", "zset", "a")
+	checkMemoryCount(t, "structures")
+
+	// a stored set replaces the old one, its deadline included
+	client.expect("OK", "SADD", "other", "b")
+	client.expect("OK", "SADD", "other", "c")
+	client.expect(2, "SUNIONSTORE", "stored", "set", "other")
+	client.expect(1, "EXPIRE", "stored", "100")
+	client.expect(1, "SINTERSTORE", "stored", "set", "other")
+	client.expect(1, "SDIFFSTORE", "stored", "other", "set")
+	client.expect(0, "SDIFFSTORE", "stored", "set", "set")
+	checkMemoryCount(t, "stored")
+
+	client.expect("OK", "RENAME", "table", "renamed table")
+	client.expect("OK", "RENAME", "queue", "q")
+	checkMemoryCount(t, "renamed")
+
+	// the expired entry goes when it is read
+	time.Sleep(50 * time.Millisecond)
+	client.expect(nil, "HGET", "renamed table", "short")
+	checkMemoryCount(t, "expired")
+
+	client.expect(1, "DEL", "zset")
+	client.expect(1, "DEL", "stack")
+	checkMemoryCount(t, "deleted")
+
+	client.expect("OK", "SELECT", "dropped")
+	client.expect("OK", "HSET", "table", "key", "value")
+	client.expect("OK", "QPUSH", "queue", "item")
+	client.expect("OK", "FLUSHDB")
+	checkMemoryCount(t, "flushed")
+	client.expect("OK", "HSET", "table", "key", "value")
+	client.expect("OK", "DBDROP", "dropped")
+	checkMemoryCount(t, "dropped")
+}
+
+func TestNoEvictionRefusesWrites(t *testing.T) {
+	address := startTestServer(t)
+	client := dialTestClient(t, address)
+	client.expect("OK", "SELECT", "full")
+	client.expect("OK", "HSET", "table", "big", strings.Repeat("x", 1000))
+	client.expect("OK", "QPUSH", "queue", "item")
+
+	evicted := atomic.LoadInt64(&evictedEntries)
+	limitMemory(policyNoEviction)
+	client.expectError(codeOOM, "HSET", "table", "key", "value")
+	client.expectError(codeOOM, "QPUSH", "queue", "item")
+
+	// taking data away still works and makes room again
+	client.expect("item", "QPOP", "queue")
+	client.expect(1, "HDEL", "table", "big")
+	client.expect("OK", "HSET", "table", "key", "value")
+
+	if atomic.LoadInt64(&evictedEntries) != evicted {
+		t.Fatal("noeviction evicted an entry")
+	}
+}
+
+func TestAllKeysLRUEvictsLeastRecentlyUsed(t *testing.T) {
+	address := startTestServer(t)
+	client := dialTestClient(t, address)
+	client.expect("OK", "SELECT", "cache")
+
+	// the entry written first is read last
+	for _, key := range []string{"hot", "cold", "warm"} {
+		client.expect("OK", "HSET", "table", key, "value")
+		time.Sleep(5 * time.Millisecond)
+	}
+	client.expect("value", "HGET", "table", "hot")
+	time.Sleep(5 * time.Millisecond)
+
+	limitMemory(policyAllKeysLRU)
+	client.expect("OK", "HSET", "table", "new", "value")
+	client.expect(nil, "HGET", "table", "cold")
+	client.expect("value", "HGET", "table", "warm")
+	client.expect("value", "HGET", "table", "hot")
+	checkMemoryCount(t, "evicted")
+}
+
+func TestAllKeysLFUEvictsLeastFrequentlyUsed(t *testing.T) {
+	address := startTestServer(t)
+	client := dialTestClient(t, address)
+	client.expect("OK", "SELECT", "cache")
+
+	client.expect("OK", "HSET", "table", "hot", "value")
+	client.expect("OK", "HSET", "table", "warm", "value")
+	client.expect("OK", "HSET", "table", "cold", "value")
+	for i := 0; i < 50; i++ {
+		client.expect("value", "HGET", "table", "hot")
+	}
+	// the first hit of a new entry always counts
+	client.expect("value", "HGET", "table", "warm")
+
+	limitMemory(policyAllKeysLFU)
+	client.expect("OK", "HSET", "table", "new", "value")
+	client.expect(nil, "HGET", "table", "cold")
+	client.expect("value", "HGET", "table", "warm")
+	client.expect("value", "HGET", "table", "hot")
+	checkMemoryCount(t, "evicted")
+}
+
+func TestVolatileTTLEvictsEarliestDeadline(t *testing.T) {
+	address := startTestServer(t)
+	client := dialTestClient(t, address)
+	client.expect("OK", "SELECT", "cache")
+
+	later := strconv.FormatInt(nowMillis()+100000, 10)
+	client.expect("OK", "HSET", "table", "later", "value", "PXAT", later)
+	client.expect("OK", "HSET", "table", "kept", "value")
+	// the deadline of its table counts for an entry
+	client.expect("OK", "HSET", "session", "soon", "value")
+	client.expect(1, "EXPIRE", "session", "50")
+
+	limitMemory(policyVolatileTTL)
+	client.expect("OK", "HSET", "table", "first", "value")
+	client.expect(nil, "HGET", "session", "soon")
+	client.expect("value", "HGET", "table", "later")
+
+	limitMemory(policyVolatileTTL)
+	client.expect("OK", "HSET", "table", "second", "value")
+	client.expect(nil, "HGET", "table", "later")
+
+	// nothing left with a deadline
+	limitMemory(policyVolatileTTL)
+	client.expectError(codeOOM, "HSET", "table", "third", "value")
+	client.expect("value", "HGET", "table", "kept")
+	checkMemoryCount(t, "evicted")
+}
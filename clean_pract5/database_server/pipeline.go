@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"time"
+)
+
+// Pipelining: a client may send many commands without waiting for their
+// replies, a connection runs them one after the other and answers in the
+// same order. Replies collect in an output buffer that is written once no
+// further command is waiting, so a burst of commands is answered with a
+// few writes instead of one per command.
+//
+// A full buffer is written right away and the connection reads nothing
+// more until the client took it. A client that sends faster than it reads
+// is slowed down to its own pace this way instead of piling up replies in
+// the server, one that does not read at all is disconnected after
+// CLIENT_OUTPUT_TIMEOUT. Clients that pipeline a lot have to read while
+// they still write. Commands write their reply to a buffer of their own
+// while they hold locks, a slow client never holds up the others.
+
+// replies a connection collects before it has to write them
+var CLIENT_OUTPUT_BUFFER = 64 * 1024
+
+// how long writing replies to a client may take, 0 waits forever
+var CLIENT_OUTPUT_TIMEOUT = 30 * time.Second
+
+// commands are read in chunks this big, the replies to all the commands
+// of a chunk go out together
+const clientInputBuffer = 64 * 1024
+
+type clientConn struct {
+	net.Conn
+}
+
+func (conn clientConn) Write(data []byte) (int, error) {
+	if CLIENT_OUTPUT_TIMEOUT > 0 {
+		conn.SetWriteDeadline(time.Now().Add(CLIENT_OUTPUT_TIMEOUT))
+	}
+	return conn.Conn.Write(data)
+}
+
+func newClientOutput(conn net.Conn) *bufio.Writer {
+	return bufio.NewWriterSize(clientConn{conn}, CLIENT_OUTPUT_BUFFER)
+}
+
+// flushReplies writes the collected replies unless another command is
+// already waiting, its reply can go out with them. It returns the error
+// of this or any earlier write, the connection is unusable after one.
+func flushReplies(output *bufio.Writer, input *bufio.Reader) error {
+	if input.Buffered() > 0 {
+		// a write of nothing only reports an earlier error
+		_, err := output.Write(nil)
+		return err
+	}
+	return output.Flush()
+}
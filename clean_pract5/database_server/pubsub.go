@@ -0,0 +1,259 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// messages a subscriber may have waiting before it is disconnected,
+// a slow reader must not hold up the publishers
+var PUBSUB_BUFFER_SIZE = 1024
+
+// Channels live outside the databases, a message reaches every
+// connection subscribed to the channel or to a matching pattern.
+type pubsubHub struct {
+	mutex    sync.RWMutex
+	channels map[string]map[*subscriber]bool
+	patterns map[string]map[*subscriber]bool
+}
+
+// one subscribed connection, messages go through a buffered channel to
+// the goroutine writing them
+type subscriber struct {
+	conn     net.Conn
+	messages chan []string
+	// only touched by the connection goroutine and under hub.mutex
+	channels map[string]bool
+	patterns map[string]bool
+	dropped  bool
+}
+
+var pubsub = &pubsubHub{
+	channels: map[string]map[*subscriber]bool{},
+	patterns: map[string]map[*subscriber]bool{},
+}
+
+func newSubscriber(conn net.Conn) *subscriber {
+	return &subscriber{
+		conn:     conn,
+		messages: make(chan []string, PUBSUB_BUFFER_SIZE),
+		channels: map[string]bool{},
+		patterns: map[string]bool{},
+	}
+}
+
+func (sub *subscriber) count() int {
+	return len(sub.channels) + len(sub.patterns)
+}
+
+// subscribe returns the number of subscriptions the connection has after
+// adding the channel or pattern
+func (hub *pubsubHub) subscribe(sub *subscriber, name string, pattern bool) int {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	index, own := hub.channels, sub.channels
+	if pattern {
+		index, own = hub.patterns, sub.patterns
+	}
+
+	if index[name] == nil {
+		index[name] = map[*subscriber]bool{}
+	}
+	index[name][sub] = true
+	own[name] = true
+
+	return sub.count()
+}
+
+func (hub *pubsubHub) unsubscribe(sub *subscriber, name string, pattern bool) int {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	index, own := hub.channels, sub.channels
+	if pattern {
+		index, own = hub.patterns, sub.patterns
+	}
+
+	delete(index[name], sub)
+	if len(index[name]) == 0 {
+		delete(index, name)
+	}
+	delete(own, name)
+
+	return sub.count()
+}
+
+// subscriptions lists channels or patterns in a stable order, for an
+// UNSUBSCRIBE without arguments
+func (sub *subscriber) subscriptions(pattern bool) []string {
+	own := sub.channels
+	if pattern {
+		own = sub.patterns
+	}
+
+	names := []string{}
+	for name := range own {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// drop removes a closed connection from every channel
+func (hub *pubsubHub) drop(sub *subscriber) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	for name := range sub.channels {
+		delete(hub.channels[name], sub)
+		if len(hub.channels[name]) == 0 {
+			delete(hub.channels, name)
+		}
+	}
+	for name := range sub.patterns {
+		delete(hub.patterns[name], sub)
+		if len(hub.patterns[name]) == 0 {
+			delete(hub.patterns, name)
+		}
+	}
+	sub.channels = map[string]bool{}
+	sub.patterns = map[string]bool{}
+
+	if !sub.dropped {
+		sub.dropped = true
+		close(sub.messages)
+	}
+}
+
+// publish returns how many subscribers the message was queued for
+func (hub *pubsubHub) publish(channel string, message string) int {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+
+	receivers := 0
+	for sub := range hub.channels[channel] {
+		if hub.deliver(sub, []string{"message", channel, message}) {
+			receivers++
+		}
+	}
+	for pattern, subs := range hub.patterns {
+		if !matchPattern(pattern, channel) {
+			continue
+		}
+		for sub := range subs {
+			if hub.deliver(sub, []string{"pmessage", pattern, channel, message}) {
+				receivers++
+			}
+		}
+	}
+
+	return receivers
+}
+
+// deliver needs hub.mutex held, a subscriber with a full buffer is
+// disconnected instead of blocking everybody else
+func (hub *pubsubHub) deliver(sub *subscriber, push []string) bool {
+	if sub.dropped {
+		return false
+	}
+
+	select {
+	case sub.messages <- push:
+		return true
+	default:
+		sub.dropped = true
+		close(sub.messages)
+		sub.conn.Close()
+		return false
+	}
+}
+
+// subscribeCommands are the only ones a RESP2 connection may send while
+// it has subscriptions
+var subscribeCommands = map[string]bool{
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+	"PING":         true,
+	"QUIT":         true,
+}
+
+// executeSubscribe runs the four subscription commands for a RESP
+// session, every channel gets its own confirmation push
+func (session *respSession) executeSubscribe(w *respWriter, action string, args []string) {
+	pattern := strings.HasPrefix(action, "P")
+	kind := strings.ToLower(action)
+
+	if session.subscriber == nil {
+		session.subscriber = newSubscriber(session.conn)
+		go session.pushLoop(w, session.subscriber)
+	}
+	sub := session.subscriber
+
+	switch action {
+	case "SUBSCRIBE", "PSUBSCRIBE":
+		if len(args) < 2 {
+			w.commandError(wrongArguments(kind))
+			return
+		}
+		for _, name := range args[1:] {
+			count := pubsub.subscribe(sub, name, pattern)
+			w.pushHeader(3)
+			w.bulk(kind)
+			w.bulk(name)
+			w.integer(int64(count))
+		}
+	case "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		names := args[1:]
+		if len(names) == 0 {
+			names = sub.subscriptions(pattern)
+		}
+		if len(names) == 0 {
+			w.pushHeader(3)
+			w.bulk(kind)
+			w.null()
+			w.integer(int64(sub.count()))
+			return
+		}
+		for _, name := range names {
+			count := pubsub.unsubscribe(sub, name, pattern)
+			w.pushHeader(3)
+			w.bulk(kind)
+			w.bulk(name)
+			w.integer(int64(count))
+		}
+	}
+}
+
+// pushLoop writes the published messages, sharing the writer with the
+// replies of the connection
+func (session *respSession) pushLoop(w *respWriter, sub *subscriber) {
+	for push := range sub.messages {
+		session.writeMutex.Lock()
+		w.pushHeader(len(push))
+		for _, value := range push {
+			w.bulk(value)
+		}
+		// write everything that queued up meanwhile in one go
+		for waiting := len(sub.messages); waiting > 0; waiting-- {
+			push, ok := <-sub.messages
+			if !ok {
+				break
+			}
+			w.pushHeader(len(push))
+			for _, value := range push {
+				w.bulk(value)
+			}
+		}
+		err := w.writer.Flush()
+		session.writeMutex.Unlock()
+		if err != nil {
+			session.conn.Close()
+			return
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+// deliveries an item gets before it is moved to the dead letter queue
+var QUEUE_MAX_ATTEMPTS = 5
+
+// the dead letter queue of "jobs" is "jobs:dead" in the same database
+var DEAD_LETTER_SUFFIX = ":dead"
+
+// Reliable consumption: QRESERVE takes the head of a queue like QPOP but
+// keeps it in flight under an id until QACK confirms it. An item whose
+// lease runs out goes back to the tail of the queue, after
+// QUEUE_MAX_ATTEMPTS deliveries it goes to the dead letter queue instead.
+//
+// Only a primary gives items back on its own, by recording QREQUEUE or
+// QDEAD, so replicas and the append only log follow the same decisions.
+type reservation struct {
+	value    string
+	deadline int64
+	attempts int
+}
+
+// commands that first give back expired leases and make due delayed
+// items visible
+var queueDueCommands = map[string]bool{
+	"QPOP":       true,
+	"QRESERVEAT": true,
+	"QACK":       true,
+	"QREQUEUE":   true,
+	"QDEAD":      true,
+}
+
+func newReservationID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// reserveCommand turns QRESERVE into the QRESERVEAT that is executed and
+// recorded, with the id and the absolute deadline already chosen
+func reserveCommand(args []string) ([]string, error) {
+	seconds, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || seconds <= 0 {
+		return nil, errors.New("Invalid lease time")
+	}
+	deadline := nowMillis() + seconds*1000
+	return []string{"QRESERVEAT", args[1], newReservationID(), strconv.FormatInt(deadline, 10)}, nil
+}
+
+func (queue *Queue) pushAttempts(val string, attempts int) {
+	queue.push(val)
+	queue.tail.attempts = attempts
+}
+
+func (queue *Queue) popNode() (*Node, error) {
+	if queue.head == nil {
+		return nil, errors.New("Queue is empty!")
+	}
+	node := queue.head
+	queue.head = queue.head.next
+	addMemory(&queue.memory, -listItemSize(node.data))
+	return node, nil
+}
+
+// reserve needs the database held exclusively
+func (queue *Queue) reserve(id string, deadline int64) (string, error) {
+	node, err := queue.popNode()
+	if err != nil {
+		return "", err
+	}
+	queue.addInFlight(id, &reservation{value: node.data, deadline: deadline, attempts: node.attempts + 1})
+	return node.data, nil
+}
+
+func (queue *Queue) addInFlight(id string, item *reservation) {
+	if queue.inFlight == nil {
+		queue.inFlight = map[string]*reservation{}
+	}
+	queue.inFlight[id] = item
+	addMemory(&queue.memory, reservationSize(id, item.value))
+}
+
+// removeInFlight forgets a reservation and returns it, nil for an
+// unknown id
+func (queue *Queue) removeInFlight(id string) *reservation {
+	item, ok := queue.inFlight[id]
+	if !ok {
+		return nil
+	}
+	delete(queue.inFlight, id)
+	addMemory(&queue.memory, -reservationSize(id, item.value))
+	return item
+}
+
+// reservationIDs lists the items in flight in a stable order
+func (queue *Queue) reservationIDs() []string {
+	ids := []string{}
+	for id := range queue.inFlight {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// giveBack returns an item in flight to the tail of its queue, or to the
+// dead letter queue, and hands it to a waiting BQPOP if there is one
+func (base *DatabaseStruct) giveBack(name string, id string, dead bool) ([][]string, bool) {
+	queue := findQueue(base, name)
+	if queue == nil {
+		return nil, false
+	}
+	item := queue.removeInFlight(id)
+	if item == nil {
+		return nil, false
+	}
+
+	target := name
+	if dead {
+		target = name + DEAD_LETTER_SUFFIX
+		if findQueue(base, target) == nil {
+			base.Queues = append(base.Queues, *NewQueue(target))
+		}
+	}
+	findQueue(base, target).pushAttempts(item.value, item.attempts)
+	base.touch(name, "")
+	base.touch(target, "")
+
+	return base.serveBlocked(true, target), true
+}
+
+// requeueExpired gives back every item of the queue whose lease ran out
+// and returns the commands that did it, for the log and the replicas
+func (base *DatabaseStruct) requeueExpired(name string, now int64) [][]string {
+	queue := findQueue(base, name)
+	if queue == nil || len(queue.inFlight) == 0 {
+		return nil
+	}
+
+	commands := [][]string{}
+	for _, id := range queue.reservationIDs() {
+		item := queue.inFlight[id]
+		if item.deadline > now {
+			continue
+		}
+		dead := item.attempts >= QUEUE_MAX_ATTEMPTS
+		action := "QREQUEUE"
+		if dead {
+			action = "QDEAD"
+		}
+		served, _ := base.giveBack(name, id, dead)
+		commands = append(commands, []string{action, name, id})
+		commands = append(commands, served...)
+	}
+	return commands
+}
+
+// releaseDue does what time changed for one queue, lapsed leases and
+// delayed items that are due, and returns the commands to record
+func (base *DatabaseStruct) releaseDue(name string, now int64) [][]string {
+	commands := base.requeueExpired(name, now)
+	return append(commands, base.promoteDue(name, now)...)
+}
+
+// releaseAllDue is the background half, run by the expire cycle on a
+// primary with the database held exclusively
+func (base *DatabaseStruct) releaseAllDue(now int64) {
+	names := []string{}
+	for i := range base.Queues {
+		if len(base.Queues[i].inFlight) > 0 || len(base.Queues[i].delayed) > 0 {
+			names = append(names, base.Queues[i].Name)
+		}
+	}
+
+	for _, name := range names {
+		commands := base.releaseDue(name, now)
+		if len(commands) > 0 {
+			base.record(commands)
+		}
+	}
+}
+
+// executeReliable runs QRESERVEAT, QACK, QREQUEUE and QDEAD. It returns
+// the pops done for waiting clients so the caller records them.
+func executeReliable(out reply, base *DatabaseStruct, action string, args []string) [][]string {
+	name := args[1]
+
+	switch action {
+	case "QRESERVEAT":
+		deadline, err := strconv.ParseInt(args[3], 10, 64)
+		if err != nil {
+			writeError(out, codeSyntax, "Invalid lease time")
+			return nil
+		}
+		queue := findQueue(base, name)
+		if queue == nil {
+			writeError(out, codeNoSuchKey, "Queue doesnt exist")
+			return nil
+		}
+		value, err := queue.reserve(args[2], deadline)
+		if err != nil {
+			writeError(out, codeEmpty, err.Error())
+			return nil
+		}
+		out.array([]string{args[2], value})
+	case "QACK":
+		queue := findQueue(base, name)
+		done := false
+		if queue != nil {
+			done = queue.removeInFlight(args[2]) != nil
+		}
+		out.integer(boolToInt(done))
+	case "QREQUEUE", "QDEAD":
+		served, done := base.giveBack(name, args[2], action == "QDEAD")
+		out.integer(boolToInt(done))
+		return served
+	}
+
+	return nil
+}
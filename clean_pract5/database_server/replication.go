@@ -0,0 +1,596 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// "host:port" of the primary to follow at start, empty for a primary
+var REPLICA_OF = ""
+
+// a replica that falls this far behind is disconnected and has to resync
+var REPLICA_OUTPUT_LIMIT = 64 << 20
+
+const replicationPingInterval = time.Second
+const replicationRetryInterval = time.Second
+
+// The primary sends every replica a full copy of the data and after that
+// the same stream of write commands, as RESP arrays with a SELECT whenever
+// the database changes. The offset counts the bytes of that stream, the
+// replicas acknowledge how far they got with REPLCONF ACK <offset>.
+type replicationState struct {
+	mutex sync.Mutex
+
+	// primary side
+	replicationID string
+	offset        int64
+	lastDatabase  string
+	replicas      map[int]*replicaLink
+	nextReplicaID int
+
+	// replica side
+	primaryHost      string
+	primaryPort      string
+	primaryConn      net.Conn
+	linkUp           bool
+	syncInProgress   bool
+	lastIO           time.Time
+	replicaOffset    int64
+	stopReplication  chan struct{}
+	replicationEpoch int
+}
+
+// one replica connected to this server
+type replicaLink struct {
+	id      int
+	address string
+	conn    net.Conn
+
+	mutex  sync.Mutex
+	buffer []byte
+	notify chan struct{}
+	// closed together with closed, notify is never closed since writers
+	// may still hold the link
+	done      chan struct{}
+	closed    bool
+	ackOffset int64
+	ackTime   time.Time
+}
+
+var replication = newReplicationState()
+
+func newReplicationState() *replicationState {
+	id := make([]byte, 20)
+	rand.Read(id)
+	return &replicationState{
+		replicationID: hex.EncodeToString(id),
+		replicas:      map[int]*replicaLink{},
+	}
+}
+
+func (state *replicationState) isReplica() bool {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+	return state.primaryHost != ""
+}
+
+// feed passes write commands on to the replicas, caller must hold the lock
+// of the database so the stream has them in execution order
+func (state *replicationState) feed(databaseName string, commands [][]string) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if len(state.replicas) == 0 {
+		return
+	}
+
+	var data []byte
+	if databaseName != state.lastDatabase {
+		data = append(data, encodeRespCommand([]string{"SELECT", databaseName})...)
+		state.lastDatabase = databaseName
+	}
+	for _, command := range commands {
+		data = append(data, encodeRespCommand(command)...)
+	}
+
+	state.send(data)
+}
+
+// feedCommand passes on a command that does not belong to a database
+func (state *replicationState) feedCommand(args []string) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if len(state.replicas) > 0 {
+		state.send(encodeRespCommand(args))
+	}
+}
+
+// send needs state.mutex held
+func (state *replicationState) send(data []byte) {
+	state.offset += int64(len(data))
+	for id, link := range state.replicas {
+		if !link.write(data) {
+			fmt.Println("Replica", link.address, "fell too far behind, disconnecting")
+			delete(state.replicas, id)
+		}
+	}
+}
+
+// pingLoop keeps the stream moving so replicas can tell a quiet primary
+// from a dead link
+func (state *replicationState) pingLoop() {
+	ticker := time.NewTicker(replicationPingInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		state.mutex.Lock()
+		if len(state.replicas) > 0 {
+			state.send(encodeRespCommand([]string{"PING"}))
+		}
+		state.mutex.Unlock()
+	}
+}
+
+func (link *replicaLink) write(data []byte) bool {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+
+	if link.closed {
+		return false
+	}
+	if len(link.buffer)+len(data) > REPLICA_OUTPUT_LIMIT {
+		link.closeLocked()
+		return false
+	}
+
+	link.buffer = append(link.buffer, data...)
+	select {
+	case link.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+func (link *replicaLink) close() {
+	link.mutex.Lock()
+	defer link.mutex.Unlock()
+	link.closeLocked()
+}
+
+// closeLocked needs link.mutex held
+func (link *replicaLink) closeLocked() {
+	if !link.closed {
+		link.closed = true
+		close(link.done)
+		link.conn.Close()
+	}
+}
+
+// writeLoop sends whatever the stream produced since the last round
+func (link *replicaLink) writeLoop() {
+	for {
+		select {
+		case <-link.notify:
+		case <-link.done:
+			return
+		}
+
+		link.mutex.Lock()
+		data := link.buffer
+		link.buffer = nil
+		closed := link.closed
+		link.mutex.Unlock()
+
+		if closed {
+			return
+		}
+		if len(data) == 0 {
+			continue
+		}
+
+		_, err := link.conn.Write(data)
+		if err != nil {
+			link.close()
+			return
+		}
+	}
+}
+
+// servePrimaryLink answers SYNC. The data is copied while db.mutex is held
+// exclusively and the replica joins the stream before it is released, so
+// it gets exactly the commands that came after the copy.
+func servePrimaryLink(conn net.Conn, reader *bufio.Reader) {
+	link := &replicaLink{
+		address: conn.RemoteAddr().String(),
+		conn:    conn,
+		notify:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		ackTime: time.Now(),
+	}
+
+	db.mutex.Lock()
+	snapshot := db.makeSnapshot()
+	replication.mutex.Lock()
+	replication.nextReplicaID++
+	link.id = replication.nextReplicaID
+	link.ackOffset = replication.offset
+	// the first command after the copy has to say its database again
+	replication.lastDatabase = ""
+	replication.replicas[link.id] = link
+	offset := replication.offset
+	replicationID := replication.replicationID
+	replication.mutex.Unlock()
+	db.mutex.Unlock()
+
+	defer func() {
+		replication.mutex.Lock()
+		delete(replication.replicas, link.id)
+		replication.mutex.Unlock()
+		link.close()
+		fmt.Println("Replica", link.address, "disconnected")
+	}()
+
+	fmt.Println("Full sync with replica", link.address)
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		fmt.Println("Could not encode the snapshot for", link.address, ": ", err)
+		return
+	}
+
+	header := "+FULLRESYNC " + replicationID + " " + strconv.FormatInt(offset, 10) + "\r\n"
+	header += "$" + strconv.Itoa(len(data)) + "\r\n"
+	_, err = conn.Write(append(append([]byte(header), data...), '\r', '\n'))
+	if err != nil {
+		return
+	}
+
+	go link.writeLoop()
+
+	// the replica only ever sends acknowledgements from now on
+	for {
+		args, err := readRespCommand(reader)
+		if err != nil {
+			return
+		}
+		if len(args) == 3 && strings.ToUpper(args[0]) == "REPLCONF" && strings.ToUpper(args[1]) == "ACK" {
+			ackOffset, err := strconv.ParseInt(args[2], 10, 64)
+			if err == nil {
+				link.mutex.Lock()
+				link.ackOffset = ackOffset
+				link.ackTime = time.Now()
+				link.mutex.Unlock()
+			}
+		}
+	}
+}
+
+// replicaOf switches between following a primary and being one, an empty
+// host means REPLICAOF NO ONE
+func (state *replicationState) replicaOf(host string, port string) {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	if state.stopReplication != nil {
+		close(state.stopReplication)
+		state.stopReplication = nil
+	}
+	if state.primaryConn != nil {
+		state.primaryConn.Close()
+		state.primaryConn = nil
+	}
+	state.linkUp = false
+	state.syncInProgress = false
+	state.primaryHost = host
+	state.primaryPort = port
+	state.replicationEpoch++
+
+	if host == "" {
+		fmt.Println("Replication stopped, now a primary")
+		return
+	}
+
+	stop := make(chan struct{})
+	state.stopReplication = stop
+	go state.replicaLoop(host, port, stop, state.replicationEpoch)
+}
+
+func (state *replicationState) replicaLoop(host string, port string, stop chan struct{}, epoch int) {
+	for {
+		err := state.syncWithPrimary(host, port, stop, epoch)
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		fmt.Println("Replication link to", net.JoinHostPort(host, port), "lost: ", err)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(replicationRetryInterval):
+		}
+	}
+}
+
+// current tells whether a replication goroutine still belongs to the
+// active REPLICAOF, caller must hold state.mutex
+func (state *replicationState) current(epoch int) bool {
+	return state.replicationEpoch == epoch
+}
+
+func (state *replicationState) syncWithPrimary(host string, port string, stop chan struct{}, epoch int) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	state.mutex.Lock()
+	if !state.current(epoch) {
+		state.mutex.Unlock()
+		return errors.New("replication target changed")
+	}
+	state.primaryConn = conn
+	state.syncInProgress = true
+	state.mutex.Unlock()
+
+	reader := bufio.NewReader(conn)
+	if PRIMARY_USER != "" {
+		_, err = conn.Write(encodeRespCommand([]string{"AUTH", PRIMARY_USER, PRIMARY_PASSWORD}))
+		if err != nil {
+			return err
+		}
+		line, err := readRespLine(reader)
+		if err != nil {
+			return err
+		}
+		if line != "+OK" {
+			return errors.New("primary refused AUTH: " + line)
+		}
+	}
+	_, err = conn.Write(encodeRespCommand([]string{"SYNC"}))
+	if err != nil {
+		return err
+	}
+
+	line, err := readRespLine(reader)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		return errors.New("unexpected reply to SYNC: " + line)
+	}
+	offset, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return errors.New("bad offset in " + line)
+	}
+
+	line, err = readRespLine(reader)
+	if err != nil {
+		return err
+	}
+	length, err := readRespLength(line, '$', respMaxBulkLength)
+	if err != nil || length < 0 {
+		return errors.New("bad snapshot header " + line)
+	}
+	data := make([]byte, length+2)
+	_, err = io.ReadFull(reader, data)
+	if err != nil {
+		return err
+	}
+
+	databases, err := parseSnapshot(data[:length])
+	if err != nil {
+		return err
+	}
+
+	state.mutex.Lock()
+	if !state.current(epoch) {
+		state.mutex.Unlock()
+		return errors.New("replication target changed")
+	}
+	state.mutex.Unlock()
+
+	db.mutex.Lock()
+	replaceDatabases(databases)
+	db.mutex.Unlock()
+	fmt.Println("Full sync from", net.JoinHostPort(host, port), "done,", len(databases), "databases")
+
+	// the old data is gone, so is what our own log and replicas know
+	if aof != nil {
+		err = aof.rewriteNow()
+		if err != nil {
+			fmt.Println("Could not rewrite append only file after sync: ", err)
+		}
+	}
+	state.dropReplicas()
+
+	state.mutex.Lock()
+	state.replicaOffset = offset
+	state.syncInProgress = false
+	state.linkUp = true
+	state.lastIO = time.Now()
+	state.mutex.Unlock()
+
+	defer func() {
+		state.mutex.Lock()
+		if state.current(epoch) {
+			state.linkUp = false
+		}
+		state.mutex.Unlock()
+	}()
+
+	go state.ackLoop(conn, stop)
+
+	databaseName := ""
+	for {
+		args, err := readRespCommand(reader)
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		switch strings.ToUpper(args[0]) {
+		case "SELECT":
+			if len(args) == 2 {
+				databaseName = args[1]
+			}
+		case "PING":
+		default:
+			executeCommand(&replyBuffer{}, databaseName, args, fromPrimary)
+		}
+
+		state.mutex.Lock()
+		state.replicaOffset += int64(len(encodeRespCommand(args)))
+		state.lastIO = time.Now()
+		state.mutex.Unlock()
+	}
+}
+
+func (state *replicationState) ackLoop(conn net.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		state.mutex.Lock()
+		offset := state.replicaOffset
+		state.mutex.Unlock()
+
+		_, err := conn.Write(encodeRespCommand([]string{"REPLCONF", "ACK", strconv.FormatInt(offset, 10)}))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// dropReplicas makes our own replicas sync again after our data changed
+// under them
+func (state *replicationState) dropReplicas() {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	for id, link := range state.replicas {
+		link.close()
+		delete(state.replicas, id)
+	}
+}
+
+// info is the replication section of INFO
+func (state *replicationState) info() string {
+	state.mutex.Lock()
+	defer state.mutex.Unlock()
+
+	lines := []string{"# Replication"}
+
+	if state.primaryHost != "" {
+		status := "down"
+		if state.linkUp {
+			status = "up"
+		}
+		syncing := "0"
+		if state.syncInProgress {
+			syncing = "1"
+		}
+		lastIO := -1
+		if !state.lastIO.IsZero() {
+			lastIO = int(time.Since(state.lastIO).Seconds())
+		}
+		lines = append(lines,
+			"role:slave",
+			"master_host:"+state.primaryHost,
+			"master_port:"+state.primaryPort,
+			"master_link_status:"+status,
+			"master_last_io_seconds_ago:"+strconv.Itoa(lastIO),
+			"master_sync_in_progress:"+syncing,
+			"slave_repl_offset:"+strconv.FormatInt(state.replicaOffset, 10),
+			"slave_read_only:1",
+		)
+	} else {
+		lines = append(lines, "role:master")
+	}
+
+	lines = append(lines, "connected_slaves:"+strconv.Itoa(len(state.replicas)))
+	number := 0
+	for _, link := range state.replicas {
+		link.mutex.Lock()
+		host, port, _ := net.SplitHostPort(link.address)
+		lines = append(lines, fmt.Sprintf("slave%d:ip=%s,port=%s,state=online,offset=%d,lag=%d,behind=%d",
+			number, host, port, link.ackOffset, int(time.Since(link.ackTime).Seconds()), state.offset-link.ackOffset))
+		link.mutex.Unlock()
+		number++
+	}
+
+	lines = append(lines,
+		"master_replid:"+state.replicationID,
+		"master_repl_offset:"+strconv.FormatInt(state.offset, 10),
+	)
+
+	return strings.Join(lines, "\r\n")
+}
+
+// replaceDatabases puts the data of a full sync in place of the old one,
+// caller must hold db.mutex exclusively. A database that is in both keeps
+// its struct, so transactions watching it and clients blocked in it stay
+// with the database clients reach by name. Every watched key counts as
+// changed, and blocked clients are woken as a replica never pops for them.
+func replaceDatabases(databases []*DatabaseStruct) {
+	old := map[string]*DatabaseStruct{}
+	for _, base := range db.databasesList {
+		old[base.Name] = base
+	}
+
+	list := make([]*DatabaseStruct, 0, len(databases))
+	for _, loaded := range databases {
+		base := old[loaded.Name]
+		if base == nil {
+			list = append(list, loaded)
+			continue
+		}
+		delete(old, loaded.Name)
+
+		base.mutex.Lock()
+		base.flush()
+		base.wakeBlocked()
+		base.HashTables = loaded.HashTables
+		base.Stacks = loaded.Stacks
+		base.Queues = loaded.Queues
+		base.Sets = loaded.Sets
+		base.SortedSets = loaded.SortedSets
+		base.expires = loaded.expires
+		base.mutex.Unlock()
+		list = append(list, base)
+	}
+
+	// databases the primary does not have are dropped
+	for _, base := range old {
+		base.mutex.Lock()
+		base.flush()
+		base.wakeBlocked()
+		base.mutex.Unlock()
+	}
+	db.databasesList = list
+	recountMemory()
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitBlocked waits until count clients are blocked in the database name
+func waitBlocked(t *testing.T, name string, count int) {
+	t.Helper()
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		blocked := 0
+		db.mutex.RLock()
+		if base := db.findDatabase(name); base != nil {
+			base.mutex.RLock()
+			for _, clients := range base.blocked {
+				blocked += len(clients)
+			}
+			base.mutex.RUnlock()
+		}
+		db.mutex.RUnlock()
+		if blocked >= count {
+			return
+		}
+	}
+	t.Fatalf("no client blocked in %s", name)
+}
+
+func TestFullSyncWakesBlockedClientsAndWatchers(t *testing.T) {
+	address := startTestServer(t)
+
+	client := dialTestClient(t, address)
+	client.expect("OK", "SELECT", "kept")
+	client.expect("OK", "HSET", "table", "key", "old")
+	client.expect("OK", "SELECT", "gone")
+	client.expect("OK", "HSET", "table", "key", "old")
+
+	watcher := dialTestClient(t, address)
+	watcher.expect("OK", "SELECT", "kept")
+	watcher.expect("OK", "WATCH", "table", "key")
+
+	results := make(chan error, 2)
+	for _, name := range []string{"kept", "gone"} {
+		blocked := dialTestClient(t, address)
+		blocked.expect("OK", "SELECT", name)
+		go func() {
+			_, err := blocked.call("BQPOP", "queue", "0")
+			results <- err
+		}()
+		waitBlocked(t, name, 1)
+	}
+	db.mutex.RLock()
+	kept := db.findDatabase("kept")
+	db.mutex.RUnlock()
+
+	// what a full sync loads: only "kept", with other data
+	table := NewHashTable("table", 8)
+	table.Add("key", "new")
+	loaded := &DatabaseStruct{Name: "kept", HashTables: []HashTable{*table}}
+	db.mutex.Lock()
+	replaceDatabases([]*DatabaseStruct{loaded})
+	db.mutex.Unlock()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err == nil || !strings.Contains(err.Error(), "replaced") {
+				t.Fatalf("blocked client got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("a blocked client was not woken by the sync")
+		}
+	}
+
+	db.mutex.RLock()
+	if db.findDatabase("kept") != kept {
+		t.Fatal("the synced database got a new struct")
+	}
+	db.mutex.RUnlock()
+
+	// the watched field changed under the transaction
+	watcher.expect("OK", "MULTI")
+	watcher.expect("QUEUED", "HSET", "table", "key", "mine")
+	watcher.expect(nil, "EXEC")
+	watcher.expect("new", "HGET", "table", "key")
+	watcher.expect([]string{"kept"}, "DBLIST")
+}
+
+// TestReplicaDropsDuringWrites disconnects replicas while the stream is
+// fed without a pause, a write to a link that is going away must not
+// bring the primary down
+func TestReplicaDropsDuringWrites(t *testing.T) {
+	address := startTestServer(t)
+
+	stop := make(chan struct{})
+	var wait sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		worker := strconv.Itoa(w)
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				replication.feed("fed", [][]string{{"HSET", "table", worker, strconv.Itoa(i)}})
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		replica := dialTestClient(t, address)
+		reply, err := replica.call("SYNC")
+		if err != nil || !strings.HasPrefix(reply.(string), "FULLRESYNC ") {
+			t.Fatalf("SYNC = %#v, %v", reply, err)
+		}
+		if _, err := readTestReply(replica.reader); err != nil {
+			t.Fatalf("snapshot: %v", err)
+		}
+		// the replica stops talking but still takes the stream, so only
+		// its end of the link tells the primary that it is gone
+		go io.Copy(io.Discard, replica.reader)
+		replica.conn.(*net.TCPConn).CloseWrite()
+	}
+	close(stop)
+	wait.Wait()
+
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		replication.mutex.Lock()
+		left := len(replication.replicas)
+		replication.mutex.Unlock()
+		if left == 0 {
+			break
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("%d replicas still linked", left)
+		}
+	}
+
+	client := dialTestClient(t, address)
+	client.expect("OK", "HSET", "table", "after", "value")
+	client.expect("value", "HGET", "table", "after")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+)
+
+// reply is where a command writes its answer. Each command writes one
+// reply, a command that writes none is confirmed with OK. The types
+// let every protocol render a value its own way, a value that contains a
+// newline or reads like an error message stays one value.
+type reply interface {
+	// status is a short confirmation like OK
+	status(text string)
+	// bulk is one stored value
+	bulk(value string)
+	integer(value int64)
+	// array is a list of stored values
+	array(values []string)
+	// scanPage is the next cursor and the items of one SCAN call
+	scanPage(cursor uint64, items []string)
+	// removed confirms that one item is gone, legacy clients read text
+	removed(text string)
+	boolean(value bool)
+	// timedOut ends a blocking pop that got nothing
+	timedOut()
+	fail(code string, message string)
+}
+
+type replyKind int
+
+const (
+	replyNone replyKind = iota
+	replyStatus
+	replyBulk
+	replyInteger
+	replyArray
+	replyScanPage
+	replyRemoved
+	replyBoolean
+	replyTimedOut
+	replyError
+)
+
+// replyBuffer keeps the reply of one command until the command released
+// its locks, then it goes out in the protocol of the connection
+type replyBuffer struct {
+	kind   replyKind
+	text   string
+	number int64
+	items  []string
+	// code of an error, its message is in text
+	code string
+}
+
+func (buffer *replyBuffer) status(text string) {
+	buffer.kind, buffer.text = replyStatus, text
+}
+
+func (buffer *replyBuffer) bulk(value string) {
+	buffer.kind, buffer.text = replyBulk, value
+}
+
+func (buffer *replyBuffer) integer(value int64) {
+	buffer.kind, buffer.number = replyInteger, value
+}
+
+func (buffer *replyBuffer) array(values []string) {
+	buffer.kind, buffer.items = replyArray, values
+}
+
+func (buffer *replyBuffer) scanPage(cursor uint64, items []string) {
+	buffer.kind, buffer.number, buffer.items = replyScanPage, int64(cursor), items
+}
+
+func (buffer *replyBuffer) removed(text string) {
+	buffer.kind, buffer.text = replyRemoved, text
+}
+
+func (buffer *replyBuffer) boolean(value bool) {
+	buffer.kind, buffer.number = replyBoolean, 0
+	if value {
+		buffer.number = 1
+	}
+}
+
+func (buffer *replyBuffer) timedOut() {
+	buffer.kind = replyTimedOut
+}
+
+func (buffer *replyBuffer) fail(code string, message string) {
+	buffer.kind, buffer.code, buffer.text = replyError, code, message
+}
+
+func (buffer *replyBuffer) failed() bool {
+	return buffer.kind == replyError
+}
+
+// writeLegacy sends the reply as lines, every command gets exactly one
+// reply. An error is a line starting with
+// "-" and the code. An array is a "*<count>" line and its items, "*0" when
+// it is empty and "*-1" for nothing at all, a blocking pop that timed out.
+// Any other reply is one value.
+func (buffer *replyBuffer) writeLegacy(out io.Writer) {
+	lines := []string{}
+	switch buffer.kind {
+	case replyNone:
+		lines = append(lines, "OK")
+	case replyStatus, replyBulk, replyRemoved:
+		lines = append(lines, legacyValue(buffer.text))
+	case replyInteger:
+		lines = append(lines, legacyValue(strconv.FormatInt(buffer.number, 10)))
+	case replyArray:
+		lines = append(lines, "*"+strconv.Itoa(len(buffer.items)))
+		for _, item := range buffer.items {
+			lines = append(lines, legacyValue(item))
+		}
+	case replyScanPage:
+		// the cursor comes first
+		lines = append(lines, "*"+strconv.Itoa(len(buffer.items)+1), strconv.FormatInt(buffer.number, 10))
+		for _, item := range buffer.items {
+			lines = append(lines, legacyValue(item))
+		}
+	case replyBoolean:
+		lines = append(lines, strconv.FormatBool(buffer.number == 1))
+	case replyTimedOut:
+		lines = append(lines, "*-1")
+	case replyError:
+		lines = append(lines, "-"+buffer.code+" "+buffer.text)
+	}
+	out.Write([]byte(strings.Join(lines, "\n") + "\n"))
+}
+
+// legacyValue is a value as one line. A value with a line break or one that
+// starts like an error, an array or a length goes as "$<length>\n", its
+// bytes and a line break, the way legacy commands send such values, see
+// framing.go.
+func legacyValue(value string) string {
+	if strings.ContainsAny(value, "\r\n") || (value != "" && strings.ContainsRune("-*$", rune(value[0]))) {
+		return "$" + strconv.Itoa(len(value)) + "\n" + value
+	}
+	return value
+}
+
+func writeError(out reply, code string, message string) {
+	out.fail(code, message)
+}
+
+func writeCommandError(out reply, err *commandError) {
+	out.fail(err.code, err.message)
+}
+
+// writeLegacyError answers a legacy client that sent no valid command
+func writeLegacyError(out io.Writer, code string, message string) {
+	buffer := &replyBuffer{}
+	buffer.fail(code, message)
+	buffer.writeLegacy(out)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// legacyCall sends one legacy command on database name and reads its reply
+func legacyCall(t *testing.T, client *legacyTestClient, name string, command string) interface{} {
+	t.Helper()
+	if err := client.send("--file " + name + " --query \"" + command + "\""); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := client.readReply()
+	if _, ok := err.(respError); ok {
+		return err
+	}
+	if err != nil {
+		t.Fatalf("%s: %v", command, err)
+	}
+	return reply
+}
+
+func TestLegacyEmptyReplies(t *testing.T) {
+	address := startTestServer(t)
+	client := dialLegacyTestClient(t, address)
+
+	// an empty array is a count of its own, the next reply follows it
+	if err := client.send(`--file empty --query "SMEMBERS missing"`); err != nil {
+		t.Fatal(err)
+	}
+	line, err := client.reader.ReadString('\n')
+	if err != nil || line != "*0\n" {
+		t.Fatalf("SMEMBERS of a missing set = %q, %v", line, err)
+	}
+	for _, command := range []string{"KEYS *", "SUNION missing other"} {
+		reply := legacyCall(t, client, "empty", command)
+		if items, ok := reply.([]interface{}); !ok || len(items) != 0 {
+			t.Fatalf("%s = %#v", command, reply)
+		}
+	}
+
+	// a blocking pop that got nothing
+	if reply := legacyCall(t, client, "empty", "BQPOP queue 0.01"); reply != nil {
+		t.Fatalf("BQPOP that timed out = %#v", reply)
+	}
+	if reply := legacyCall(t, client, "empty", "HSET table key value"); reply != "OK" {
+		t.Fatalf("HSET after the empty replies = %#v", reply)
+	}
+}
+
+func TestLegacyValuesThatLookLikeMarkers(t *testing.T) {
+	address := startTestServer(t)
+	client := dialLegacyTestClient(t, address)
+
+	for _, value := range []string{"-ERR", "-1", "*2", "$5"} {
+		if reply := legacyCall(t, client, "values", "HSET table key "+value); reply != "OK" {
+			t.Fatalf("HSET %q = %#v", value, reply)
+		}
+		if reply := legacyCall(t, client, "values", "HGET table key"); reply != value {
+			t.Fatalf("HGET of %q = %#v", value, reply)
+		}
+	}
+
+	// a frame keeps a value with a line break whole
+	command := "--file values --query \"HSET table lines first\nsecond\""
+	if err := client.send("$" + strconv.Itoa(len(command)) + "\n" + command); err != nil {
+		t.Fatal(err)
+	}
+	if reply, err := client.readReply(); err != nil || reply != "OK" {
+		t.Fatalf("HSET of two lines = %#v, %v", reply, err)
+	}
+	if reply := legacyCall(t, client, "values", "HGET table lines"); reply != "first\nsecond" {
+		t.Fatalf("HGET of two lines = %#v", reply)
+	}
+
+	legacyCall(t, client, "values", "SADD set -member")
+	reply := legacyCall(t, client, "values", "SMEMBERS set")
+	if items, ok := reply.([]interface{}); !ok || len(items) != 1 || items[0] != "-member" {
+		t.Fatalf("SMEMBERS = %#v", reply)
+	}
+	if reply := legacyCall(t, client, "values", "TTL table"); reply != "-1" {
+		t.Fatalf("TTL without a deadline = %#v", reply)
+	}
+
+	// a real error is still one
+	reply = legacyCall(t, client, "values", "HGET table missing")
+	if err, ok := reply.(respError); !ok || err[:9] != "NOSUCHKEY" {
+		t.Fatalf("HGET of a missing key = %#v", reply)
+	}
+}
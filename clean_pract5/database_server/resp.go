@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// database used by RESP connections until they send SELECT
+var RESP_DEFAULT_DATABASE = "0"
+
+const (
+	respMaxBulkLength  = 512 << 20
+	respMaxArrayLength = 1 << 20
+)
+
+type respProtocolError struct {
+	message string
+}
+
+func (err *respProtocolError) Error() string {
+	return "Protocol error: " + err.message
+}
+
+// readRespLine returns one line without its CRLF
+func readRespLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", &respProtocolError{"too big line"}
+	}
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", &respProtocolError{"expected CRLF"}
+	}
+	return string(line[:len(line)-2]), nil
+}
+
+func readRespLength(line string, prefix byte, limit int) (int, error) {
+	if len(line) == 0 || line[0] != prefix {
+		return 0, &respProtocolError{fmt.Sprintf("expected '%c', got '%s'", prefix, line)}
+	}
+	length, err := strconv.Atoi(line[1:])
+	if err != nil || length > limit {
+		return 0, &respProtocolError{fmt.Sprintf("invalid length '%s'", line[1:])}
+	}
+	return length, nil
+}
+
+// readRespCommand reads one array of bulk strings, an empty or null
+// array gives a nil command which the caller skips
+func readRespCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := readRespLine(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	count, err := readRespLength(line, '*', respMaxArrayLength)
+	if err != nil || count <= 0 {
+		return nil, err
+	}
+
+	args := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		line, err = readRespLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		length, err := readRespLength(line, '$', respMaxBulkLength)
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, &respProtocolError{"null bulk string in command"}
+		}
+
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if data[length] != '\r' || data[length+1] != '\n' {
+			return nil, &respProtocolError{"bulk string is not terminated by CRLF"}
+		}
+		args = append(args, string(data[:length]))
+	}
+
+	return args, nil
+}
+
+// encodeRespCommand is how commands travel to replicas
+func encodeRespCommand(args []string) []byte {
+	var buffer bytes.Buffer
+	buffer.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buffer.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	return buffer.Bytes()
+}
+
+type respWriter struct {
+	writer   *bufio.Writer
+	protocol int
+}
+
+func (w *respWriter) simpleString(value string) {
+	w.writer.WriteString("+" + value + "\r\n")
+}
+
+func (w *respWriter) errorReply(code string, message string) {
+	message = strings.NewReplacer("\r", " ", "\n", " ").Replace(message)
+	w.writer.WriteString("-" + code + " " + message + "\r\n")
+}
+
+func (w *respWriter) commandError(err *commandError) {
+	w.errorReply(err.code, err.message)
+}
+
+func (w *respWriter) integer(value int64) {
+	w.writer.WriteString(":" + strconv.FormatInt(value, 10) + "\r\n")
+}
+
+func (w *respWriter) bulk(value string) {
+	w.writer.WriteString("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+}
+
+func (w *respWriter) null() {
+	if w.protocol == 3 {
+		w.writer.WriteString("_\r\n")
+	} else {
+		w.writer.WriteString("$-1\r\n")
+	}
+}
+
+func (w *respWriter) nullArray() {
+	if w.protocol == 3 {
+		w.writer.WriteString("_\r\n")
+	} else {
+		w.writer.WriteString("*-1\r\n")
+	}
+}
+
+func (w *respWriter) arrayHeader(length int) {
+	w.writer.WriteString("*" + strconv.Itoa(length) + "\r\n")
+}
+
+// pushHeader starts an out of band message, RESP2 has no push type and
+// uses a plain array
+func (w *respWriter) pushHeader(length int) {
+	if w.protocol == 3 {
+		w.writer.WriteString(">" + strconv.Itoa(length) + "\r\n")
+	} else {
+		w.arrayHeader(length)
+	}
+}
+
+// mapHeader falls back to a flat array of key value pairs for RESP2
+func (w *respWriter) mapHeader(length int) {
+	if w.protocol == 3 {
+		w.writer.WriteString("%" + strconv.Itoa(length) + "\r\n")
+	} else {
+		w.arrayHeader(length * 2)
+	}
+}
+
+type respSession struct {
+	conn     net.Conn
+	reader   *bufio.Reader
+	database string
+	protocol int
+
+	// replies and published messages share the connection
+	writeMutex sync.Mutex
+	subscriber *subscriber
+
+	tx   transaction
+	auth *authState
+}
+
+// commands the session answers itself, they can not be queued in a
+// transaction
+var respSessionCommands = map[string]bool{
+	"PING":         true,
+	"ECHO":         true,
+	"SELECT":       true,
+	"HELLO":        true,
+	"COMMAND":      true,
+	"CLIENT":       true,
+	"REPLCONF":     true,
+	"AUTH":         true,
+	"SUBSCRIBE":    true,
+	"PSUBSCRIBE":   true,
+	"UNSUBSCRIBE":  true,
+	"PUNSUBSCRIBE": true,
+}
+
+func handleRespConnection(conn net.Conn, reader *bufio.Reader) {
+	session := &respSession{conn: conn, reader: reader, database: RESP_DEFAULT_DATABASE, protocol: 2, auth: newAuthState()}
+	writer := &respWriter{writer: newClientOutput(conn), protocol: 2}
+
+	defer func() {
+		if session.subscriber != nil {
+			pubsub.drop(session.subscriber)
+		}
+		session.tx.close()
+
+		// replies held back for a command that never arrived completely
+		session.writeMutex.Lock()
+		writer.writer.Flush()
+		session.writeMutex.Unlock()
+	}()
+
+	for {
+		args, err := readRespCommand(reader)
+		if err != nil {
+			var protocolErr *respProtocolError
+			if errors.As(err, &protocolErr) {
+				session.writeMutex.Lock()
+				writer.errorReply(codeError, protocolErr.Error())
+				writer.writer.Flush()
+				session.writeMutex.Unlock()
+			} else if err == io.EOF {
+				fmt.Println("Connection closed for", conn.LocalAddr())
+			} else {
+				fmt.Println("Error while reading data: ", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if strings.ToUpper(args[0]) == "SYNC" {
+			if err := session.auth.check("SYNC", ""); err != nil {
+				session.writeMutex.Lock()
+				writer.commandError(err)
+				writer.writer.Flush()
+				session.writeMutex.Unlock()
+				continue
+			}
+			// the connection belongs to a replica from now on
+			session.writeMutex.Lock()
+			err = writer.writer.Flush()
+			session.writeMutex.Unlock()
+			if err != nil {
+				return
+			}
+			servePrimaryLink(conn, reader)
+			return
+		}
+
+		session.writeMutex.Lock()
+		quit := session.execute(writer, args)
+		if quit {
+			err = writer.writer.Flush()
+		} else {
+			err = flushReplies(writer.writer, reader)
+		}
+		session.writeMutex.Unlock()
+		if err != nil {
+			fmt.Println("Error while writing replies: ", err)
+			return
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// execute handles the connection level commands itself and passes
+// everything else to the shared command set
+func (session *respSession) execute(w *respWriter, args []string) bool {
+	action := strings.ToUpper(args[0])
+
+	subscribed := session.subscriber != nil && session.subscriber.count() > 0
+	if subscribed && session.protocol == 2 && !subscribeCommands[action] {
+		w.errorReply(codeError, "Can't execute '"+strings.ToLower(args[0])+"': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+		return false
+	}
+	if err := session.auth.check(action, commandDatabase(action, args, session.database)); err != nil {
+		if session.tx.active {
+			session.tx.failed = true
+		}
+		w.commandError(err)
+		return false
+	}
+	if session.tx.active && respSessionCommands[action] {
+		w.errorReply(codeError, "'"+strings.ToLower(args[0])+"' can not be used inside MULTI")
+		return false
+	}
+
+	switch action {
+	case "MULTI", "DISCARD", "WATCH", "UNWATCH":
+		buffer := &replyBuffer{}
+		session.tx.control(buffer, session.database, action, args)
+		buffer.writeResp(w, action)
+	case "EXEC":
+		session.exec(w)
+	case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+		session.executeSubscribe(w, action, args)
+	case "PING":
+		if subscribed && session.protocol == 2 {
+			message := ""
+			if len(args) > 1 {
+				message = args[1]
+			}
+			w.arrayHeader(2)
+			w.bulk("pong")
+			w.bulk(message)
+		} else if len(args) > 1 {
+			w.bulk(args[1])
+		} else {
+			w.simpleString("PONG")
+		}
+	case "ECHO":
+		if len(args) != 2 {
+			w.commandError(wrongArguments(args[0]))
+			break
+		}
+		w.bulk(args[1])
+	case "SELECT":
+		if len(args) != 2 {
+			w.commandError(wrongArguments(args[0]))
+			break
+		}
+		session.database = args[1]
+		w.simpleString("OK")
+	case "AUTH":
+		if err := session.auth.authenticate(args); err != nil {
+			w.commandError(err)
+		} else {
+			w.simpleString("OK")
+		}
+	case "HELLO":
+		session.hello(w, args)
+	case "QUIT":
+		w.simpleString("OK")
+		return true
+	case "COMMAND":
+		// nothing to describe, clients only need a valid reply
+		w.arrayHeader(0)
+	case "CLIENT", "REPLCONF":
+		w.simpleString("OK")
+	default:
+		buffer := &replyBuffer{}
+		if session.tx.active {
+			session.tx.queue(buffer, session.database, args)
+		} else if blockingCommands[action] && checkCommand(args, fromClient) == nil {
+			// the replies so far must not wait with it
+			w.writer.Flush()
+			closed, stop := watchDisconnect(session.conn, session.reader)
+			executeBlocking(buffer, session.database, args, fromClient, closed)
+			stop()
+		} else {
+			executeCommand(buffer, session.database, args, fromClient)
+		}
+		buffer.writeResp(w, action)
+	}
+
+	return false
+}
+
+// exec answers with an array of the replies, or a null array when a
+// watched key changed
+func (session *respSession) exec(w *respWriter) {
+	commands := session.tx.queued
+	replies, err := session.tx.exec()
+	if err != nil {
+		w.commandError(err)
+		return
+	}
+	if replies == nil {
+		w.nullArray()
+		return
+	}
+
+	w.arrayHeader(len(replies))
+	for i, reply := range replies {
+		reply.writeResp(w, strings.ToUpper(commands[i].args[0]))
+	}
+}
+
+func (session *respSession) hello(w *respWriter, args []string) {
+	protocol := session.protocol
+	if len(args) > 1 {
+		var err error
+		protocol, err = strconv.Atoi(args[1])
+		if err != nil || (protocol != 2 && protocol != 3) {
+			w.errorReply(codeNoProto, "unsupported protocol version")
+			return
+		}
+	}
+	// HELLO <protocol> AUTH <user> <password> logs in on the way
+	for i := 2; i+2 < len(args); i++ {
+		if strings.ToUpper(args[i]) != "AUTH" {
+			continue
+		}
+		if err := session.auth.authenticate([]string{"AUTH", args[i+1], args[i+2]}); err != nil {
+			w.commandError(err)
+			return
+		}
+		i += 2
+	}
+	if session.auth.user == nil {
+		w.errorReply(codeNoAuth, "HELLO must be called with the client already authenticated, use HELLO <protocol> AUTH <user> <password>")
+		return
+	}
+	session.protocol = protocol
+	w.protocol = protocol
+
+	w.mapHeader(5)
+	w.bulk("server")
+	w.bulk("database_server")
+	w.bulk("version")
+	w.bulk("1.0.0")
+	w.bulk("proto")
+	w.integer(int64(session.protocol))
+	w.bulk("mode")
+	w.bulk("standalone")
+	w.bulk("role")
+	if replication.isReplica() {
+		w.bulk("replica")
+	} else {
+		w.bulk("master")
+	}
+}
+
+// writeResp sends the reply as its RESP type. A command that had nothing
+// to say is confirmed with OK.
+func (buffer *replyBuffer) writeResp(w *respWriter, action string) {
+	switch buffer.kind {
+	case replyNone:
+		w.simpleString("OK")
+	case replyStatus:
+		w.simpleString(buffer.text)
+	case replyBulk:
+		w.bulk(buffer.text)
+	case replyInteger, replyBoolean:
+		w.integer(buffer.number)
+	case replyRemoved:
+		w.integer(1)
+	case replyArray:
+		writeRespArray(w, buffer.items)
+	case replyScanPage:
+		w.arrayHeader(2)
+		w.bulk(strconv.FormatInt(buffer.number, 10))
+		writeRespArray(w, buffer.items)
+	case replyTimedOut:
+		w.nullArray()
+	case replyError:
+		writeRespFailure(w, action, buffer)
+	}
+}
+
+// writeRespFailure sends an error reply. The misses of the commands that
+// read, pop or remove one item are a null or a 0 instead.
+func writeRespFailure(w *respWriter, action string, buffer *replyBuffer) {
+	if buffer.code == codeNoSuchKey || buffer.code == codeEmpty {
+		switch action {
+		case "SPOP", "QPOP", "HGET", "ZSCORE", "ZRANK", "ZREVRANK", "SRANDMEMBER":
+			w.null()
+			return
+		case "QRESERVE", "QRESERVEAT":
+			w.nullArray()
+			return
+		case "HDEL", "SREM", "SISMEMBER":
+			w.integer(0)
+			return
+		}
+	}
+	w.errorReply(buffer.code, buffer.text)
+}
+
+func writeRespArray(w *respWriter, items []string) {
+	w.arrayHeader(len(items))
+	for _, item := range items {
+		w.bulk(item)
+	}
+}
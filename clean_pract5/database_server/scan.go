@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+// SCAN lists the structures of a database, HSCAN the fields of a hash
+// table, SSCAN the members of a set and ZSCAN those of a sorted set, a
+// few at a time.
+//
+// Like SCAN of redis a call walks a few slots and the cursor is the next
+// slot with its bits reversed, 0 starts and ends a scan. A table that
+// doubles or halves between two calls splits or merges the slots still
+// to come instead of reordering them, so an item that is there for the
+// whole scan is returned at least once even while tables resize and
+// rehash. It may come twice when a table shrank. Items added or removed
+// meanwhile may or may not show up.
+var scanCommands = map[string]bool{
+	"SCAN":  true,
+	"HSCAN": true,
+	"SSCAN": true,
+	"ZSCAN": true,
+}
+
+// items looked at by one call unless COUNT says otherwise
+const scanDefaultCount = 10
+
+type scanOptions struct {
+	pattern string
+	count   int
+	// SCAN only, the kind of structure as TYPE names it
+	kind string
+}
+
+type scanItem struct {
+	name string
+	// what is replied after the name, the value of a field or a score
+	values []string
+	kinds  map[string]bool
+}
+
+func parseScan(args []string, first int, allowType bool) (uint64, scanOptions, error) {
+	options := scanOptions{pattern: "*", count: scanDefaultCount}
+
+	cursor, err := strconv.ParseUint(args[first-1], 10, 64)
+	if err != nil {
+		return 0, options, errors.New("Invalid cursor")
+	}
+
+	for i := first; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return 0, options, errors.New("Syntax error")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			options.pattern = args[i+1]
+		case "COUNT":
+			options.count, err = strconv.Atoi(args[i+1])
+			if err != nil || options.count < 1 {
+				return 0, options, errors.New("Invalid count")
+			}
+		case "TYPE":
+			if !allowType {
+				return 0, options, errors.New("Syntax error")
+			}
+			options.kind = strings.ToLower(args[i+1])
+		default:
+			return 0, options, errors.New("Syntax error")
+		}
+	}
+
+	return cursor, options, nil
+}
+
+// nextCursor gives the slot after cursor in a table of mask+1 slots, 0
+// after the last one. It counts up from the highest bit of the slot, so
+// the slots still to come stay the same when the table is resized.
+func nextCursor(cursor uint64, mask uint64) uint64 {
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
+
+// scanSlot visits the entries of table whose home slot is cursor. They
+// are in the run of used slots that starts there, see probe.
+func scanSlot(table []*HashTableNode, cursor uint64, visit func(*HashTableNode)) {
+	mask := uint64(len(table) - 1)
+	home := cursor & mask
+	slot := home
+	for i := 0; i < len(table) && table[slot] != nil; i++ {
+		node := table[slot]
+		if node != deletedNode && uint64(hashKey(node.Key))&mask == home {
+			visit(node)
+		}
+		slot = (slot + 1) & mask
+	}
+}
+
+// scan visits the entries of the slot cursor and gives the next cursor.
+// While a resize is in progress it visits the slot of the smaller table
+// and every slot of the larger one it was split into, an entry is in one
+// of the two tables.
+func (ht *HashTable) scan(cursor uint64, visit func(*HashTableNode)) uint64 {
+	if !ht.isRehashing() {
+		scanSlot(ht.Table, cursor, visit)
+		return nextCursor(cursor, uint64(len(ht.Table)-1))
+	}
+
+	small, large := ht.oldTable, ht.Table
+	if len(small) > len(large) {
+		small, large = large, small
+	}
+	smallMask, largeMask := uint64(len(small)-1), uint64(len(large)-1)
+
+	scanSlot(small, cursor, visit)
+	for {
+		scanSlot(large, cursor, visit)
+		// the next of the larger slots with the same low bits
+		cursor = (((cursor | smallMask) + 1) &^ smallMask) | (cursor & smallMask)
+		if cursor&(smallMask^largeMask) == 0 {
+			break
+		}
+	}
+	return nextCursor(cursor, smallMask)
+}
+
+// tablePage walks the slots of ht from cursor on until count entries came
+// up. It looks at no more slots than should hold count entries, or ten
+// times count in a fuller table, so a small table is walked at once.
+func (ht *HashTable) tablePage(cursor uint64, count int, values bool, now int64) ([]scanItem, uint64) {
+	items := []scanItem{}
+	visit := func(node *HashTableNode) {
+		if ht.expired(node.Key, now) {
+			return
+		}
+		item := scanItem{name: node.Key}
+		if values {
+			item.values = []string{node.Value}
+		}
+		items = append(items, item)
+	}
+
+	limit := count * 10
+	if ht.count == 0 {
+		limit = ht.capacity
+	} else if sparse := count * ht.capacity / ht.count; sparse > limit {
+		limit = sparse
+	}
+	for slots := 0; slots < limit; slots++ {
+		cursor = ht.scan(cursor, visit)
+		if cursor == 0 || len(items) >= count {
+			break
+		}
+	}
+	return items, cursor
+}
+
+// virtualSlots is a page of the names that are not kept in a hash table,
+// the structures of a database and the members of a sorted set. They go
+// in the slots of a table sized for their number, about one name a slot,
+// which are walked like the slots of a hash table. A page is count slots,
+// start and end are the first and the next slot in the order of the scan.
+type virtualSlots struct {
+	mask  uint64
+	width uint
+	start uint64
+	end   uint64
+}
+
+func newVirtualSlots(cursor uint64, names int, count int) virtualSlots {
+	capacity := uint64(roundCapacity(names))
+	slots := virtualSlots{mask: capacity - 1, width: uint(bits.TrailingZeros64(capacity))}
+	slots.start = slots.reverse(cursor & slots.mask)
+	slots.end = slots.start + uint64(count)
+	return slots
+}
+
+// reverse turns a slot into its place in the order of the scan and back
+func (slots virtualSlots) reverse(slot uint64) uint64 {
+	return bits.Reverse64(slot) >> (64 - slots.width)
+}
+
+func (slots virtualSlots) contains(name string) bool {
+	place := slots.reverse(uint64(hashKey(name)) & slots.mask)
+	return place >= slots.start && place < slots.end
+}
+
+// next is the cursor of the following page
+func (slots virtualSlots) next() uint64 {
+	if slots.end > slots.mask {
+		return 0
+	}
+	return slots.reverse(slots.end)
+}
+
+// structurePage takes the live names of a database in the slots of one
+// page with their kinds, a name can be used by structures of different
+// kinds at once
+func (base *DatabaseStruct) structurePage(cursor uint64, count int, now int64) ([]scanItem, uint64) {
+	names := len(base.HashTables) + len(base.Stacks) + len(base.Queues) + len(base.Sets) + len(base.SortedSets)
+	slots := newVirtualSlots(cursor, names, count)
+
+	items := []scanItem{}
+	positions := map[string]int{}
+	add := func(name string, kind string) {
+		if !slots.contains(name) || base.nameExpired(name, now) {
+			return
+		}
+		position, found := positions[name]
+		if !found {
+			position = len(items)
+			positions[name] = position
+			items = append(items, scanItem{name: name, kinds: map[string]bool{}})
+		}
+		items[position].kinds[kind] = true
+	}
+
+	for i := range base.HashTables {
+		add(base.HashTables[i].Name, "hash")
+	}
+	for i := range base.Stacks {
+		add(base.Stacks[i].Name, "stack")
+	}
+	for i := range base.Queues {
+		add(base.Queues[i].Name, "queue")
+	}
+	for i := range base.Sets {
+		add(base.Sets[i].Name, "set")
+	}
+	for i := range base.SortedSets {
+		add(base.SortedSets[i].Name, "zset")
+	}
+	return items, slots.next()
+}
+
+// memberPage takes the members of a sorted set in the slots of one page
+// with their scores
+func (zset *SortedSet) memberPage(cursor uint64, count int) ([]scanItem, uint64) {
+	slots := newVirtualSlots(cursor, len(zset.scores), count)
+	items := []scanItem{}
+	for member, score := range zset.scores {
+		if slots.contains(member) {
+			items = append(items, scanItem{name: member, values: []string{formatScore(score)}})
+		}
+	}
+	return items, slots.next()
+}
+
+// filterScan applies MATCH and TYPE to a page, after the page was taken,
+// so a page may come back empty before the scan ends
+func filterScan(items []scanItem, options scanOptions) []scanItem {
+	page := []scanItem{}
+	for _, item := range items {
+		if !matchPattern(options.pattern, item.name) {
+			continue
+		}
+		if options.kind != "" && !item.kinds[options.kind] {
+			continue
+		}
+		page = append(page, item)
+	}
+	return page
+}
+
+// executeScan replies the next cursor and the names, each followed by its
+// value for HSCAN and ZSCAN
+func executeScan(out reply, base *DatabaseStruct, action string, args []string) {
+	first := 3
+	if action == "SCAN" {
+		first = 2
+	}
+	cursor, options, err := parseScan(args, first, action == "SCAN")
+	if err != nil {
+		writeError(out, codeSyntax, err.Error())
+		return
+	}
+
+	now := nowMillis()
+	items, next := []scanItem{}, uint64(0)
+	switch action {
+	case "SCAN":
+		items, next = base.structurePage(cursor, options.count, now)
+	case "HSCAN":
+		table := findHashTable(base, args[1])
+		if table != nil && !base.nameExpired(args[1], now) {
+			items, next = table.tablePage(cursor, options.count, true, now)
+		}
+	case "SSCAN":
+		if set := base.liveSet(args[1], now); set != nil {
+			items, next = set.ht.tablePage(cursor, options.count, false, now)
+		}
+	case "ZSCAN":
+		zset := findSortedSet(base, args[1])
+		if zset != nil && !base.nameExpired(args[1], now) {
+			items, next = zset.memberPage(cursor, options.count)
+		}
+	}
+
+	names := []string{}
+	for _, item := range filterScan(items, options) {
+		names = append(names, item.name)
+		names = append(names, item.values...)
+	}
+	out.scanPage(next, names)
+}
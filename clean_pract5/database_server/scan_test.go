@@ -0,0 +1,183 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// scanTable runs a whole scan of ht, calling between after every page,
+// and counts how often each key came up
+func scanTable(t *testing.T, ht *HashTable, count int, between func()) map[string]int {
+	seen := map[string]int{}
+	cursor := uint64(0)
+	for pages := 0; ; pages++ {
+		if pages > 100000 {
+			t.Fatal("the scan does not end")
+		}
+		var items []scanItem
+		items, cursor = ht.tablePage(cursor, count, false, nowMillis())
+		for _, item := range items {
+			seen[item.name]++
+		}
+		if cursor == 0 {
+			return seen
+		}
+		between()
+	}
+}
+
+func TestScanTableOnce(t *testing.T) {
+	ht := NewHashTable("test", 8)
+	for i := 0; i < 1000; i++ {
+		ht.Add("key:"+strconv.Itoa(i), "value")
+	}
+	// deletes leave tombstones in the runs the scan walks
+	for i := 0; i < 1000; i += 3 {
+		ht.Delete("key:" + strconv.Itoa(i))
+	}
+
+	seen := scanTable(t, ht, 7, func() {})
+	if len(seen) != ht.Len() {
+		t.Fatalf("scan found %d keys of %d", len(seen), ht.Len())
+	}
+	for key, times := range seen {
+		if times != 1 {
+			t.Fatalf("%s came %d times from a table that did not change", key, times)
+		}
+	}
+}
+
+func TestScanTableGrowing(t *testing.T) {
+	ht := NewHashTable("test", 8)
+	for i := 0; i < 200; i++ {
+		ht.Add("kept:"+strconv.Itoa(i), "value")
+	}
+
+	capacity, rehashed := ht.capacity, false
+	added := 0
+	seen := scanTable(t, ht, 5, func() {
+		for i := 0; i < 40; i++ {
+			ht.Add("added:"+strconv.Itoa(added), "value")
+			added++
+		}
+		rehashed = rehashed || ht.isRehashing()
+	})
+
+	if ht.capacity < capacity*8 || !rehashed {
+		t.Fatalf("the table went from %d to %d slots, rehashed: %v", capacity, ht.capacity, rehashed)
+	}
+	for i := 0; i < 200; i++ {
+		if seen["kept:"+strconv.Itoa(i)] == 0 {
+			t.Fatalf("kept:%d was missed while the table grew", i)
+		}
+	}
+}
+
+func TestScanTableShrinking(t *testing.T) {
+	ht := NewHashTable("test", 8)
+	for i := 0; i < 20000; i++ {
+		ht.Add("gone:"+strconv.Itoa(i), "value")
+	}
+	for i := 0; i < 100; i++ {
+		ht.Add("kept:"+strconv.Itoa(i), "value")
+	}
+
+	capacity, rehashed := ht.capacity, false
+	deleted := 0
+	seen := scanTable(t, ht, 20, func() {
+		for i := 0; i < 400 && deleted < 20000; i++ {
+			ht.Delete("gone:" + strconv.Itoa(deleted))
+			deleted++
+		}
+		rehashed = rehashed || ht.isRehashing()
+	})
+
+	if ht.capacity > capacity/8 || !rehashed {
+		t.Fatalf("the table went from %d to %d slots, rehashed: %v", capacity, ht.capacity, rehashed)
+	}
+	for i := 0; i < 100; i++ {
+		if seen["kept:"+strconv.Itoa(i)] == 0 {
+			t.Fatalf("kept:%d was missed while the table shrank", i)
+		}
+	}
+}
+
+// scanServer runs a whole scan command through a client, calling between
+// after every page, and counts how often each name came up
+func scanServer(t *testing.T, client *testClient, command []string, step int, between func()) map[string]int {
+	seen := map[string]int{}
+	cursor := "0"
+	for pages := 0; ; pages++ {
+		if pages > 10000 {
+			t.Fatal("the scan does not end")
+		}
+		args := append([]string{command[0]}, command[1:]...)
+		args = append(args, cursor, "COUNT", "5")
+		reply, ok := client.do(args...).([]interface{})
+		if !ok || len(reply) != 2 {
+			t.Fatalf("%v = %#v", args, reply)
+		}
+		items := reply[1].([]interface{})
+		for i := 0; i < len(items); i += step {
+			seen[items[i].(string)]++
+		}
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			return seen
+		}
+		between()
+	}
+}
+
+func TestScanNamesWhileTheyChange(t *testing.T) {
+	address := startTestServer(t)
+	client := dialTestClient(t, address)
+	other := dialTestClient(t, address)
+	for _, c := range []*testClient{client, other} {
+		c.expect("OK", "SELECT", "scans")
+	}
+
+	for i := 0; i < 100; i++ {
+		client.expect("OK", "HSET", "kept:"+strconv.Itoa(i), "field", "value")
+		client.expect(1, "ZADD", "zset", strconv.Itoa(i), "kept:"+strconv.Itoa(i))
+	}
+
+	// names come and go, so the slots they are placed in change size
+	added, stacks := 0, 0
+	change := func(zset bool) func() {
+		return func() {
+			for i := 0; i < 10; i++ {
+				name := "added:" + strconv.Itoa(added)
+				if zset {
+					other.expect(1, "ZADD", "zset", "1", name)
+				} else {
+					other.expect("OK", "SPUSH", name, "value")
+					stacks++
+				}
+				added++
+			}
+		}
+	}
+
+	names := scanServer(t, client, []string{"SCAN"}, 1, change(false))
+	members := scanServer(t, client, []string{"ZSCAN", "zset"}, 2, change(true))
+	for i := 0; i < 100; i++ {
+		if names["kept:"+strconv.Itoa(i)] == 0 {
+			t.Fatalf("SCAN missed kept:%d", i)
+		}
+		if members["kept:"+strconv.Itoa(i)] == 0 {
+			t.Fatalf("ZSCAN missed kept:%d", i)
+		}
+	}
+
+	// without changes every name comes exactly once
+	names = scanServer(t, client, []string{"SCAN"}, 1, func() {})
+	if want := 100 + 1 + stacks; len(names) != want {
+		t.Fatalf("SCAN found %d names, want %d", len(names), want)
+	}
+	for name, times := range names {
+		if times != 1 {
+			t.Fatalf("%s came %d times", name, times)
+		}
+	}
+}
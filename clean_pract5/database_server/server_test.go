@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startTestServer serves clients on a free local port until the test
+// ends. The data starts empty and snapshots go to a temporary directory.
+func startTestServer(t *testing.T) string {
+	t.Helper()
+	resetTestData(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// resetTestData drops every database and the settings tests change
+func resetTestData(t *testing.T) {
+	db.mutex.Lock()
+	for _, base := range db.databasesList {
+		base.mutex.Lock()
+		base.flush()
+		base.wakeBlocked()
+		base.mutex.Unlock()
+	}
+	db.databasesList = nil
+	// tables tests made on their own were counted too
+	recountMemory()
+	db.mutex.Unlock()
+
+	SNAPSHOT_FILE = filepath.Join(t.TempDir(), "snapshot.json")
+	aclUsers = nil
+	MAX_MEMORY = 0
+	MAX_MEMORY_POLICY = policyNoEviction
+}
+
+// respError is an error reply, as opposed to a failed connection
+type respError string
+
+func (err respError) Error() string {
+	return string(err)
+}
+
+// testClient speaks RESP 2 to a test server
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialTestClient(t *testing.T, address string) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// call sends one command and reads its reply: a string for simple
+// strings and bulks, an int64, nil, a []interface{} or a respError. It
+// may be used from any goroutine.
+func (client *testClient) call(args ...string) (interface{}, error) {
+	client.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	command := "*" + strconv.Itoa(len(args)) + "\r\n"
+	for _, arg := range args {
+		command += "$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n"
+	}
+	if _, err := client.conn.Write([]byte(command)); err != nil {
+		return nil, err
+	}
+	return readTestReply(client.reader)
+}
+
+// do is call for the test goroutine, a failed connection ends the test
+func (client *testClient) do(args ...string) interface{} {
+	client.t.Helper()
+	reply, err := client.call(args...)
+	if _, ok := err.(respError); ok {
+		return err
+	}
+	if err != nil {
+		client.t.Fatalf("%v: %v", args, err)
+	}
+	return reply
+}
+
+// expect runs a command and fails the test unless the reply is want
+func (client *testClient) expect(want interface{}, args ...string) {
+	client.t.Helper()
+	reply := client.do(args...)
+	if !sameReply(reply, want) {
+		client.t.Fatalf("%v = %#v, want %#v", args, reply, want)
+	}
+}
+
+// expectError runs a command and fails the test unless it fails with code
+func (client *testClient) expectError(code string, args ...string) {
+	client.t.Helper()
+	reply := client.do(args...)
+	err, ok := reply.(respError)
+	if !ok || !strings.HasPrefix(string(err), code+" ") {
+		client.t.Fatalf("%v = %#v, want a %s error", args, reply, code)
+	}
+}
+
+func sameReply(reply interface{}, want interface{}) bool {
+	if want, ok := want.(int); ok {
+		return reply == int64(want)
+	}
+	wantItems, ok := want.([]string)
+	if !ok {
+		return reply == want
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != len(wantItems) {
+		return false
+	}
+	for i := range items {
+		if items[i] != wantItems[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func readTestReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply line")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, respError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			items[i], err = readTestReply(reader)
+			if _, ok := err.(respError); ok {
+				items[i], err = err, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, errors.New("unexpected reply line " + line)
+}
+
+// legacyTestClient speaks the line protocol of the first clients
+type legacyTestClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialLegacyTestClient(t *testing.T, address string) *legacyTestClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &legacyTestClient{conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// send writes one command line, the reply has to be read with readReply
+func (client *legacyTestClient) send(line string) error {
+	client.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err := client.conn.Write([]byte(line + "\n"))
+	return err
+}
+
+// readReply reads one typed reply like call does: a string, nil, a
+// []interface{} or a respError
+func (client *legacyTestClient) readReply() (interface{}, error) {
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\n")
+
+	switch {
+	case strings.HasPrefix(line, "-"):
+		return nil, respError(line[1:])
+	case strings.HasPrefix(line, "$"):
+		length, err := strconv.Atoi(line[1:])
+		if err != nil || length < 0 {
+			return nil, errors.New("bad length line " + line)
+		}
+		data := make([]byte, length+1)
+		if _, err := io.ReadFull(client.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:length]), nil
+	case strings.HasPrefix(line, "*"):
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, errors.New("bad count line " + line)
+		}
+		if count < 0 {
+			return nil, nil
+		}
+		items := make([]interface{}, count)
+		for i := range items {
+			if items[i], err = client.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return line, nil
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Set algebra works on several sets of the same database, a name that
+// does not exist or has expired counts as an empty set. Lists of members
+// are replied sorted so the output is stable.
+//
+// SPOP pops the top of a stack. On a name that holds a set and no stack,
+// or with a count, it takes random members out of the set like SPOP of
+// redis does, see popsSet.
+var setCommands = map[string]bool{
+	"SMEMBERS":    true,
+	"SCARD":       true,
+	"SUNION":      true,
+	"SINTER":      true,
+	"SDIFF":       true,
+	"SUNIONSTORE": true,
+	"SINTERSTORE": true,
+	"SDIFFSTORE":  true,
+	"SRANDMEMBER": true,
+}
+
+func findSet(base *DatabaseStruct, name string) *Set {
+	for i := range base.Sets {
+		if base.Sets[i].Name == name {
+			return &base.Sets[i]
+		}
+	}
+	return nil
+}
+
+// liveSet leaves out an expired set, reads can not remove it
+func (base *DatabaseStruct) liveSet(name string, now int64) *Set {
+	if base.nameExpired(name, now) {
+		return nil
+	}
+	return findSet(base, name)
+}
+
+func (set *Set) members() []string {
+	members := []string{}
+	if set == nil {
+		return members
+	}
+	for _, element := range set.ht.entries() {
+		members = append(members, element.Key)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// combine computes the union, intersection or difference of the named sets
+func (base *DatabaseStruct) combine(operation string, names []string) []string {
+	now := nowMillis()
+	first := base.liveSet(names[0], now)
+
+	switch operation {
+	case "SUNION":
+		seen := map[string]bool{}
+		result := []string{}
+		for _, name := range names {
+			for _, member := range base.liveSet(name, now).members() {
+				if !seen[member] {
+					seen[member] = true
+					result = append(result, member)
+				}
+			}
+		}
+		sort.Strings(result)
+		return result
+	case "SINTER":
+		others := []*Set{}
+		for _, name := range names[1:] {
+			set := base.liveSet(name, now)
+			if set == nil {
+				return []string{}
+			}
+			others = append(others, set)
+		}
+		result := []string{}
+		for _, member := range first.members() {
+			inAll := true
+			for _, set := range others {
+				if !set.IsMember(member) {
+					inAll = false
+					break
+				}
+			}
+			if inAll {
+				result = append(result, member)
+			}
+		}
+		return result
+	case "SDIFF":
+		result := []string{}
+		for _, member := range first.members() {
+			inOther := false
+			for _, name := range names[1:] {
+				set := base.liveSet(name, now)
+				if set != nil && set.IsMember(member) {
+					inOther = true
+					break
+				}
+			}
+			if !inOther {
+				result = append(result, member)
+			}
+		}
+		return result
+	}
+
+	return nil
+}
+
+// storeSet replaces the set called name, an empty result removes it. The
+// new set starts without the deadline of the old one.
+func (base *DatabaseStruct) storeSet(name string, members []string) {
+	sets := base.Sets[:0]
+	for _, set := range base.Sets {
+		if set.Name != name {
+			sets = append(sets, set)
+		} else {
+			trackMemory(-set.ht.memoryUsage())
+		}
+	}
+	base.Sets = sets
+	base.dropDeadline(name)
+
+	if len(members) == 0 {
+		return
+	}
+	set := NewSet(name, 512)
+	for _, member := range members {
+		set.Add(member)
+	}
+	base.Sets = append(base.Sets, *set)
+}
+
+func parseCount(value string) (int, error) {
+	count, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.New("Invalid count")
+	}
+	return count, nil
+}
+
+// randomMembers picks count distinct members, or with a negative count
+// -count members that may repeat
+func randomMembers(members []string, count int) []string {
+	picked := []string{}
+	if len(members) == 0 {
+		return picked
+	}
+
+	if count < 0 {
+		for i := 0; i < -count; i++ {
+			picked = append(picked, members[rand.Intn(len(members))])
+		}
+		return picked
+	}
+
+	for _, i := range rand.Perm(len(members)) {
+		if len(picked) == count {
+			break
+		}
+		picked = append(picked, members[i])
+	}
+	return picked
+}
+
+// executeSets runs the set algebra and enumeration commands
+func executeSets(out reply, base *DatabaseStruct, action string, args []string) [][]string {
+	now := nowMillis()
+
+	switch action {
+	case "SMEMBERS":
+		out.array(base.liveSet(args[1], now).members())
+	case "SCARD":
+		count := 0
+		if set := base.liveSet(args[1], now); set != nil {
+			count = set.ht.Len()
+		}
+		out.integer(int64(count))
+	case "SUNION", "SINTER", "SDIFF":
+		out.array(base.combine(action, args[1:]))
+	case "SUNIONSTORE", "SINTERSTORE", "SDIFFSTORE":
+		members := base.combine(strings.TrimSuffix(action, "STORE"), args[2:])
+		base.storeSet(args[1], members)
+		out.integer(int64(len(members)))
+	case "SRANDMEMBER":
+		count := 1
+		if len(args) > 2 {
+			var err error
+			count, err = parseCount(args[2])
+			if err != nil {
+				writeError(out, codeSyntax, "Invalid count")
+				return nil
+			}
+		}
+		writeRandomMembers(out, args, randomMembers(base.liveSet(args[1], now).members(), count))
+	}
+
+	return nil
+}
+
+// writeRandomMembers replies one member without a count and a list with one
+func writeRandomMembers(out reply, args []string, picked []string) {
+	if len(args) == 2 && len(picked) == 0 {
+		writeError(out, codeEmpty, "Set is empty")
+	} else if len(args) == 2 {
+		out.bulk(picked[0])
+	} else {
+		out.array(picked)
+	}
+}
+
+// popsSet tells whether SPOP takes random members of a set rather than
+// the top of a stack. It is decided before SPOP runs, its pop may remove
+// the set.
+func (base *DatabaseStruct) popsSet(args []string, now int64) bool {
+	if len(args) > 2 {
+		return true
+	}
+	return findStack(base, args[1]) == nil && base.liveSet(args[1], now) != nil
+}
+
+// executeSetPop is SPOP name [count] of a set. The members are picked at
+// random, so it returns the SREM of each one to be recorded in its place.
+func executeSetPop(out reply, base *DatabaseStruct, args []string) [][]string {
+	count := 1
+	if len(args) > 2 {
+		var err error
+		count, err = parseCount(args[2])
+		if err != nil || count < 0 {
+			writeError(out, codeSyntax, "Invalid count")
+			return nil
+		}
+	}
+
+	set := base.liveSet(args[1], nowMillis())
+	picked := randomMembers(set.members(), count)
+	writeRandomMembers(out, args, picked)
+
+	commands := [][]string{}
+	for _, member := range picked {
+		set.Remove(member)
+		commands = append(commands, []string{"SREM", args[1], member})
+	}
+	return commands
+}
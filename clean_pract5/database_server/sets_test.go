@@ -0,0 +1,79 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestSPopByKind(t *testing.T) {
+	address := startTestServer(t)
+	client := dialTestClient(t, address)
+	client.expect("OK", "SELECT", "pops")
+
+	// a stack pops its top
+	client.expect("OK", "SPUSH", "stack", "first")
+	client.expect("OK", "SPUSH", "stack", "second")
+	client.expect("second", "SPOP", "stack")
+
+	// a set gives random members until it is empty
+	for _, member := range []string{"a", "b", "c"} {
+		client.expect("OK", "SADD", "set", member)
+	}
+	popped := []string{}
+	first, ok := client.do("SPOP", "set").(string)
+	if !ok {
+		t.Fatalf("SPOP of a set gave %#v", first)
+	}
+	popped = append(popped, first)
+	rest, ok := client.do("SPOP", "set", "5").([]interface{})
+	if !ok || len(rest) != 2 {
+		t.Fatalf("SPOP set 5 = %#v", rest)
+	}
+	for _, member := range rest {
+		popped = append(popped, member.(string))
+	}
+	sort.Strings(popped)
+	if popped[0] != "a" || popped[1] != "b" || popped[2] != "c" {
+		t.Fatalf("popped %q", popped)
+	}
+	client.expect(0, "SCARD", "set")
+	client.expect(nil, "SPOP", "set")
+
+	// a count only makes sense for a set
+	client.expectError("WRONGTYPE", "SPOP", "stack", "2")
+	client.expectError("SYNTAX", "SPOP", "set", "-1")
+	client.expect("first", "SPOP", "stack")
+}
+
+func TestSetStoreOverwrites(t *testing.T) {
+	address := startTestServer(t)
+	client := dialTestClient(t, address)
+	client.expect("OK", "SELECT", "stores")
+
+	for _, member := range []string{"a", "b"} {
+		client.expect("OK", "SADD", "first", member)
+	}
+	for _, member := range []string{"b", "c"} {
+		client.expect("OK", "SADD", "second", member)
+	}
+
+	client.expect(3, "SUNIONSTORE", "result", "first", "second")
+	client.expect(1, "EXPIRE", "result", "100")
+
+	// every STORE replaces the destination, members and deadline
+	client.expect(1, "SINTERSTORE", "result", "first", "second")
+	client.expect([]string{"b"}, "SMEMBERS", "result")
+	client.expect(-1, "TTL", "result")
+	checkMemoryCount(t, "intersection")
+
+	client.expect(1, "EXPIRE", "result", "100")
+	client.expect(1, "SDIFFSTORE", "result", "first", "second")
+	client.expect([]string{"a"}, "SMEMBERS", "result")
+	client.expect(-1, "TTL", "result")
+
+	// an empty result removes the destination
+	client.expect(0, "SINTERSTORE", "result", "first", "missing")
+	client.expect(0, "SCARD", "result")
+	client.expect(-2, "TTL", "result")
+	checkMemoryCount(t, "removed")
+}
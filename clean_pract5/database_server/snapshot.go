@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+var SNAPSHOT_FILE = "data/dump.json"
+var SNAPSHOT_INTERVAL = 60 * time.Second
+
+const snapshotVersion = 1
+
+// snapshot file layout, one entry per database
+type snapshotFile struct {
+	Version   int                `json:"version"`
+	SavedAt   int64              `json:"savedAt"`
+	Databases []snapshotDatabase `json:"databases"`
+}
+
+type snapshotDatabase struct {
+	Name       string              `json:"name"`
+	HashTables []snapshotHashTable `json:"hashTables"`
+	Stacks     []snapshotList      `json:"stacks"`
+	Queues     []snapshotList      `json:"queues"`
+	Sets       []snapshotList      `json:"sets"`
+	SortedSets []snapshotSortedSet `json:"sortedSets"`
+	Expires    map[string]int64    `json:"expires,omitempty"`
+}
+
+// members from the lowest score up, scores as text so infinity fits in JSON
+type snapshotSortedSet struct {
+	Name    string          `json:"name"`
+	Members []snapshotScore `json:"members"`
+}
+
+type snapshotScore struct {
+	Member string `json:"member"`
+	Score  string `json:"score"`
+}
+
+type snapshotHashTable struct {
+	Name     string           `json:"name"`
+	Capacity int              `json:"capacity"`
+	Entries  []HashTableNode  `json:"entries"`
+	Expires  map[string]int64 `json:"expires,omitempty"`
+}
+
+// stacks are stored top to bottom, queues head to tail
+type snapshotList struct {
+	Name     string   `json:"name"`
+	Capacity int      `json:"capacity,omitempty"`
+	Items    []string `json:"items"`
+
+	// queues only, deliveries of each item, the items in flight and the
+	// delayed items
+	Attempts []int                 `json:"attempts,omitempty"`
+	InFlight []snapshotReservation `json:"inFlight,omitempty"`
+	Delayed  []snapshotDelayed     `json:"delayed,omitempty"`
+}
+
+type snapshotReservation struct {
+	ID       string `json:"id"`
+	Value    string `json:"value"`
+	Deadline int64  `json:"deadline"`
+	Attempts int    `json:"attempts"`
+}
+
+type snapshotDelayed struct {
+	Value    string `json:"value"`
+	At       int64  `json:"at"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+func copyExpires(expires map[string]int64) map[string]int64 {
+	if len(expires) == 0 {
+		return nil
+	}
+	result := make(map[string]int64, len(expires))
+	for key, at := range expires {
+		result[key] = at
+	}
+	return result
+}
+
+// snapshot keeps the deadlines of the fields it saves, a field that
+// expired is left out together with its deadline
+func (ht *HashTable) snapshot() snapshotHashTable {
+	saved := snapshotHashTable{Name: ht.Name, Capacity: ht.capacity, Entries: ht.entries()}
+	for _, element := range saved.Entries {
+		at, ok := ht.expires[element.Key]
+		if !ok {
+			continue
+		}
+		if saved.Expires == nil {
+			saved.Expires = map[string]int64{}
+		}
+		saved.Expires[element.Key] = at
+	}
+	return saved
+}
+
+func (stack *Stack) items() []string {
+	result := []string{}
+	for node := stack.head; node != nil; node = node.next {
+		result = append(result, node.data)
+	}
+	return result
+}
+
+// snapshot keeps delivery counts only when some item has one
+func (queue *Queue) snapshot() snapshotList {
+	saved := snapshotList{Name: queue.Name, Items: queue.items()}
+
+	attempts := []int{}
+	retried := false
+	for node := queue.head; node != nil; node = node.next {
+		attempts = append(attempts, node.attempts)
+		if node.attempts > 0 {
+			retried = true
+		}
+	}
+	if retried {
+		saved.Attempts = attempts
+	}
+
+	for _, id := range queue.reservationIDs() {
+		item := queue.inFlight[id]
+		saved.InFlight = append(saved.InFlight, snapshotReservation{ID: id, Value: item.value, Deadline: item.deadline, Attempts: item.attempts})
+	}
+	for _, item := range queue.delayedItems() {
+		saved.Delayed = append(saved.Delayed, snapshotDelayed{Value: item.value, At: item.at, Attempts: item.attempts})
+	}
+	return saved
+}
+
+func (queue *Queue) items() []string {
+	result := []string{}
+	for node := queue.head; node != nil; node = node.next {
+		result = append(result, node.data)
+	}
+	return result
+}
+
+// snapshot copies every structure of one database, caller must hold its
+// lock
+func (base *DatabaseStruct) snapshot() snapshotDatabase {
+	savedBase := snapshotDatabase{Name: base.Name, Expires: copyExpires(base.expires)}
+	for i := range base.HashTables {
+		savedBase.HashTables = append(savedBase.HashTables, base.HashTables[i].snapshot())
+	}
+	for i := range base.Stacks {
+		savedBase.Stacks = append(savedBase.Stacks, snapshotList{Name: base.Stacks[i].Name, Items: base.Stacks[i].items()})
+	}
+	for i := range base.Queues {
+		savedBase.Queues = append(savedBase.Queues, base.Queues[i].snapshot())
+	}
+	for i := range base.Sets {
+		members := []string{}
+		for _, element := range base.Sets[i].ht.entries() {
+			members = append(members, element.Key)
+		}
+		savedBase.Sets = append(savedBase.Sets, snapshotList{Name: base.Sets[i].Name, Capacity: base.Sets[i].ht.capacity, Items: members})
+	}
+	for i := range base.SortedSets {
+		saved := snapshotSortedSet{Name: base.SortedSets[i].Name, Members: []snapshotScore{}}
+		for _, node := range base.SortedSets[i].entries() {
+			saved.Members = append(saved.Members, snapshotScore{Member: node.member, Score: formatScore(node.score)})
+		}
+		savedBase.SortedSets = append(savedBase.SortedSets, saved)
+	}
+	return savedBase
+}
+
+// makeSnapshot copies every structure while it holds the read locks of
+// all databases together, so the dump is one point in time across them
+// and not just within each database. The caller must hold db.mutex.
+func (mainDb *MainDatabaseStructure) makeSnapshot() snapshotFile {
+	snapshot := snapshotFile{
+		Version:   snapshotVersion,
+		SavedAt:   time.Now().Unix(),
+		Databases: []snapshotDatabase{},
+	}
+
+	// commands hold the lock of one database at a time, so taking all of
+	// them one after the other can not deadlock
+	for _, base := range mainDb.databasesList {
+		base.mutex.RLock()
+	}
+	for _, base := range mainDb.databasesList {
+		snapshot.Databases = append(snapshot.Databases, base.snapshot())
+	}
+	for _, base := range mainDb.databasesList {
+		base.mutex.RUnlock()
+	}
+
+	return snapshot
+}
+
+func (snapshot *snapshotFile) restore() []*DatabaseStruct {
+	databases := []*DatabaseStruct{}
+
+	for _, savedBase := range snapshot.Databases {
+		base := &DatabaseStruct{Name: savedBase.Name, expires: savedBase.Expires}
+		for _, savedTable := range savedBase.HashTables {
+			capacity := savedTable.Capacity
+			if capacity <= 0 {
+				capacity = 512
+			}
+			table := NewHashTable(savedTable.Name, capacity)
+			for _, element := range savedTable.Entries {
+				table.Add(element.Key, element.Value)
+			}
+			table.expires = savedTable.Expires
+			base.HashTables = append(base.HashTables, *table)
+		}
+		for _, savedStack := range savedBase.Stacks {
+			stack := NewStack(savedStack.Name)
+			for i := len(savedStack.Items) - 1; i >= 0; i-- {
+				stack.push(savedStack.Items[i])
+			}
+			base.Stacks = append(base.Stacks, *stack)
+		}
+		for _, savedQueue := range savedBase.Queues {
+			queue := NewQueue(savedQueue.Name)
+			for j, item := range savedQueue.Items {
+				attempts := 0
+				if j < len(savedQueue.Attempts) {
+					attempts = savedQueue.Attempts[j]
+				}
+				queue.pushAttempts(item, attempts)
+			}
+			for _, item := range savedQueue.InFlight {
+				queue.addInFlight(item.ID, &reservation{value: item.Value, deadline: item.Deadline, attempts: item.Attempts})
+			}
+			for _, item := range savedQueue.Delayed {
+				queue.pushDelayed(item.Value, item.At, item.Attempts)
+			}
+			base.Queues = append(base.Queues, *queue)
+		}
+		for _, savedSet := range savedBase.Sets {
+			capacity := savedSet.Capacity
+			if capacity <= 0 {
+				capacity = 512
+			}
+			set := NewSet(savedSet.Name, capacity)
+			for _, member := range savedSet.Items {
+				set.Add(member)
+			}
+			base.Sets = append(base.Sets, *set)
+		}
+		for _, savedSortedSet := range savedBase.SortedSets {
+			zset := NewSortedSet(savedSortedSet.Name)
+			for _, saved := range savedSortedSet.Members {
+				score, err := parseScore(saved.Score)
+				if err != nil {
+					continue
+				}
+				zset.Add(saved.Member, score)
+			}
+			base.SortedSets = append(base.SortedSets, *zset)
+		}
+		databases = append(databases, base)
+	}
+
+	return databases
+}
+
+// writeSnapshot goes through a temp file and a rename so a crash
+// in the middle never leaves a half written dump behind
+func writeSnapshot(snapshot snapshotFile, filename string) error {
+	jsonData, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(filename)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, "dump-*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmpFile.Name()
+
+	_, err = tmpFile.Write(jsonData)
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	closeErr := tmpFile.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, filename)
+}
+
+func loadSnapshot(filename string) ([]*DatabaseStruct, error) {
+	file, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if len(file) == 0 {
+		return nil, nil
+	}
+
+	return parseSnapshot(file)
+}
+
+// parseSnapshot reads a dump, from the snapshot file or from a primary
+func parseSnapshot(data []byte) ([]*DatabaseStruct, error) {
+	var snapshot snapshotFile
+	err := json.Unmarshal(data, &snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshot.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", snapshot.Version)
+	}
+
+	return snapshot.restore(), nil
+}
+
+// save blocks until the dump is on disk, caller must hold db.mutex
+func (mainDb *MainDatabaseStructure) save() error {
+	mainDb.saveMutex.Lock()
+	defer mainDb.saveMutex.Unlock()
+
+	savedDirty := atomic.LoadInt64(&mainDb.dirty)
+	snapshot := mainDb.makeSnapshot()
+	err := writeSnapshot(snapshot, SNAPSHOT_FILE)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&mainDb.dirty, -savedDirty)
+	mainDb.lastSave = time.Now()
+	return nil
+}
+
+// bgsave copies the data right away, caller must hold db.mutex, and
+// writes it out in a separate goroutine
+func (mainDb *MainDatabaseStructure) bgsave() error {
+	mainDb.saveMutex.Lock()
+	defer mainDb.saveMutex.Unlock()
+
+	if mainDb.bgsaveInProgress {
+		return errors.New("Background save already in progress")
+	}
+
+	savedDirty := atomic.LoadInt64(&mainDb.dirty)
+	snapshot := mainDb.makeSnapshot()
+	mainDb.bgsaveInProgress = true
+
+	go func() {
+		err := writeSnapshot(snapshot, SNAPSHOT_FILE)
+
+		mainDb.saveMutex.Lock()
+		defer mainDb.saveMutex.Unlock()
+
+		mainDb.bgsaveInProgress = false
+		if err != nil {
+			fmt.Println("Background save failed: ", err)
+			return
+		}
+		atomic.AddInt64(&mainDb.dirty, -savedDirty)
+		mainDb.lastSave = time.Now()
+	}()
+
+	return nil
+}
+
+// snapshotLoop saves in the background whenever something changed
+// since the last dump
+func (mainDb *MainDatabaseStructure) snapshotLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if atomic.LoadInt64(&mainDb.dirty) == 0 {
+			continue
+		}
+
+		mainDb.mutex.RLock()
+		err := mainDb.bgsave()
+		mainDb.mutex.RUnlock()
+		if err != nil {
+			fmt.Println("Periodic save failed: ", err)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// address of the TLS listener, empty serves plaintext only. Both
+// listeners speak the same protocols and share every database.
+var TLS_LISTEN_ADDRESS = ""
+
+// PEM files of the server certificate and its key
+var TLS_CERT_FILE = ""
+var TLS_KEY_FILE = ""
+
+// PEM file with the CAs client certificates must be signed by, set it
+// to make the TLS listener refuse clients without a valid certificate
+var TLS_CLIENT_CA_FILE = ""
+
+// how long a client has to finish the handshake
+var TLS_HANDSHAKE_TIMEOUT = 10 * time.Second
+
+// A certificate for local tests can be made with
+//
+//	openssl req -x509 -newkey rsa:2048 -nodes -days 365 -subj /CN=localhost \
+//		-addext subjectAltName=DNS:localhost,IP:127.0.0.1 -keyout key.pem -out cert.pem
+//
+// and given to clients as their CA.
+func loadTLSConfig() (*tls.Config, error) {
+	if TLS_CERT_FILE == "" || TLS_KEY_FILE == "" {
+		return nil, errors.New("-tls-listen needs -tls-cert and -tls-key")
+	}
+	certificate, err := tls.LoadX509KeyPair(TLS_CERT_FILE, TLS_KEY_FILE)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if TLS_CLIENT_CA_FILE != "" {
+		pem, err := os.ReadFile(TLS_CLIENT_CA_FILE)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + TLS_CLIENT_CA_FILE)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+func serveTLS(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Println("Error on TLS connection: ", err)
+			continue
+		}
+
+		go handleTLSConnection(conn.(*tls.Conn))
+	}
+}
+
+// handleTLSConnection finishes the handshake before the connection is
+// handled like any other, so a client that never completes it does not
+// hold a connection forever and a refused certificate gets logged
+func handleTLSConnection(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(TLS_HANDSHAKE_TIMEOUT))
+	err := conn.Handshake()
+	if err != nil {
+		fmt.Println("TLS handshake with", conn.RemoteAddr(), "failed: ", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	handleConnection(conn)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testAuthority is a CA that signs certificates for one test
+type testAuthority struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pem         []byte
+}
+
+func newTestAuthority(t *testing.T, name string) *testAuthority {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testAuthority{
+		certificate: certificate,
+		key:         key,
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue signs a certificate for 127.0.0.1 and gives it with its key as PEM
+func (ca *testAuthority) issue(t *testing.T, name string, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// clientCertificate is a certificate of ca a client can present
+func (ca *testAuthority) clientCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	certificate, err := tls.X509KeyPair(ca.issue(t, "client", x509.ExtKeyUsageClientAuth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate
+}
+
+func writeTestFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// startTLSTestServer serves TLS clients with a certificate of ca, which
+// also checks client certificates when clientCA is set
+func startTLSTestServer(t *testing.T, ca *testAuthority, clientCA *testAuthority) string {
+	t.Helper()
+	resetTestData(t)
+
+	certificate, key := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	files := []*string{&TLS_CERT_FILE, &TLS_KEY_FILE, &TLS_CLIENT_CA_FILE}
+	saved := []string{TLS_CERT_FILE, TLS_KEY_FILE, TLS_CLIENT_CA_FILE}
+	t.Cleanup(func() {
+		for i, file := range files {
+			*file = saved[i]
+		}
+	})
+	TLS_CERT_FILE = writeTestFile(t, "cert.pem", certificate)
+	TLS_KEY_FILE = writeTestFile(t, "key.pem", key)
+	TLS_CLIENT_CA_FILE = ""
+	if clientCA != nil {
+		TLS_CLIENT_CA_FILE = writeTestFile(t, "client-ca.pem", clientCA.pem)
+	}
+
+	config, err := loadTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go handleTLSConnection(conn.(*tls.Conn))
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// dialTLSTestClient finishes the handshake and sends PING, the error is
+// where either failed
+func dialTLSTestClient(t *testing.T, address string, config *tls.Config) (*testClient, error) {
+	t.Helper()
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		return nil, err
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	// with TLS 1.3 the server checks the client certificate after the
+	// client finished its side, a refusal shows up on the first read
+	client := &testClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+	if _, err := client.call("PING"); err != nil {
+		return nil, err
+	}
+	return client, nil
+}
+
+func TestTLSHandshake(t *testing.T) {
+	ca := newTestAuthority(t, "test CA")
+	address := startTLSTestServer(t, ca, nil)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+	client, err := dialTLSTestClient(t, address, &tls.Config{RootCAs: roots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.expect("OK", "SELECT", "secured")
+	client.expect("OK", "HSET", "table", "key", "value")
+	client.expect("value", "HGET", "table", "key")
+
+	// the server is only trusted through its CA
+	if _, err := dialTLSTestClient(t, address, &tls.Config{}); err == nil {
+		t.Fatal("a client without the CA accepted the server")
+	}
+	if _, err := dialTLSTestClient(t, address, &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS11}); err == nil {
+		t.Fatal("the server accepted TLS 1.1")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestAuthority(t, "test CA")
+	address := startTLSTestServer(t, ca, ca)
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(ca.pem)
+
+	if _, err := dialTLSTestClient(t, address, &tls.Config{RootCAs: roots}); err == nil {
+		t.Fatal("a client without a certificate got in")
+	}
+
+	// sent even though the server asks for certificates of its CA only
+	stranger := newTestAuthority(t, "other CA").clientCertificate(t)
+	strangerConfig := &tls.Config{
+		RootCAs: roots,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &stranger, nil
+		},
+	}
+	if _, err := dialTLSTestClient(t, address, strangerConfig); err == nil {
+		t.Fatal("a client with a certificate of another CA got in")
+	}
+
+	client, err := dialTLSTestClient(t, address, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{ca.clientCertificate(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.expect("PONG", "PING")
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+)
+
+// A transaction queues commands between MULTI and EXEC and runs them
+// while db.mutex is held exclusively, so nothing else can run in between.
+// WATCH makes EXEC give up when a structure or a hash field it read
+// before MULTI was written by somebody else meanwhile.
+type transaction struct {
+	active bool
+	// a command was rejected while queuing, EXEC refuses to run
+	failed bool
+	queued []queuedCommand
+
+	watched []watchedKey
+	// set by writers holding the lock of the watched database
+	dirty int32
+}
+
+type queuedCommand struct {
+	database string
+	args     []string
+}
+
+type watchedKey struct {
+	base  *DatabaseStruct
+	name  string
+	field string
+	// a key that expires does not get written, so its presence is
+	// compared at EXEC as well
+	existed bool
+}
+
+// commands that control the transaction itself and are never queued
+var transactionCommands = map[string]bool{
+	"MULTI":   true,
+	"EXEC":    true,
+	"DISCARD": true,
+	"WATCH":   true,
+	"UNWATCH": true,
+}
+
+// commandField is the hash field a write changes, empty when it changes
+// the structure as a whole
+func commandField(action string, args []string) string {
+	switch action {
+	case "HSET", "HDEL":
+		return args[2]
+	case "EXPIRE", "PEXPIREAT":
+		if len(args) > 3 {
+			return args[2]
+		}
+	case "PERSIST":
+		if len(args) > 2 {
+			return args[2]
+		}
+	}
+	return ""
+}
+
+// touch marks the transactions watching name or one of its fields,
+// caller must hold the database exclusively
+func (base *DatabaseStruct) touch(name string, field string) {
+	fields := base.watchers[name]
+	if fields == nil {
+		return
+	}
+
+	for watchedField, transactions := range fields {
+		if field != "" && watchedField != "" && watchedField != field {
+			continue
+		}
+		for tx := range transactions {
+			atomic.StoreInt32(&tx.dirty, 1)
+		}
+	}
+}
+
+// present tells whether the watched structure or field is there
+func (base *DatabaseStruct) present(name string, field string, now int64) bool {
+	if base.nameExpired(name, now) {
+		return false
+	}
+	if field == "" {
+		return base.exists(name)
+	}
+	table := findHashTable(base, name)
+	if table == nil {
+		return false
+	}
+	_, err := table.Get(field)
+	return err == nil
+}
+
+// watch registers the transaction, caller must hold db.mutex
+func (tx *transaction) watch(base *DatabaseStruct, name string, field string) {
+	base.mutex.Lock()
+	defer base.mutex.Unlock()
+
+	if base.watchers == nil {
+		base.watchers = map[string]map[string]map[*transaction]bool{}
+	}
+	if base.watchers[name] == nil {
+		base.watchers[name] = map[string]map[*transaction]bool{}
+	}
+	if base.watchers[name][field] == nil {
+		base.watchers[name][field] = map[*transaction]bool{}
+	}
+	base.watchers[name][field][tx] = true
+
+	tx.watched = append(tx.watched, watchedKey{
+		base:    base,
+		name:    name,
+		field:   field,
+		existed: base.present(name, field, nowMillis()),
+	})
+}
+
+// unwatch forgets every watched key, caller must hold db.mutex
+func (tx *transaction) unwatch() {
+	for _, key := range tx.watched {
+		key.base.mutex.Lock()
+		fields := key.base.watchers[key.name]
+		delete(fields[key.field], tx)
+		if len(fields[key.field]) == 0 {
+			delete(fields, key.field)
+		}
+		if len(fields) == 0 {
+			delete(key.base.watchers, key.name)
+		}
+		key.base.mutex.Unlock()
+	}
+
+	tx.watched = nil
+	atomic.StoreInt32(&tx.dirty, 0)
+}
+
+// changed needs db.mutex held exclusively
+func (tx *transaction) changed() bool {
+	if atomic.LoadInt32(&tx.dirty) != 0 {
+		return true
+	}
+
+	now := nowMillis()
+	for _, key := range tx.watched {
+		if key.base.present(key.name, key.field, now) != key.existed {
+			return true
+		}
+	}
+	return false
+}
+
+func (tx *transaction) reset() {
+	tx.active = false
+	tx.failed = false
+	tx.queued = nil
+}
+
+// close releases the watches of a connection that went away
+func (tx *transaction) close() {
+	if len(tx.watched) == 0 {
+		return
+	}
+	db.mutex.RLock()
+	tx.unwatch()
+	db.mutex.RUnlock()
+}
+
+// control runs MULTI, DISCARD, WATCH and UNWATCH for a connection, EXEC
+// goes through exec because its reply depends on the protocol
+func (tx *transaction) control(out reply, databaseName string, action string, args []string) {
+	switch action {
+	case "MULTI":
+		if tx.active {
+			writeError(out, codeError, "MULTI calls can not be nested")
+			return
+		}
+		tx.active = true
+		out.status("OK")
+	case "DISCARD":
+		if !tx.active {
+			writeError(out, codeError, "DISCARD without MULTI")
+			return
+		}
+		tx.reset()
+		tx.close()
+		out.status("OK")
+	case "WATCH":
+		if tx.active {
+			writeError(out, codeError, "WATCH inside MULTI is not allowed")
+			return
+		}
+		if len(args) < 2 || len(args) > 3 {
+			writeCommandError(out, wrongArguments(args[0]))
+			return
+		}
+		field := ""
+		if len(args) == 3 {
+			field = args[2]
+		}
+
+		db.mutex.RLock()
+		base := db.findDatabase(databaseName)
+		for base == nil {
+			db.mutex.RUnlock()
+			db.createDatabase(databaseName)
+			db.mutex.RLock()
+			base = db.findDatabase(databaseName)
+		}
+		tx.watch(base, args[1], field)
+		db.mutex.RUnlock()
+		out.status("OK")
+	case "UNWATCH":
+		tx.close()
+		out.status("OK")
+	}
+}
+
+// queue adds a command after MULTI, a command that could never run makes
+// the whole transaction fail
+func (tx *transaction) queue(out reply, databaseName string, args []string) {
+	err := checkCommand(args, fromClient)
+	if err == nil {
+		action := strings.ToUpper(args[0])
+		if commandArity[action] == 0 && !serverCommands[action] {
+			err = &commandError{codeSyntax, "unknown command '" + args[0] + "'"}
+		}
+	}
+	if err != nil {
+		tx.failed = true
+		writeCommandError(out, err)
+		return
+	}
+
+	tx.queued = append(tx.queued, queuedCommand{database: databaseName, args: args})
+	out.status("QUEUED")
+}
+
+// exec runs the queued commands and returns the reply of each one, or
+// nil when a watched key changed and nothing was run
+func (tx *transaction) exec() ([]*replyBuffer, *commandError) {
+	defer tx.close()
+	defer tx.reset()
+
+	if !tx.active {
+		return nil, &commandError{codeError, "EXEC without MULTI"}
+	}
+	if tx.failed {
+		return nil, &commandError{codeExecAbort, "Transaction discarded because of previous errors."}
+	}
+
+	db.mutex.Lock()
+
+	if tx.changed() {
+		db.mutex.Unlock()
+		return nil, nil
+	}
+
+	replies := make([]*replyBuffer, 0, len(tx.queued))
+	recorded := false
+	for _, command := range tx.queued {
+		buffer := &replyBuffer{}
+		err := checkCommand(command.args, fromClient)
+		action := strings.ToUpper(command.args[0])
+
+		if err != nil {
+			writeCommandError(buffer, err)
+		} else if memoryCommands[action] && !freeMemory() {
+			writeError(buffer, codeOOM, oomReply)
+		} else if serverCommands[action] {
+			executeServerCommand(buffer, action, command.args)
+		} else if databaseCommands[action] {
+			recorded = executeDatabaseCommand(buffer, action, command.args, fromClient) || recorded
+		} else {
+			base := db.findDatabase(command.database)
+			if base == nil {
+				// db.mutex is already held exclusively
+				base = &DatabaseStruct{Name: command.database}
+				db.databasesList = append(db.databasesList, base)
+			}
+			if blockingCommands[action] {
+				recorded = base.popNow(buffer, command.args, fromClient) || recorded
+			} else if base.runCommand(buffer, action, command.args, fromClient) {
+				recorded = true
+			}
+		}
+		replies = append(replies, buffer)
+	}
+
+	db.mutex.Unlock()
+
+	if recorded {
+		rewriteIfNeeded()
+	}
+
+	return replies, nil
+}
+
+// writeExec is EXEC for legacy connections, the replies of the queued
+// commands follow each other
+func (tx *transaction) writeExec(out io.Writer) {
+	replies, err := tx.exec()
+	if err != nil {
+		writeLegacyError(out, err.code, err.message)
+		return
+	}
+	if replies == nil {
+		writeLegacyError(out, codeError, "Transaction aborted, a watched key changed")
+		return
+	}
+	for _, reply := range replies {
+		reply.writeLegacy(out)
+	}
+}
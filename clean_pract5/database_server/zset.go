@@ -0,0 +1,574 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// A sorted set keeps its members ordered by score, members with the same
+// score by name. The skip list answers rank and range queries, the map
+// next to it finds the score of a member.
+type SortedSet struct {
+	Name   string
+	list   *skipList
+	scores map[string]float64
+	// bytes of the members, see memory.go
+	memory int64
+}
+
+// levels a skip list node can have, enough for 4^32 members
+const skipListMaxLevel = 32
+
+// chance that a node goes up one more level
+const skipListP = 0.25
+
+type skipListLevel struct {
+	forward *skipListNode
+	// members passed by following forward, for ranks
+	span int
+}
+
+type skipListNode struct {
+	member   string
+	score    float64
+	backward *skipListNode
+	levels   []skipListLevel
+}
+
+type skipList struct {
+	header *skipListNode
+	tail   *skipListNode
+	length int
+	level  int
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		header: &skipListNode{levels: make([]skipListLevel, skipListMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomLevel() int {
+	level := 1
+	for level < skipListMaxLevel && rand.Float64() < skipListP {
+		level++
+	}
+	return level
+}
+
+// before tells whether node sorts before the given score and member
+func (node *skipListNode) before(score float64, member string) bool {
+	return node.score < score || (node.score == score && node.member < member)
+}
+
+// insert expects the member not to be in the list yet
+func (list *skipList) insert(score float64, member string) {
+	update := make([]*skipListNode, skipListMaxLevel)
+	rank := make([]int, skipListMaxLevel)
+
+	x := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		if i < list.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.levels[i].forward != nil && x.levels[i].forward.before(score, member) {
+			rank[i] += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomLevel()
+	if level > list.level {
+		for i := list.level; i < level; i++ {
+			rank[i] = 0
+			update[i] = list.header
+			update[i].levels[i].span = list.length
+		}
+		list.level = level
+	}
+
+	node := &skipListNode{member: member, score: score, levels: make([]skipListLevel, level)}
+	for i := 0; i < level; i++ {
+		node.levels[i].forward = update[i].levels[i].forward
+		update[i].levels[i].forward = node
+		node.levels[i].span = update[i].levels[i].span - (rank[0] - rank[i])
+		update[i].levels[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < list.level; i++ {
+		update[i].levels[i].span++
+	}
+
+	if update[0] != list.header {
+		node.backward = update[0]
+	}
+	if node.levels[0].forward != nil {
+		node.levels[0].forward.backward = node
+	} else {
+		list.tail = node
+	}
+	list.length++
+}
+
+func (list *skipList) delete(score float64, member string) bool {
+	update := make([]*skipListNode, skipListMaxLevel)
+
+	x := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && x.levels[i].forward.before(score, member) {
+			x = x.levels[i].forward
+		}
+		update[i] = x
+	}
+
+	x = x.levels[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < list.level; i++ {
+		if update[i].levels[i].forward == x {
+			update[i].levels[i].span += x.levels[i].span - 1
+			update[i].levels[i].forward = x.levels[i].forward
+		} else {
+			update[i].levels[i].span--
+		}
+	}
+	if x.levels[0].forward != nil {
+		x.levels[0].forward.backward = x.backward
+	} else {
+		list.tail = x.backward
+	}
+	for list.level > 1 && list.header.levels[list.level-1].forward == nil {
+		list.level--
+	}
+	list.length--
+	return true
+}
+
+// rank of a member starting at 1, 0 when it is not there
+func (list *skipList) rank(score float64, member string) int {
+	rank := 0
+	x := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && !(score < x.levels[i].forward.score ||
+			(score == x.levels[i].forward.score && member < x.levels[i].forward.member)) {
+			rank += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if x != list.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// byRank finds the node at a rank starting at 1
+func (list *skipList) byRank(rank int) *skipListNode {
+	traversed := 0
+	x := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && traversed+x.levels[i].span <= rank {
+			traversed += x.levels[i].span
+			x = x.levels[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// scoreRange is min and max of ZRANGEBYSCORE, "(" makes a bound exclusive
+type scoreRange struct {
+	min, max                   float64
+	minExclusive, maxExclusive bool
+}
+
+func (r scoreRange) aboveMin(score float64) bool {
+	if r.minExclusive {
+		return score > r.min
+	}
+	return score >= r.min
+}
+
+func (r scoreRange) belowMax(score float64) bool {
+	if r.maxExclusive {
+		return score < r.max
+	}
+	return score <= r.max
+}
+
+func (list *skipList) firstInRange(r scoreRange) *skipListNode {
+	x := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && !r.aboveMin(x.levels[i].forward.score) {
+			x = x.levels[i].forward
+		}
+	}
+	x = x.levels[0].forward
+	if x == nil || !r.belowMax(x.score) {
+		return nil
+	}
+	return x
+}
+
+func (list *skipList) lastInRange(r scoreRange) *skipListNode {
+	x := list.header
+	for i := list.level - 1; i >= 0; i-- {
+		for x.levels[i].forward != nil && r.belowMax(x.levels[i].forward.score) {
+			x = x.levels[i].forward
+		}
+	}
+	if x == list.header || !r.aboveMin(x.score) {
+		return nil
+	}
+	return x
+}
+
+func NewSortedSet(name string) *SortedSet {
+	trackMemory(structureSize(name))
+	return &SortedSet{Name: name, list: newSkipList(), scores: map[string]float64{}}
+}
+
+// Add sets the score of a member and tells whether the member is new
+func (zset *SortedSet) Add(member string, score float64) bool {
+	old, found := zset.scores[member]
+	if found {
+		if old == score {
+			return false
+		}
+		zset.list.delete(old, member)
+	}
+	zset.list.insert(score, member)
+	zset.scores[member] = score
+	if !found {
+		addMemory(&zset.memory, sortedSetMemberSize(member))
+	}
+	return !found
+}
+
+func (zset *SortedSet) Remove(member string) bool {
+	score, found := zset.scores[member]
+	if !found {
+		return false
+	}
+	zset.list.delete(score, member)
+	delete(zset.scores, member)
+	addMemory(&zset.memory, -sortedSetMemberSize(member))
+	return true
+}
+
+func (zset *SortedSet) Score(member string) (float64, bool) {
+	score, found := zset.scores[member]
+	return score, found
+}
+
+// Rank starts at 0, reverse counts from the highest score
+func (zset *SortedSet) Rank(member string, reverse bool) (int, bool) {
+	score, found := zset.scores[member]
+	if !found {
+		return 0, false
+	}
+	rank := zset.list.rank(score, member)
+	if reverse {
+		return zset.list.length - rank, true
+	}
+	return rank - 1, true
+}
+
+func (zset *SortedSet) Len() int {
+	return zset.list.length
+}
+
+// entries lists the members from the lowest score up
+func (zset *SortedSet) entries() []*skipListNode {
+	result := []*skipListNode{}
+	for node := zset.list.header.levels[0].forward; node != nil; node = node.levels[0].forward {
+		result = append(result, node)
+	}
+	return result
+}
+
+func formatScore(score float64) string {
+	if math.IsInf(score, 1) {
+		return "inf"
+	}
+	if math.IsInf(score, -1) {
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+func parseScore(value string) (float64, error) {
+	score, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errors.New("Invalid score")
+	}
+	return score, nil
+}
+
+// parseScoreBound reads a ZRANGEBYSCORE bound like 5, (5, -inf or +inf
+func parseScoreBound(value string) (float64, bool, error) {
+	exclusive := strings.HasPrefix(value, "(")
+	score, err := parseScore(strings.TrimPrefix(value, "("))
+	return score, exclusive, err
+}
+
+func findSortedSet(base *DatabaseStruct, name string) *SortedSet {
+	for i := range base.SortedSets {
+		if base.SortedSets[i].Name == name {
+			return &base.SortedSets[i]
+		}
+	}
+	return nil
+}
+
+// sortedSetCommands are run by executeSortedSet
+var sortedSetCommands = map[string]bool{
+	"ZADD":             true,
+	"ZINCRBY":          true,
+	"ZSCORE":           true,
+	"ZRANK":            true,
+	"ZREVRANK":         true,
+	"ZRANGE":           true,
+	"ZREVRANGE":        true,
+	"ZRANGEBYSCORE":    true,
+	"ZREVRANGEBYSCORE": true,
+	"ZREM":             true,
+	"ZCARD":            true,
+}
+
+// writeRange replies the members, each followed by its score when asked
+// WITHSCORES. It follows the list backwards when reverse is set.
+func writeRange(out reply, node *skipListNode, reverse bool, offset int, count int, scores bool, r *scoreRange) {
+	items := []string{}
+	for ; node != nil && offset > 0; offset-- {
+		node = nextNode(node, reverse)
+	}
+	for ; node != nil && count != 0; count-- {
+		if r != nil && !(r.aboveMin(node.score) && r.belowMax(node.score)) {
+			break
+		}
+		items = append(items, node.member)
+		if scores {
+			items = append(items, formatScore(node.score))
+		}
+		node = nextNode(node, reverse)
+	}
+	out.array(items)
+}
+
+func nextNode(node *skipListNode, reverse bool) *skipListNode {
+	if reverse {
+		return node.backward
+	}
+	return node.levels[0].forward
+}
+
+// executeSortedSet runs the Z commands. A sorted set that does not exist
+// reads as an empty one.
+func executeSortedSet(out reply, base *DatabaseStruct, action string, args []string) {
+	zset := findSortedSet(base, args[1])
+
+	switch action {
+	case "ZADD":
+		if len(args)%2 != 0 {
+			writeCommandError(out, wrongArguments(args[0]))
+			return
+		}
+		scores := []float64{}
+		for i := 2; i < len(args); i += 2 {
+			score, err := parseScore(args[i])
+			if err != nil {
+				writeError(out, codeSyntax, err.Error())
+				return
+			}
+			scores = append(scores, score)
+		}
+		if zset == nil {
+			base.SortedSets = append(base.SortedSets, *NewSortedSet(args[1]))
+			zset = &base.SortedSets[len(base.SortedSets)-1]
+		}
+		added := 0
+		for i, score := range scores {
+			if zset.Add(args[3+2*i], score) {
+				added++
+			}
+		}
+		out.integer(int64(added))
+	case "ZINCRBY":
+		increment, err := parseScore(args[2])
+		if err != nil {
+			writeError(out, codeSyntax, err.Error())
+			return
+		}
+		if zset == nil {
+			base.SortedSets = append(base.SortedSets, *NewSortedSet(args[1]))
+			zset = &base.SortedSets[len(base.SortedSets)-1]
+		}
+		score, _ := zset.Score(args[3])
+		score += increment
+		if math.IsNaN(score) {
+			writeError(out, codeError, "Resulting score is not a number")
+			return
+		}
+		zset.Add(args[3], score)
+		out.bulk(formatScore(score))
+	case "ZSCORE":
+		if zset == nil {
+			writeError(out, codeNoSuchKey, "Member not found")
+			return
+		}
+		score, found := zset.Score(args[2])
+		if !found {
+			writeError(out, codeNoSuchKey, "Member not found")
+			return
+		}
+		out.bulk(formatScore(score))
+	case "ZRANK", "ZREVRANK":
+		if zset == nil {
+			writeError(out, codeNoSuchKey, "Member not found")
+			return
+		}
+		rank, found := zset.Rank(args[2], action == "ZREVRANK")
+		if !found {
+			writeError(out, codeNoSuchKey, "Member not found")
+			return
+		}
+		out.integer(int64(rank))
+	case "ZREM":
+		removed := 0
+		if zset != nil {
+			for _, member := range args[2:] {
+				if zset.Remove(member) {
+					removed++
+				}
+			}
+		}
+		out.integer(int64(removed))
+	case "ZCARD":
+		count := 0
+		if zset != nil {
+			count = zset.Len()
+		}
+		out.integer(int64(count))
+	case "ZRANGE", "ZREVRANGE":
+		executeRankRange(out, zset, action == "ZREVRANGE", args)
+	case "ZRANGEBYSCORE", "ZREVRANGEBYSCORE":
+		executeScoreRange(out, zset, action == "ZREVRANGEBYSCORE", args)
+	}
+}
+
+// executeRankRange is ZRANGE and ZREVRANGE name start stop [WITHSCORES],
+// negative ranks count from the end
+func executeRankRange(out reply, zset *SortedSet, reverse bool, args []string) {
+	start, err := strconv.Atoi(args[2])
+	if err != nil {
+		writeError(out, codeSyntax, "Invalid range")
+		return
+	}
+	stop, err := strconv.Atoi(args[3])
+	if err != nil {
+		writeError(out, codeSyntax, "Invalid range")
+		return
+	}
+	scores := false
+	for _, option := range args[4:] {
+		if strings.ToUpper(option) != "WITHSCORES" {
+			writeError(out, codeSyntax, "Syntax error")
+			return
+		}
+		scores = true
+	}
+	if zset == nil {
+		out.array([]string{})
+		return
+	}
+
+	length := zset.Len()
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= length {
+		stop = length - 1
+	}
+	if start > stop || start >= length {
+		out.array([]string{})
+		return
+	}
+
+	// ranks of the skip list start at 1 from the lowest score
+	first := zset.list.byRank(start + 1)
+	if reverse {
+		first = zset.list.byRank(length - start)
+	}
+	writeRange(out, first, reverse, 0, stop-start+1, scores, nil)
+}
+
+// executeScoreRange is ZRANGEBYSCORE name min max and ZREVRANGEBYSCORE
+// name max min, both with [WITHSCORES] [LIMIT offset count]
+func executeScoreRange(out reply, zset *SortedSet, reverse bool, args []string) {
+	low, high := args[2], args[3]
+	if reverse {
+		low, high = high, low
+	}
+	r := scoreRange{}
+	var err error
+	r.min, r.minExclusive, err = parseScoreBound(low)
+	if err != nil {
+		writeError(out, codeSyntax, "Invalid score range")
+		return
+	}
+	r.max, r.maxExclusive, err = parseScoreBound(high)
+	if err != nil {
+		writeError(out, codeSyntax, "Invalid score range")
+		return
+	}
+
+	scores := false
+	offset, count := 0, -1
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "WITHSCORES":
+			scores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				writeError(out, codeSyntax, "Syntax error")
+				return
+			}
+			offset, err = strconv.Atoi(args[i+1])
+			if err == nil {
+				count, err = strconv.Atoi(args[i+2])
+			}
+			if err != nil || offset < 0 {
+				writeError(out, codeSyntax, "Syntax error")
+				return
+			}
+			i += 2
+		default:
+			writeError(out, codeSyntax, "Syntax error")
+			return
+		}
+	}
+	if zset == nil {
+		out.array([]string{})
+		return
+	}
+
+	first := zset.list.firstInRange(r)
+	if reverse {
+		first = zset.list.lastInRange(r)
+	}
+	writeRange(out, first, reverse, offset, count, scores, &r)
+}
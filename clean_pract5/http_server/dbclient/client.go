@@ -0,0 +1,178 @@
+// Package dbclient talks to database_server over RESP. A Client keeps a
+// pool of connections, logs them in, selects the database of each call
+// and retries what can be retried safely, so callers do not deal with the
+// wire format at all:
+//
+//	client := dbclient.New(dbclient.Options{Address: "database_server:6379", Database: "siteDB"})
+//	defer client.Close()
+//
+//	link, err := client.HGet(ctx, "linksHashtable", code)
+//	if errors.Is(err, dbclient.ErrNil) {
+//		// no such code
+//	}
+//
+// Every call takes a context, its deadline or cancellation ends the call
+// and closes the connection it was using. Error replies of the database
+// are *Error values with the code of the reply.
+package dbclient
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"time"
+)
+
+type Options struct {
+	// host:port of the server, localhost:6379 when empty
+	Address string
+	// dial with TLS using this configuration, ServerName defaults to the
+	// host of Address
+	TLSConfig *tls.Config
+
+	// login for a server started with a users file
+	User     string
+	Password string
+
+	// database the commands of the client work on, see Client.Database
+	Database string
+
+	// connections handed out at a time, 10 when zero
+	PoolSize int
+	// returned connections kept for later, PoolSize when zero
+	MaxIdle int
+	// idle connections older than this are closed instead of used, 5
+	// minutes when zero
+	IdleTimeout time.Duration
+	// idle connections older than this are pinged before they are used,
+	// 30 seconds when zero
+	HealthCheckAfter time.Duration
+
+	// for connecting and logging in, 5 seconds when zero
+	DialTimeout time.Duration
+	// for one call whose context has no deadline, 5 seconds when zero.
+	// Blocking pops get their own timeout on top.
+	CommandTimeout time.Duration
+
+	// how often a call that failed on the network is tried again, 2 when
+	// zero and never when negative. Commands that may change data are
+	// only retried when they did not reach the server, or when a pooled
+	// connection was closed before any reply came. A server that dies
+	// while it runs the command looks the same, so it may run twice then.
+	MaxRetries int
+	// pause before the first retry, it grows with every retry. 100
+	// milliseconds when zero.
+	RetryBackoff time.Duration
+}
+
+func (options *Options) setDefaults() {
+	if options.Address == "" {
+		options.Address = "localhost:6379"
+	}
+	if options.PoolSize <= 0 {
+		options.PoolSize = 10
+	}
+	if options.MaxIdle <= 0 {
+		options.MaxIdle = options.PoolSize
+	}
+	if options.IdleTimeout == 0 {
+		options.IdleTimeout = 5 * time.Minute
+	}
+	if options.HealthCheckAfter == 0 {
+		options.HealthCheckAfter = 30 * time.Second
+	}
+	if options.DialTimeout == 0 {
+		options.DialTimeout = 5 * time.Second
+	}
+	if options.CommandTimeout == 0 {
+		options.CommandTimeout = 5 * time.Second
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = 2
+	}
+	if options.RetryBackoff == 0 {
+		options.RetryBackoff = 100 * time.Millisecond
+	}
+}
+
+// Client is safe for use by many goroutines at once
+type Client struct {
+	commands
+	options  *Options
+	pool     *pool
+	database string
+}
+
+// New makes a client, connections are made when calls need them
+func New(options Options) *Client {
+	options.setDefaults()
+	client := &Client{options: &options, pool: newPool(&options), database: options.Database}
+	client.commands = commands{do: client.do}
+	return client
+}
+
+// Database gives a client for another database that shares the
+// connections of c
+func (c *Client) Database(name string) *Client {
+	client := &Client{options: c.options, pool: c.pool, database: name}
+	client.commands = commands{do: client.do}
+	return client
+}
+
+// Close closes the connections, calls already running finish first
+func (c *Client) Close() error {
+	return c.pool.close()
+}
+
+// Do runs any command, the typed methods are built on it
+func (c *Client) Do(ctx context.Context, args ...string) (Reply, error) {
+	return c.do(ctx, 0, args)
+}
+
+// commands that never change data, they are retried even when they may
+// have reached the server
+var readOnlyCommands = map[string]bool{
+	"PING": true, "ECHO": true,
+	"HGET": true, "SISMEMBER": true, "SMEMBERS": true, "SCARD": true,
+	"SUNION": true, "SINTER": true, "SDIFF": true, "SRANDMEMBER": true,
+	"ZSCORE": true, "ZRANK": true, "ZREVRANK": true, "ZRANGE": true, "ZREVRANGE": true,
+	"ZRANGEBYSCORE": true, "ZREVRANGEBYSCORE": true, "ZCARD": true,
+	"SCAN": true, "HSCAN": true, "SSCAN": true, "ZSCAN": true,
+	"EXISTS": true, "TYPE": true, "KEYS": true, "TTL": true,
+	"DBLIST": true, "DUMP": true, "INFO": true, "LASTSAVE": true,
+}
+
+// do runs one command. block is how long a blocking command may wait on
+// the server, -1 for as long as ctx allows.
+func (c *Client) do(ctx context.Context, block time.Duration, args []string) (Reply, error) {
+	timeout := c.options.CommandTimeout + block
+	if block < 0 {
+		timeout = -1
+	}
+	retryable := readOnlyCommands[strings.ToUpper(args[0])]
+
+	for attempt := 0; ; attempt++ {
+		cn, err := c.pool.get(ctx)
+		sent := false
+		var replies []Reply
+		if err == nil {
+			replies, sent, err = cn.do(ctx, timeout, c.database, [][]string{args})
+			c.pool.put(cn)
+		}
+		if err == nil {
+			if replies[0].Err != nil {
+				return Reply{}, replies[0].Err
+			}
+			return replies[0], nil
+		}
+
+		if attempt >= c.options.MaxRetries || err == ErrClosed || !isNetworkError(err) || (sent && !retryable) {
+			return Reply{}, err
+		}
+		select {
+		case <-time.After(time.Duration(attempt+1) * c.options.RetryBackoff):
+		case <-ctx.Done():
+			return Reply{}, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package dbclient
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// hangUp as the reply of a fakeServer closes the connection instead
+const hangUp = "hang up"
+
+// fakeServer reads commands like database_server and answers them with
+// what reply gives, until the test ends
+type fakeServer struct {
+	listener net.Listener
+	reply    func(command []string) string
+
+	mutex    sync.Mutex
+	received []string
+	conns    []net.Conn
+}
+
+func newFakeServer(t *testing.T, reply func(command []string) string) *fakeServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeServer{listener: listener, reply: reply}
+	t.Cleanup(func() {
+		listener.Close()
+		server.hangUpAll()
+	})
+
+	go func() {
+		for {
+			netConn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.mutex.Lock()
+			server.conns = append(server.conns, netConn)
+			server.mutex.Unlock()
+			go server.serve(netConn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeServer) serve(netConn net.Conn) {
+	defer netConn.Close()
+	reader := bufio.NewReader(netConn)
+	for {
+		// a command is an array of bulks, the client reads replies alike
+		command, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, item := range command.Items {
+			args = append(args, item.Value)
+		}
+
+		server.mutex.Lock()
+		server.received = append(server.received, strings.Join(args, " "))
+		server.mutex.Unlock()
+
+		reply := server.reply(args)
+		if reply == hangUp {
+			return
+		}
+		netConn.Write([]byte(reply))
+	}
+}
+
+func (server *fakeServer) address() string {
+	return server.listener.Addr().String()
+}
+
+// accepted counts the connections the client made
+func (server *fakeServer) accepted() int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return len(server.conns)
+}
+
+// count tells how often the server got a command starting with prefix
+func (server *fakeServer) count(prefix string) int {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	count := 0
+	for _, command := range server.received {
+		if strings.HasPrefix(command, prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+// hangUpAll closes every connection, like a restarted server
+func (server *fakeServer) hangUpAll() {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	for _, netConn := range server.conns {
+		netConn.Close()
+	}
+}
+
+// okServer answers PONG to PING and OK to the rest
+func okServer(command []string) string {
+	if strings.ToUpper(command[0]) == "PING" {
+		return "+PONG\r\n"
+	}
+	return "+OK\r\n"
+}
+
+func TestPoolReuse(t *testing.T) {
+	server := newFakeServer(t, okServer)
+	client := New(Options{Address: server.address(), PoolSize: 2})
+	defer client.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if err := client.HSet(ctx, "table", "key", "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if server.accepted() != 1 {
+		t.Fatalf("10 calls one after another made %d connections", server.accepted())
+	}
+
+	// a client for another database shares the pool and selects once
+	other := client.Database("other")
+	for i := 0; i < 3; i++ {
+		if err := other.Ping(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if server.accepted() != 1 || server.count("SELECT other") != 1 {
+		t.Fatalf("%d connections and %d SELECT", server.accepted(), server.count("SELECT other"))
+	}
+}
+
+func TestPoolExhaustion(t *testing.T) {
+	release := make(chan struct{})
+	server := newFakeServer(t, func(command []string) string {
+		if command[0] == "BQPOP" {
+			<-release
+			return "*2\r\n$5\r\nqueue\r\n$4\r\nitem\r\n"
+		}
+		return okServer(command)
+	})
+	client := New(Options{Address: server.address(), PoolSize: 2})
+	defer client.Close()
+
+	// two calls hold both connections
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, _, err := client.BQPop(context.Background(), time.Second, "queue")
+			results <- err
+		}()
+	}
+	for start := time.Now(); server.count("BQPOP") < 2; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("the blocking calls did not arrive")
+		}
+	}
+
+	// a third one waits for a connection until its context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Ping(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Ping on a full pool gave %v", err)
+	}
+	if server.accepted() != 2 || server.count("PING") != 0 {
+		t.Fatalf("the full pool made %d connections", server.accepted())
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if server.accepted() != 2 {
+		t.Fatalf("%d connections after the pool was freed", server.accepted())
+	}
+}
+
+func TestHealthCheckDropsDeadConnection(t *testing.T) {
+	server := newFakeServer(t, okServer)
+	// every connection that waited at all is pinged first
+	client := New(Options{Address: server.address(), HealthCheckAfter: time.Nanosecond})
+	defer client.Close()
+
+	ctx := context.Background()
+	if err := client.HSet(ctx, "table", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if err := client.HSet(ctx, "table", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if server.accepted() != 1 || server.count("PING") != 1 {
+		t.Fatalf("a healthy connection: %d connections, %d PING", server.accepted(), server.count("PING"))
+	}
+
+	server.hangUpAll()
+	time.Sleep(time.Millisecond)
+	if err := client.HSet(ctx, "table", "key", "other"); err != nil {
+		t.Fatal(err)
+	}
+	// the HSET never went to the dead connection, a new one took it
+	if server.accepted() != 2 || server.count("HSET") != 3 {
+		t.Fatalf("after a failed health check: %d connections, %d HSET", server.accepted(), server.count("HSET"))
+	}
+}
+
+func TestContextTimeout(t *testing.T) {
+	stuck := make(chan struct{})
+	defer close(stuck)
+	server := newFakeServer(t, func(command []string) string {
+		if command[0] == "HGET" {
+			<-stuck
+		}
+		return okServer(command)
+	})
+	client := New(Options{Address: server.address()})
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.HGet(ctx, "table", "key")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("HGet on a server that does not answer gave %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the timeout fired after %v", elapsed)
+	}
+	// an ended context is not retried
+	if server.count("HGET") != 1 {
+		t.Fatalf("HGET was sent %d times", server.count("HGET"))
+	}
+
+	// the reply may still come, the connection is not used again
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if server.accepted() != 2 {
+		t.Fatalf("%d connections after a timeout", server.accepted())
+	}
+
+	// cancelling works the same way
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := client.HGet(ctx, "table", "key"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("a cancelled HGet gave %v", err)
+	}
+}
+
+func TestRetryOnlyIdempotent(t *testing.T) {
+	// every command is lost the first time, the server hangs up on it
+	var mutex sync.Mutex
+	seen := map[string]bool{}
+	server := newFakeServer(t, func(command []string) string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		if !seen[command[0]] {
+			seen[command[0]] = true
+			return hangUp
+		}
+		if command[0] == "HGET" {
+			return "$5\r\nvalue\r\n"
+		}
+		if command[0] == "DBLIST" {
+			return "-ERR failing\r\n"
+		}
+		return okServer(command)
+	})
+	client := New(Options{Address: server.address(), RetryBackoff: time.Millisecond})
+	defer client.Close()
+	ctx := context.Background()
+
+	// a read is tried again
+	value, err := client.HGet(ctx, "table", "key")
+	if err != nil || value != "value" {
+		t.Fatalf("HGet = %q, %v", value, err)
+	}
+	if server.count("HGET") != 2 {
+		t.Fatalf("HGET was sent %d times", server.count("HGET"))
+	}
+
+	// a write that may have run is not. A connection of the pool closed
+	// before the reply looks like a server that restarted meanwhile, that
+	// write gets tried again, so this one goes on a new connection.
+	client = New(Options{Address: server.address(), RetryBackoff: time.Millisecond})
+	defer client.Close()
+	if err := client.QPush(ctx, "queue", "item"); err == nil {
+		t.Fatal("a QPUSH the server hung up on succeeded")
+	}
+	if server.count("QPUSH") != 1 {
+		t.Fatalf("QPUSH was sent %d times", server.count("QPUSH"))
+	}
+
+	// neither is an error reply
+	if _, err := client.DBList(ctx); err == nil {
+		t.Fatal("DBLIST succeeded")
+	}
+	if _, err := client.DBList(ctx); ErrorCode(err) != CodeError {
+		t.Fatalf("DBLIST gave %v", err)
+	}
+	if server.count("DBLIST") != 3 {
+		t.Fatalf("DBLIST was sent %d times", server.count("DBLIST"))
+	}
+}
+
+func TestRetryWriteOnStaleConnection(t *testing.T) {
+	server := newFakeServer(t, okServer)
+	client := New(Options{Address: server.address(), RetryBackoff: time.Millisecond})
+	defer client.Close()
+	ctx := context.Background()
+
+	if err := client.HSet(ctx, "table", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	// a restart closes the idle connection, the write never reached the
+	// server so it goes out again on a new one
+	server.hangUpAll()
+	time.Sleep(10 * time.Millisecond)
+	if err := client.HSet(ctx, "table", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	if server.accepted() != 2 || server.count("HSET") != 2 {
+		t.Fatalf("%d connections, HSET sent %d times", server.accepted(), server.count("HSET"))
+	}
+}
+
+func TestReplyTypes(t *testing.T) {
+	replies := map[string]string{
+		"STATUS":  "+OK\r\n",
+		"INTEGER": ":42\r\n",
+		"FLOAT":   "$4\r\n1.25\r\n",
+		"BULK":    "$12\r\nhello\r\nworld\r\n",
+		"EMPTY":   "$0\r\n\r\n",
+		"NULL":    "$-1\r\n",
+		"NULLS":   "*-1\r\n",
+		"ARRAY":   "*3\r\n$1\r\na\r\n:2\r\n+c\r\n",
+		"NESTED":  "*2\r\n$1\r\n0\r\n*2\r\n$1\r\nx\r\n$-1\r\n",
+		"ERROR":   "-WRONGTYPE Operation against a name holding the wrong kind of structure\r\n",
+		"BARE":    "-failure\r\n",
+
+		// for the typed methods
+		"HGET":      "$-1\r\n",
+		"SMEMBERS":  "*3\r\n$1\r\na\r\n:2\r\n+c\r\n",
+		"SISMEMBER": ":0\r\n",
+	}
+	server := newFakeServer(t, func(command []string) string {
+		return replies[command[0]]
+	})
+	client := New(Options{Address: server.address()})
+	defer client.Close()
+	ctx := context.Background()
+
+	do := func(command string) Reply {
+		t.Helper()
+		reply, err := client.Do(ctx, command)
+		if err != nil {
+			t.Fatalf("%s: %v", command, err)
+		}
+		return reply
+	}
+
+	if text, err := do("STATUS").Text(); text != "OK" || err != nil {
+		t.Fatalf("status = %q, %v", text, err)
+	}
+	if number, err := do("INTEGER").Int(); number != 42 || err != nil {
+		t.Fatalf("integer = %d, %v", number, err)
+	}
+	if flag, err := do("INTEGER").Bool(); !flag || err != nil {
+		t.Fatalf("integer as bool = %v, %v", flag, err)
+	}
+	if number, err := do("FLOAT").Float(); number != 1.25 || err != nil {
+		t.Fatalf("float = %v, %v", number, err)
+	}
+	if text, err := do("BULK").Text(); text != "hello\r\nworld" || err != nil {
+		t.Fatalf("bulk = %q, %v", text, err)
+	}
+	if text, err := do("EMPTY").Text(); text != "" || err != nil {
+		t.Fatalf("empty bulk = %q, %v", text, err)
+	}
+	if _, err := do("NULL").Text(); err != ErrNil {
+		t.Fatalf("null bulk gave %v", err)
+	}
+	if _, err := do("NULLS").List(); err != ErrNil {
+		t.Fatalf("null array gave %v", err)
+	}
+
+	items, err := do("ARRAY").List()
+	if err != nil || strings.Join(items, ",") != "a,2,c" {
+		t.Fatalf("array = %q, %v", items, err)
+	}
+	nested := do("NESTED")
+	if len(nested.Items) != 2 || nested.Items[0].Value != "0" || len(nested.Items[1].Items) != 2 || !nested.Items[1].Items[1].Null {
+		t.Fatalf("nested array = %+v", nested)
+	}
+	if _, err := nested.Items[1].List(); err != ErrNil {
+		t.Fatalf("a null inside a list gave %v", err)
+	}
+
+	_, err = client.Do(ctx, "ERROR")
+	var replyErr *Error
+	if !errors.As(err, &replyErr) || replyErr.Code != CodeWrongType || !strings.HasPrefix(replyErr.Message, "Operation") {
+		t.Fatalf("error reply gave %#v", err)
+	}
+	if _, err := client.Do(ctx, "BARE"); ErrorCode(err) != "failure" {
+		t.Fatalf("error reply without a message gave %#v", err)
+	}
+
+	// the typed methods read the same replies
+	if _, err := client.HGet(ctx, "table", "missing"); !errors.Is(err, ErrNil) {
+		t.Fatalf("HGet of a missing key gave %v", err)
+	}
+	if members, err := client.SMembers(ctx, "set"); err != nil || len(members) != 3 {
+		t.Fatalf("SMembers = %q, %v", members, err)
+	}
+	if member, err := client.SIsMember(ctx, "set", "x"); member || err != nil {
+		t.Fatalf("SIsMember = %v, %v", member, err)
+	}
+}
@@ -0,0 +1,644 @@
+package dbclient
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commands holds the typed methods, Client and Tx run them their own way
+type commands struct {
+	do func(ctx context.Context, block time.Duration, args []string) (Reply, error)
+}
+
+func (c commands) status(ctx context.Context, args ...string) error {
+	_, err := c.do(ctx, 0, args)
+	return err
+}
+
+func (c commands) text(ctx context.Context, args ...string) (string, error) {
+	reply, err := c.do(ctx, 0, args)
+	if err != nil {
+		return "", err
+	}
+	return reply.Text()
+}
+
+func (c commands) integer(ctx context.Context, args ...string) (int64, error) {
+	reply, err := c.do(ctx, 0, args)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Int()
+}
+
+func (c commands) boolean(ctx context.Context, args ...string) (bool, error) {
+	reply, err := c.do(ctx, 0, args)
+	if err != nil {
+		return false, err
+	}
+	return reply.Bool()
+}
+
+func (c commands) float(ctx context.Context, args ...string) (float64, error) {
+	reply, err := c.do(ctx, 0, args)
+	if err != nil {
+		return 0, err
+	}
+	return reply.Float()
+}
+
+func (c commands) list(ctx context.Context, args ...string) ([]string, error) {
+	reply, err := c.do(ctx, 0, args)
+	if err != nil {
+		return nil, err
+	}
+	return reply.List()
+}
+
+// pair reads the two item replies of blocking pops and reservations
+func (c commands) pair(ctx context.Context, block time.Duration, args ...string) (string, string, error) {
+	reply, err := c.do(ctx, block, args)
+	if err != nil {
+		return "", "", err
+	}
+	values, err := reply.List()
+	if err != nil {
+		return "", "", err
+	}
+	if len(values) != 2 {
+		return "", "", &Error{Code: CodeError, Message: "expected two items, got " + strconv.Itoa(len(values))}
+	}
+	return values[0], values[1], nil
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// seconds rounds a duration up to whole seconds, the unit of the server
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+func formatUnixTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', 3, 64)
+}
+
+func (c commands) Ping(ctx context.Context) error {
+	return c.status(ctx, "PING")
+}
+
+func (c commands) Echo(ctx context.Context, message string) (string, error) {
+	return c.text(ctx, "ECHO", message)
+}
+
+// stacks
+
+func (c commands) SPush(ctx context.Context, name string, value string) error {
+	return c.status(ctx, "SPUSH", name, value)
+}
+
+// SPop takes the top of a stack, or a random member when name only holds
+// a set. It gives ErrNil when there is nothing to take.
+func (c commands) SPop(ctx context.Context, name string) (string, error) {
+	return c.text(ctx, "SPOP", name)
+}
+
+// SPopN removes up to count random members of a set
+func (c commands) SPopN(ctx context.Context, name string, count int) ([]string, error) {
+	return c.list(ctx, "SPOP", name, strconv.Itoa(count))
+}
+
+// BSPop waits up to timeout, forever when it is 0, for one of the stacks
+// to have an item and gives the name of the stack with it. ErrNil means it
+// timed out.
+func (c commands) BSPop(ctx context.Context, timeout time.Duration, names ...string) (string, string, error) {
+	return c.blockingPop(ctx, "BSPOP", timeout, names)
+}
+
+func (c commands) blockingPop(ctx context.Context, action string, timeout time.Duration, names []string) (string, string, error) {
+	args := append([]string{action}, names...)
+	args = append(args, strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64))
+	block := timeout
+	if timeout == 0 {
+		block = -1
+	}
+	return c.pair(ctx, block, args...)
+}
+
+// queues
+
+func (c commands) QPush(ctx context.Context, name string, value string) error {
+	return c.status(ctx, "QPUSH", name, value)
+}
+
+type QPushOptions struct {
+	// the item becomes visible this much later
+	Delay time.Duration
+	// deliveries before the item goes to the dead letter queue, the
+	// server default when zero
+	Attempts int
+}
+
+func (c commands) QPushWith(ctx context.Context, name string, value string, options QPushOptions) error {
+	args := []string{"QPUSH", name, value}
+	if options.Delay > 0 {
+		args = append(args, "DELAY", strconv.FormatFloat(options.Delay.Seconds(), 'f', 3, 64))
+	}
+	if options.Attempts > 0 {
+		args = append(args, "ATTEMPTS", strconv.Itoa(options.Attempts))
+	}
+	return c.status(ctx, args...)
+}
+
+// QPushAt makes the item visible at a point in time
+func (c commands) QPushAt(ctx context.Context, name string, value string, at time.Time, attempts int) error {
+	args := []string{"QPUSHAT", name, value, formatUnixTime(at)}
+	if attempts > 0 {
+		args = append(args, "ATTEMPTS", strconv.Itoa(attempts))
+	}
+	return c.status(ctx, args...)
+}
+
+// QPop gives ErrNil for an empty or missing queue
+func (c commands) QPop(ctx context.Context, name string) (string, error) {
+	return c.text(ctx, "QPOP", name)
+}
+
+// BQPop is BSPop for queues
+func (c commands) BQPop(ctx context.Context, timeout time.Duration, names ...string) (string, string, error) {
+	return c.blockingPop(ctx, "BQPOP", timeout, names)
+}
+
+// QReserve takes the head of the queue for lease, it goes back to the
+// queue unless QAck confirms it in time. It gives the id of the
+// reservation with the item, ErrNil when there is nothing to take.
+func (c commands) QReserve(ctx context.Context, name string, lease time.Duration) (string, string, error) {
+	return c.pair(ctx, 0, "QRESERVE", name, seconds(lease))
+}
+
+// QReserveAt is QReserve with the id and the end of the lease chosen by
+// the caller
+func (c commands) QReserveAt(ctx context.Context, name string, id string, deadline time.Time) (string, error) {
+	_, value, err := c.pair(ctx, 0, "QRESERVEAT", name, id, strconv.FormatInt(deadline.UnixMilli(), 10))
+	return value, err
+}
+
+// QAck tells whether the reservation was still in flight
+func (c commands) QAck(ctx context.Context, name string, id string) (bool, error) {
+	return c.boolean(ctx, "QACK", name, id)
+}
+
+// QRequeue gives a reservation back to the queue before its lease ends
+func (c commands) QRequeue(ctx context.Context, name string, id string) (bool, error) {
+	return c.boolean(ctx, "QREQUEUE", name, id)
+}
+
+// QDead moves a reservation to the dead letter queue
+func (c commands) QDead(ctx context.Context, name string, id string) (bool, error) {
+	return c.boolean(ctx, "QDEAD", name, id)
+}
+
+// QPromote makes the delayed items due up to upto visible and gives how
+// many there were
+func (c commands) QPromote(ctx context.Context, name string, upto time.Time) (int64, error) {
+	return c.integer(ctx, "QPROMOTE", name, strconv.FormatInt(upto.UnixMilli(), 10))
+}
+
+// hash tables
+
+func (c commands) HSet(ctx context.Context, table string, key string, value string) error {
+	return c.status(ctx, "HSET", table, key, value)
+}
+
+// HSetEX sets a key that expires after ttl
+func (c commands) HSetEX(ctx context.Context, table string, key string, value string, ttl time.Duration) error {
+	return c.status(ctx, "HSET", table, key, value, "EX", seconds(ttl))
+}
+
+// HGet gives ErrNil for a missing key
+func (c commands) HGet(ctx context.Context, table string, key string) (string, error) {
+	return c.text(ctx, "HGET", table, key)
+}
+
+// HDel tells whether the key was there
+func (c commands) HDel(ctx context.Context, table string, key string) (bool, error) {
+	return c.boolean(ctx, "HDEL", table, key)
+}
+
+// sets
+
+func (c commands) SAdd(ctx context.Context, name string, member string) error {
+	return c.status(ctx, "SADD", name, member)
+}
+
+// SRem tells whether the member was there
+func (c commands) SRem(ctx context.Context, name string, member string) (bool, error) {
+	return c.boolean(ctx, "SREM", name, member)
+}
+
+func (c commands) SIsMember(ctx context.Context, name string, member string) (bool, error) {
+	return c.boolean(ctx, "SISMEMBER", name, member)
+}
+
+func (c commands) SMembers(ctx context.Context, name string) ([]string, error) {
+	return c.list(ctx, "SMEMBERS", name)
+}
+
+func (c commands) SCard(ctx context.Context, name string) (int64, error) {
+	return c.integer(ctx, "SCARD", name)
+}
+
+func (c commands) SUnion(ctx context.Context, names ...string) ([]string, error) {
+	return c.list(ctx, append([]string{"SUNION"}, names...)...)
+}
+
+func (c commands) SInter(ctx context.Context, names ...string) ([]string, error) {
+	return c.list(ctx, append([]string{"SINTER"}, names...)...)
+}
+
+func (c commands) SDiff(ctx context.Context, names ...string) ([]string, error) {
+	return c.list(ctx, append([]string{"SDIFF"}, names...)...)
+}
+
+// SUnionStore stores the union in destination and gives its size
+func (c commands) SUnionStore(ctx context.Context, destination string, names ...string) (int64, error) {
+	return c.integer(ctx, append([]string{"SUNIONSTORE", destination}, names...)...)
+}
+
+func (c commands) SInterStore(ctx context.Context, destination string, names ...string) (int64, error) {
+	return c.integer(ctx, append([]string{"SINTERSTORE", destination}, names...)...)
+}
+
+func (c commands) SDiffStore(ctx context.Context, destination string, names ...string) (int64, error) {
+	return c.integer(ctx, append([]string{"SDIFFSTORE", destination}, names...)...)
+}
+
+// SRandMember gives ErrNil for an empty set
+func (c commands) SRandMember(ctx context.Context, name string) (string, error) {
+	return c.text(ctx, "SRANDMEMBER", name)
+}
+
+// SRandMemberN gives count distinct members, or -count members that may
+// repeat when count is negative
+func (c commands) SRandMemberN(ctx context.Context, name string, count int) ([]string, error) {
+	return c.list(ctx, "SRANDMEMBER", name, strconv.Itoa(count))
+}
+
+// sorted sets
+
+// Z is a member of a sorted set with its score
+type Z struct {
+	Member string
+	Score  float64
+}
+
+// ZAdd adds or updates members and gives how many were new
+func (c commands) ZAdd(ctx context.Context, name string, members ...Z) (int64, error) {
+	args := []string{"ZADD", name}
+	for _, member := range members {
+		args = append(args, formatFloat(member.Score), member.Member)
+	}
+	return c.integer(ctx, args...)
+}
+
+// ZIncrBy gives the new score
+func (c commands) ZIncrBy(ctx context.Context, name string, increment float64, member string) (float64, error) {
+	return c.float(ctx, "ZINCRBY", name, formatFloat(increment), member)
+}
+
+// ZScore gives ErrNil for a member that is not there
+func (c commands) ZScore(ctx context.Context, name string, member string) (float64, error) {
+	return c.float(ctx, "ZSCORE", name, member)
+}
+
+// ZRank gives the rank from the lowest score, ErrNil for a member that is
+// not there
+func (c commands) ZRank(ctx context.Context, name string, member string) (int64, error) {
+	return c.integer(ctx, "ZRANK", name, member)
+}
+
+func (c commands) ZRevRank(ctx context.Context, name string, member string) (int64, error) {
+	return c.integer(ctx, "ZREVRANK", name, member)
+}
+
+// ZRange gives the members ranked start to stop, negative ranks count
+// from the end
+func (c commands) ZRange(ctx context.Context, name string, start int64, stop int64) ([]string, error) {
+	return c.list(ctx, "ZRANGE", name, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10))
+}
+
+func (c commands) ZRangeWithScores(ctx context.Context, name string, start int64, stop int64) ([]Z, error) {
+	return c.scored(ctx, "ZRANGE", name, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10), "WITHSCORES")
+}
+
+func (c commands) ZRevRange(ctx context.Context, name string, start int64, stop int64) ([]string, error) {
+	return c.list(ctx, "ZREVRANGE", name, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10))
+}
+
+func (c commands) ZRevRangeWithScores(ctx context.Context, name string, start int64, stop int64) ([]Z, error) {
+	return c.scored(ctx, "ZREVRANGE", name, strconv.FormatInt(start, 10), strconv.FormatInt(stop, 10), "WITHSCORES")
+}
+
+// ZRangeBy is a score range. Min and Max are scores, "-inf" or "+inf",
+// a "(" in front excludes the bound. A Count of zero means no limit.
+type ZRangeBy struct {
+	Min    string
+	Max    string
+	Offset int64
+	Count  int64
+}
+
+func (by ZRangeBy) args(action string, name string, reverse bool, scores bool) []string {
+	args := []string{action, name, by.Min, by.Max}
+	if reverse {
+		args = []string{action, name, by.Max, by.Min}
+	}
+	if scores {
+		args = append(args, "WITHSCORES")
+	}
+	if by.Offset != 0 || by.Count != 0 {
+		count := by.Count
+		if count == 0 {
+			count = -1
+		}
+		args = append(args, "LIMIT", strconv.FormatInt(by.Offset, 10), strconv.FormatInt(count, 10))
+	}
+	return args
+}
+
+func (c commands) ZRangeByScore(ctx context.Context, name string, by ZRangeBy) ([]string, error) {
+	return c.list(ctx, by.args("ZRANGEBYSCORE", name, false, false)...)
+}
+
+func (c commands) ZRangeByScoreWithScores(ctx context.Context, name string, by ZRangeBy) ([]Z, error) {
+	return c.scored(ctx, by.args("ZRANGEBYSCORE", name, false, true)...)
+}
+
+// ZRevRangeByScore goes from Max down to Min
+func (c commands) ZRevRangeByScore(ctx context.Context, name string, by ZRangeBy) ([]string, error) {
+	return c.list(ctx, by.args("ZREVRANGEBYSCORE", name, true, false)...)
+}
+
+func (c commands) ZRevRangeByScoreWithScores(ctx context.Context, name string, by ZRangeBy) ([]Z, error) {
+	return c.scored(ctx, by.args("ZREVRANGEBYSCORE", name, true, true)...)
+}
+
+func (c commands) scored(ctx context.Context, args ...string) ([]Z, error) {
+	values, err := c.list(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return pairScores(values)
+}
+
+func pairScores(values []string) ([]Z, error) {
+	members := make([]Z, 0, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		score, err := strconv.ParseFloat(values[i+1], 64)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, Z{Member: values[i], Score: score})
+	}
+	return members, nil
+}
+
+// ZRem gives how many of the members were there
+func (c commands) ZRem(ctx context.Context, name string, members ...string) (int64, error) {
+	return c.integer(ctx, append([]string{"ZREM", name}, members...)...)
+}
+
+func (c commands) ZCard(ctx context.Context, name string) (int64, error) {
+	return c.integer(ctx, "ZCARD", name)
+}
+
+// expiration
+
+// TTL results for names without a deadline and names that do not exist
+const (
+	TTLNone    time.Duration = -1
+	TTLMissing time.Duration = -2
+)
+
+// Expire tells whether the name exists to get the deadline
+func (c commands) Expire(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	return c.boolean(ctx, "EXPIRE", name, seconds(ttl))
+}
+
+// HExpire sets the deadline of one key of a hash table
+func (c commands) HExpire(ctx context.Context, table string, key string, ttl time.Duration) (bool, error) {
+	return c.boolean(ctx, "EXPIRE", table, key, seconds(ttl))
+}
+
+func (c commands) ExpireAt(ctx context.Context, name string, at time.Time) (bool, error) {
+	return c.boolean(ctx, "PEXPIREAT", name, strconv.FormatInt(at.UnixMilli(), 10))
+}
+
+func (c commands) HExpireAt(ctx context.Context, table string, key string, at time.Time) (bool, error) {
+	return c.boolean(ctx, "PEXPIREAT", table, key, strconv.FormatInt(at.UnixMilli(), 10))
+}
+
+// Persist tells whether there was a deadline to remove
+func (c commands) Persist(ctx context.Context, name string) (bool, error) {
+	return c.boolean(ctx, "PERSIST", name)
+}
+
+func (c commands) HPersist(ctx context.Context, table string, key string) (bool, error) {
+	return c.boolean(ctx, "PERSIST", table, key)
+}
+
+// TTL gives the time left in whole seconds, TTLNone or TTLMissing
+func (c commands) TTL(ctx context.Context, name string) (time.Duration, error) {
+	return c.ttl(ctx, "TTL", name)
+}
+
+func (c commands) HTTL(ctx context.Context, table string, key string) (time.Duration, error) {
+	return c.ttl(ctx, "TTL", table, key)
+}
+
+func (c commands) ttl(ctx context.Context, args ...string) (time.Duration, error) {
+	ttl, err := c.integer(ctx, args...)
+	if err != nil || ttl < 0 {
+		return time.Duration(ttl), err
+	}
+	return time.Duration(ttl) * time.Second, nil
+}
+
+// iteration
+
+// ScanOptions narrows what a scan call gives, Type only works for Scan
+type ScanOptions struct {
+	Match string
+	Count int
+	Type  string
+}
+
+func (options ScanOptions) args(args []string) []string {
+	if options.Match != "" {
+		args = append(args, "MATCH", options.Match)
+	}
+	if options.Count > 0 {
+		args = append(args, "COUNT", strconv.Itoa(options.Count))
+	}
+	if options.Type != "" {
+		args = append(args, "TYPE", options.Type)
+	}
+	return args
+}
+
+func (c commands) scan(ctx context.Context, args ...string) (uint64, []string, error) {
+	reply, err := c.do(ctx, 0, args)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(reply.Items) != 2 {
+		return 0, nil, &Error{Code: CodeError, Message: "malformed scan reply"}
+	}
+	cursor, err := reply.Items[0].Text()
+	if err != nil {
+		return 0, nil, err
+	}
+	next, err := strconv.ParseUint(cursor, 10, 64)
+	if err != nil {
+		return 0, nil, err
+	}
+	items, err := reply.Items[1].List()
+	return next, items, err
+}
+
+// Scan gives a page of names and the cursor of the next one, a scan
+// starts and ends with cursor 0
+func (c commands) Scan(ctx context.Context, cursor uint64, options ScanOptions) (uint64, []string, error) {
+	return c.scan(ctx, options.args([]string{"SCAN", strconv.FormatUint(cursor, 10)})...)
+}
+
+// HScan gives a page of keys with their values
+func (c commands) HScan(ctx context.Context, table string, cursor uint64, options ScanOptions) (uint64, map[string]string, error) {
+	next, items, err := c.scan(ctx, options.args([]string{"HSCAN", table, strconv.FormatUint(cursor, 10)})...)
+	if err != nil {
+		return 0, nil, err
+	}
+	values := make(map[string]string, len(items)/2)
+	for i := 0; i+1 < len(items); i += 2 {
+		values[items[i]] = items[i+1]
+	}
+	return next, values, nil
+}
+
+func (c commands) SScan(ctx context.Context, name string, cursor uint64, options ScanOptions) (uint64, []string, error) {
+	return c.scan(ctx, options.args([]string{"SSCAN", name, strconv.FormatUint(cursor, 10)})...)
+}
+
+func (c commands) ZScan(ctx context.Context, name string, cursor uint64, options ScanOptions) (uint64, []Z, error) {
+	next, items, err := c.scan(ctx, options.args([]string{"ZSCAN", name, strconv.FormatUint(cursor, 10)})...)
+	if err != nil {
+		return 0, nil, err
+	}
+	members, err := pairScores(items)
+	return next, members, err
+}
+
+// keyspace
+
+// Exists gives how many of the names are used
+func (c commands) Exists(ctx context.Context, names ...string) (int64, error) {
+	return c.integer(ctx, append([]string{"EXISTS"}, names...)...)
+}
+
+// Del removes every structure called like one of the names and gives how
+// many names were used
+func (c commands) Del(ctx context.Context, names ...string) (int64, error) {
+	return c.integer(ctx, append([]string{"DEL"}, names...)...)
+}
+
+// Type gives the kinds of structure that use name: hash, stack, queue, set
+// or zset. It is empty for a name nothing uses.
+func (c commands) Type(ctx context.Context, name string) ([]string, error) {
+	kinds, err := c.text(ctx, "TYPE", name)
+	if err != nil || kinds == "none" {
+		return nil, err
+	}
+	return strings.Fields(kinds), nil
+}
+
+func (c commands) Rename(ctx context.Context, from string, to string) error {
+	return c.status(ctx, "RENAME", from, to)
+}
+
+func (c commands) Keys(ctx context.Context, pattern string) ([]string, error) {
+	return c.list(ctx, "KEYS", pattern)
+}
+
+func (c commands) FlushDB(ctx context.Context) error {
+	return c.status(ctx, "FLUSHDB")
+}
+
+// databases and the server
+
+func (c commands) DBList(ctx context.Context) ([]string, error) {
+	return c.list(ctx, "DBLIST")
+}
+
+func (c commands) DBDrop(ctx context.Context, database string) error {
+	return c.status(ctx, "DBDROP", database)
+}
+
+func (c commands) DBRename(ctx context.Context, from string, to string) error {
+	return c.status(ctx, "DBRENAME", from, to)
+}
+
+// Dump gives the content of a database as "json" or "text", json when
+// format is empty
+func (c commands) Dump(ctx context.Context, database string, format string) (string, error) {
+	if format == "" {
+		return c.text(ctx, "DUMP", database)
+	}
+	return c.text(ctx, "DUMP", database, "FORMAT", format)
+}
+
+func (c commands) Save(ctx context.Context) error {
+	return c.status(ctx, "SAVE")
+}
+
+func (c commands) BGSave(ctx context.Context) error {
+	return c.status(ctx, "BGSAVE")
+}
+
+func (c commands) BGRewriteAOF(ctx context.Context) error {
+	return c.status(ctx, "BGREWRITEAOF")
+}
+
+func (c commands) LastSave(ctx context.Context) (time.Time, error) {
+	unix, err := c.integer(ctx, "LASTSAVE")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(unix, 0), nil
+}
+
+// Info gives a section of the server information, replication when
+// section is empty
+func (c commands) Info(ctx context.Context, section string) (string, error) {
+	if section == "" {
+		return c.text(ctx, "INFO")
+	}
+	return c.text(ctx, "INFO", section)
+}
+
+// ReplicaOf makes the server replicate host:port
+func (c commands) ReplicaOf(ctx context.Context, host string, port int) error {
+	return c.status(ctx, "REPLICAOF", host, strconv.Itoa(port))
+}
+
+// ReplicaOfNoOne makes a replica a primary again
+func (c commands) ReplicaOfNoOne(ctx context.Context) error {
+	return c.status(ctx, "REPLICAOF", "NO", "ONE")
+}
+
+// Publish gives how many subscribers got the message
+func (c commands) Publish(ctx context.Context, channel string, message string) (int64, error) {
+	return c.integer(ctx, "PUBLISH", channel, message)
+}
@@ -0,0 +1,181 @@
+package dbclient
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// conn is one connection to the database. It remembers the database it
+// selected so commands only send SELECT when they go somewhere else.
+type conn struct {
+	netConn net.Conn
+	reader  *bufio.Reader
+	writer  *bufio.Writer
+
+	database string
+	usedAt   time.Time
+	// taken from the idle connections of the pool
+	reused bool
+	// the server had closed it while it was idle
+	stale bool
+	// a connection that failed in the middle of a reply can not be used
+	// again, the next reply would belong to the old command
+	broken bool
+}
+
+// setting it wakes a read or write in progress
+var pastDeadline = time.Unix(1, 0)
+
+func dial(ctx context.Context, options *Options) (*conn, error) {
+	dialer := net.Dialer{Timeout: options.DialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", options.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.TLSConfig != nil {
+		config := options.TLSConfig
+		if config.ServerName == "" {
+			config = config.Clone()
+			config.ServerName, _, _ = net.SplitHostPort(options.Address)
+		}
+		tlsConn := tls.Client(netConn, config)
+		handshakeCtx, cancel := context.WithTimeout(ctx, options.DialTimeout)
+		err = tlsConn.HandshakeContext(handshakeCtx)
+		cancel()
+		if err != nil {
+			netConn.Close()
+			return nil, err
+		}
+		netConn = tlsConn
+	}
+
+	cn := &conn{
+		netConn: netConn,
+		reader:  bufio.NewReader(netConn),
+		writer:  bufio.NewWriter(netConn),
+		usedAt:  time.Now(),
+	}
+
+	if options.User != "" {
+		replies, _, err := cn.do(ctx, options.DialTimeout, "", [][]string{{"AUTH", options.User, options.Password}})
+		if err == nil {
+			err = replies[0].Err
+		}
+		if err != nil {
+			cn.close()
+			return nil, err
+		}
+	}
+
+	return cn, nil
+}
+
+// do sends commands in one write and reads their replies, switching to
+// database first unless it is empty. Without a deadline in ctx timeout
+// bounds the whole exchange, a negative timeout waits as long as ctx
+// lets it. sent tells whether any command may have reached the server,
+// an idle connection the server closed meanwhile ends before the first
+// reply and counts as not sent.
+func (cn *conn) do(ctx context.Context, timeout time.Duration, database string, commands [][]string) (replies []Reply, sent bool, err error) {
+	selecting := database != "" && database != cn.database
+	if selecting {
+		commands = append([][]string{{"SELECT", database}}, commands...)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok && timeout >= 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	cn.netConn.SetDeadline(deadline)
+
+	// an ended context moves the deadline to the past
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		cancelled := make(chan bool, 1)
+		go func() {
+			select {
+			case <-ctx.Done():
+				cn.netConn.SetDeadline(pastDeadline)
+				cancelled <- true
+			case <-stop:
+				cancelled <- false
+			}
+		}()
+		defer func() {
+			close(stop)
+			if <-cancelled {
+				cn.broken = true
+				if err != nil {
+					err = ctx.Err()
+				}
+			}
+		}()
+	}
+
+	cn.usedAt = time.Now()
+	defer func() {
+		if err != nil {
+			cn.broken = true
+		}
+	}()
+
+	for _, args := range commands {
+		writeCommand(cn.writer, args)
+	}
+	sent = true
+	err = cn.writer.Flush()
+	if err != nil {
+		if cn.reused && isClosedError(err) {
+			cn.stale = true
+			sent = false
+		}
+		return nil, sent, err
+	}
+
+	replies = make([]Reply, 0, len(commands))
+	for range commands {
+		reply, err := readReply(cn.reader)
+		if err != nil {
+			if cn.reused && len(replies) == 0 && isClosedError(err) {
+				cn.stale = true
+				sent = false
+			}
+			return nil, sent, err
+		}
+		replies = append(replies, reply)
+	}
+
+	if selecting {
+		if replies[0].Err != nil {
+			return nil, sent, replies[0].Err
+		}
+		cn.database = database
+		replies = replies[1:]
+	}
+	return replies, sent, nil
+}
+
+func (cn *conn) close() error {
+	return cn.netConn.Close()
+}
+
+func isClosedError(err error) bool {
+	return err == io.EOF || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// isNetworkError tells apart a failed connection from an error reply or
+// an ended context, only those can be retried
+func isNetworkError(err error) bool {
+	var replyErr *Error
+	if errors.As(err, &replyErr) {
+		return false
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
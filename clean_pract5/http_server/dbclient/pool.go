@@ -0,0 +1,130 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by every call after Close
+var ErrClosed = errors.New("dbclient: client is closed")
+
+// pool hands out at most PoolSize connections at a time and keeps up to
+// MaxIdle of the returned ones. The most recently used one goes out
+// first, so connections that stay idle grow old and get closed.
+type pool struct {
+	options *Options
+
+	// one token for every connection that is handed out
+	slots chan struct{}
+
+	mutex  sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+func newPool(options *Options) *pool {
+	return &pool{options: options, slots: make(chan struct{}, options.PoolSize)}
+}
+
+// get waits for a free slot and gives an idle connection that is still
+// healthy, or a new one
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	for {
+		cn, err := p.popIdle()
+		if err != nil {
+			<-p.slots
+			return nil, err
+		}
+		if cn == nil {
+			break
+		}
+		if p.healthy(ctx, cn) {
+			cn.reused = true
+			return cn, nil
+		}
+		cn.close()
+	}
+
+	cn, err := dial(ctx, p.options)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return cn, nil
+}
+
+func (p *pool) popIdle() (*conn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return nil, ErrClosed
+	}
+	if len(p.idle) == 0 {
+		return nil, nil
+	}
+	cn := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return cn, nil
+}
+
+// healthy drops connections idle for longer than IdleTimeout and pings
+// those idle for longer than HealthCheckAfter, the server or something
+// in between may have closed them meanwhile
+func (p *pool) healthy(ctx context.Context, cn *conn) bool {
+	idle := time.Since(cn.usedAt)
+	if p.options.IdleTimeout > 0 && idle > p.options.IdleTimeout {
+		return false
+	}
+	if idle <= p.options.HealthCheckAfter {
+		return true
+	}
+	replies, _, err := cn.do(ctx, p.options.DialTimeout, "", [][]string{{"PING"}})
+	return err == nil && replies[0].Err == nil
+}
+
+// put gives a connection back, a broken one is closed. A stale one means
+// the server most likely restarted, the other idle connections are closed
+// with it instead of failing one call each.
+func (p *pool) put(cn *conn) {
+	p.mutex.Lock()
+	if cn.stale {
+		for _, other := range p.idle {
+			other.close()
+		}
+		p.idle = nil
+	}
+	if cn.broken || p.closed || len(p.idle) >= p.options.MaxIdle {
+		cn.close()
+	} else {
+		p.idle = append(p.idle, cn)
+	}
+	p.mutex.Unlock()
+
+	<-p.slots
+}
+
+// close closes the idle connections, those handed out are closed when
+// they come back
+func (p *pool) close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+	p.closed = true
+	for _, cn := range p.idle {
+		cn.close()
+	}
+	p.idle = nil
+	return nil
+}
@@ -0,0 +1,177 @@
+package dbclient
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ErrNil is returned for a null reply: a missing hash key, an empty stack
+// or queue, a member that is not there or a blocking pop that timed out
+var ErrNil = errors.New("dbclient: nil reply")
+
+// error codes the database puts in front of the message of an error reply
+const (
+	CodeSyntax    = "SYNTAX"
+	CodeNoSuchKey = "NOSUCHKEY"
+	CodeEmpty     = "EMPTY"
+	CodeWrongType = "WRONGTYPE"
+	CodeNoAuth    = "NOAUTH"
+	CodeNoPerm    = "NOPERM"
+	CodeWrongPass = "WRONGPASS"
+	CodeReadOnly  = "READONLY"
+	CodeExecAbort = "EXECABORT"
+	CodeOOM       = "OOM"
+	CodeError     = "ERR"
+)
+
+// Error is an error reply of the database, it is never retried
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Code + " " + e.Message
+}
+
+// ErrorCode gives the code of an error reply, or "" when err did not come
+// from the database
+func ErrorCode(err error) string {
+	var replyErr *Error
+	if errors.As(err, &replyErr) {
+		return replyErr.Code
+	}
+	return ""
+}
+
+func parseError(line string) *Error {
+	code, message, _ := strings.Cut(line, " ")
+	return &Error{Code: code, Message: message}
+}
+
+// Reply is one reply of the database. Err is only set for the replies of
+// a transaction, elsewhere an error reply is the error of the call.
+type Reply struct {
+	Value string
+	Null  bool
+	Items []Reply
+	Err   error
+}
+
+// Text gives a string reply, ErrNil when it was null
+func (r Reply) Text() (string, error) {
+	if r.Err != nil {
+		return "", r.Err
+	}
+	if r.Null {
+		return "", ErrNil
+	}
+	return r.Value, nil
+}
+
+func (r Reply) Int() (int64, error) {
+	value, err := r.Text()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+func (r Reply) Float() (float64, error) {
+	value, err := r.Text()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(value, 64)
+}
+
+// Bool is true for an integer reply other than 0
+func (r Reply) Bool() (bool, error) {
+	value, err := r.Int()
+	return value != 0, err
+}
+
+// List gives the items of an array reply as strings
+func (r Reply) List() ([]string, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	if r.Null {
+		return nil, ErrNil
+	}
+	values := make([]string, 0, len(r.Items))
+	for _, item := range r.Items {
+		value, err := item.Text()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func writeCommand(writer *bufio.Writer, args []string) {
+	writer.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		writer.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		writer.WriteString(arg)
+		writer.WriteString("\r\n")
+	}
+}
+
+// readReply reads one reply, an error reply comes back in Reply.Err and
+// only a broken connection or stream is an error
+func readReply(reader *bufio.Reader) (Reply, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return Reply{}, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	if len(line) == 0 {
+		return Reply{}, errors.New("dbclient: empty reply line")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return Reply{Value: line[1:]}, nil
+	case '-':
+		return Reply{Err: parseError(line[1:])}, nil
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return Reply{}, errors.New("dbclient: invalid bulk length " + line)
+		}
+		if length < 0 {
+			return Reply{Null: true}, nil
+		}
+		data := make([]byte, length+2)
+		_, err = io.ReadFull(reader, data)
+		if err != nil {
+			return Reply{}, err
+		}
+		return Reply{Value: string(data[:length])}, nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return Reply{}, errors.New("dbclient: invalid array length " + line)
+		}
+		if count < 0 {
+			return Reply{Null: true}, nil
+		}
+		reply := Reply{Items: make([]Reply, 0, count)}
+		for i := 0; i < count; i++ {
+			item, err := readReply(reader)
+			if err != nil {
+				return Reply{}, err
+			}
+			reply.Items = append(reply.Items, item)
+		}
+		return reply, nil
+	}
+
+	return Reply{}, errors.New("dbclient: unexpected reply " + line)
+}
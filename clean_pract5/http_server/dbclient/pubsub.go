@@ -0,0 +1,118 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Message is something published on a channel the subscription listens
+// to. Pattern is the pattern that matched it, empty for a channel
+// subscribed by name.
+type Message struct {
+	Pattern string
+	Channel string
+	Payload string
+}
+
+// Subscription has a connection of its own outside the pool, it can only
+// receive until it is closed
+type Subscription struct {
+	cn        *conn
+	closeOnce sync.Once
+}
+
+// Subscribe listens to channels by name
+func (c *Client) Subscribe(ctx context.Context, channels ...string) (*Subscription, error) {
+	return c.subscribe(ctx, "SUBSCRIBE", channels)
+}
+
+// PSubscribe listens to every channel matching one of the patterns
+func (c *Client) PSubscribe(ctx context.Context, patterns ...string) (*Subscription, error) {
+	return c.subscribe(ctx, "PSUBSCRIBE", patterns)
+}
+
+func (c *Client) subscribe(ctx context.Context, action string, names []string) (*Subscription, error) {
+	if len(names) == 0 {
+		return nil, errors.New("dbclient: nothing to subscribe to")
+	}
+	cn, err := dial(ctx, c.options)
+	if err != nil {
+		return nil, err
+	}
+
+	// the server confirms every name with a reply of its own
+	replies, _, err := cn.do(ctx, c.options.CommandTimeout, "", [][]string{append([]string{action}, names...)})
+	for i := 1; err == nil && i < len(names); i++ {
+		var reply Reply
+		reply, err = readReply(cn.reader)
+		replies = append(replies, reply)
+	}
+	if err == nil {
+		for _, reply := range replies {
+			if reply.Err != nil {
+				err = reply.Err
+				break
+			}
+		}
+	}
+	if err != nil {
+		cn.close()
+		return nil, err
+	}
+	return &Subscription{cn: cn}, nil
+}
+
+// Receive waits for the next message as long as ctx allows. After an
+// error, an ended ctx included, the subscription has to be made again.
+func (s *Subscription) Receive(ctx context.Context) (Message, error) {
+	for {
+		reply, err := s.read(ctx)
+		if err != nil {
+			return Message{}, err
+		}
+		values, err := reply.List()
+		if err != nil {
+			return Message{}, err
+		}
+		switch {
+		case len(values) == 3 && values[0] == "message":
+			return Message{Channel: values[1], Payload: values[2]}, nil
+		case len(values) == 4 && values[0] == "pmessage":
+			return Message{Pattern: values[1], Channel: values[2], Payload: values[3]}, nil
+		}
+		// confirmations and pongs are not messages
+	}
+}
+
+func (s *Subscription) read(ctx context.Context) (Reply, error) {
+	deadline, _ := ctx.Deadline()
+	s.cn.netConn.SetReadDeadline(deadline)
+
+	if ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				s.cn.netConn.SetReadDeadline(pastDeadline)
+			case <-stop:
+			}
+		}()
+	}
+
+	reply, err := readReply(s.cn.reader)
+	if err != nil && ctx.Err() != nil {
+		return Reply{}, ctx.Err()
+	}
+	return reply, err
+}
+
+// Close ends the subscription with its connection
+func (s *Subscription) Close() error {
+	err := ErrClosed
+	s.closeOnce.Do(func() {
+		err = s.cn.close()
+	})
+	return err
+}
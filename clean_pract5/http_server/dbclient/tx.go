@@ -0,0 +1,108 @@
+package dbclient
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrTxAborted is returned by Exec when a watched name changed since WATCH
+var ErrTxAborted = errors.New("dbclient: transaction aborted, a watched name changed")
+
+// Tx keeps one connection for WATCH, the reads that decide what to do and
+// the MULTI ... EXEC that does it. The typed methods of a Tx run right
+// away, Queue collects what Exec runs atomically.
+type Tx struct {
+	commands
+	client *Client
+	cn     *conn
+	queued [][]string
+	// WATCH was sent and neither EXEC nor UNWATCH ended it
+	watching bool
+}
+
+// Tx runs fn with a connection of its own, fn returns the error of Exec
+// or its own. Watches left over when fn returns are dropped. Nothing is
+// retried, a transaction that failed on the network may have run.
+func (c *Client) Tx(ctx context.Context, fn func(tx *Tx) error) error {
+	cn, err := c.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	tx := &Tx{client: c, cn: cn}
+	tx.commands = commands{do: tx.do}
+
+	err = fn(tx)
+
+	if tx.watching && !cn.broken {
+		tx.do(ctx, 0, []string{"UNWATCH"})
+	}
+	c.pool.put(cn)
+	return err
+}
+
+func (tx *Tx) do(ctx context.Context, block time.Duration, args []string) (Reply, error) {
+	timeout := tx.client.options.CommandTimeout + block
+	if block < 0 {
+		timeout = -1
+	}
+	replies, _, err := tx.cn.do(ctx, timeout, tx.client.database, [][]string{args})
+	if err != nil {
+		return Reply{}, err
+	}
+	if replies[0].Err != nil {
+		return Reply{}, replies[0].Err
+	}
+	return replies[0], nil
+}
+
+// Watch makes Exec fail with ErrTxAborted when name changes before it,
+// with a key only a change of that key of the hash table counts
+func (tx *Tx) Watch(ctx context.Context, name string, key ...string) error {
+	args := append([]string{"WATCH", name}, key...)
+	_, err := tx.do(ctx, 0, args)
+	if err == nil {
+		tx.watching = true
+	}
+	return err
+}
+
+func (tx *Tx) Unwatch(ctx context.Context) error {
+	_, err := tx.do(ctx, 0, []string{"UNWATCH"})
+	if err == nil {
+		tx.watching = false
+	}
+	return err
+}
+
+// Queue adds a command for the next Exec
+func (tx *Tx) Queue(args ...string) {
+	tx.queued = append(tx.queued, args)
+}
+
+// Exec runs the queued commands atomically and gives their replies, an
+// error reply of one of them is in the Err of its Reply. A command the
+// server refused to queue fails the whole transaction with EXECABORT.
+func (tx *Tx) Exec(ctx context.Context) ([]Reply, error) {
+	commands := append([][]string{{"MULTI"}}, tx.queued...)
+	commands = append(commands, []string{"EXEC"})
+	tx.queued = nil
+
+	replies, _, err := tx.cn.do(ctx, tx.client.options.CommandTimeout, tx.client.database, commands)
+	if err != nil {
+		return nil, err
+	}
+	tx.watching = false
+
+	if replies[0].Err != nil {
+		return nil, replies[0].Err
+	}
+	result := replies[len(replies)-1]
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	if result.Null {
+		return nil, ErrTxAborted
+	}
+	return result.Items, nil
+}
@@ -1,7 +1,7 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,12 +9,34 @@ import (
 	"math/rand"
 	"net"
 	"net/http"
+	"os"
 	"strings"
 	"time"
+
+	"./dbclient"
 )
 
 var DATABASE_ADDRESS = "database_server:6379"
-var STATS_ADDRESS = "http://stats_server:6565"
+
+// login for a database server started with a users file, taken from the
+// environment
+var DATABASE_USER = ""
+var DATABASE_PASSWORD = ""
+
+// TLS connection to the database, taken from the environment. With
+// DATABASE_TLS_ADDRESS set the database is dialed there over TLS,
+// DATABASE_TLS_CA verifies its certificate instead of the system roots
+// and DATABASE_TLS_CERT with DATABASE_TLS_KEY is the client certificate
+// for a server that asks for one.
+var DATABASE_TLS_ADDRESS = ""
+var DATABASE_TLS_CA = ""
+var DATABASE_TLS_CERT = ""
+var DATABASE_TLS_KEY = ""
+
+var database *dbclient.Client
+
+// channel the click events are published on, stats_server subscribes to it
+var CLICKS_CHANNEL = "clicks"
 
 type connectionReport struct {
 	ShortUrl string `json:"shortURL"`
@@ -22,7 +44,7 @@ type connectionReport struct {
 	Host     string `json:"originHost"`
 }
 
-func sendStats(a string, b string, c string) {
+func sendStats(ctx context.Context, a string, b string, c string) {
 	some := connectionReport{
 		ShortUrl: a,
 		OutLink:  strings.Trim(b, "\u0000"),
@@ -33,17 +55,15 @@ func sendStats(a string, b string, c string) {
 
 	fmt.Println("gonna send:", string(jsonPost), err)
 
-	data := []byte(jsonPost)
-	r := bytes.NewReader(data)
-
-	_, err = http.Post(STATS_ADDRESS, "application/json", r)
+	_, err = database.Publish(ctx, CLICKS_CHANNEL, string(jsonPost))
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 }
 
-func generateShortLink(link string) (string, error) {
+// generateShortLink picks random codes until one can be claimed for link
+func generateShortLink(ctx context.Context, link string) (string, error) {
 	alphabet := "QWERTYUIOPASDFGHJKLZXCVBNM"
 	alphabet = alphabet + strings.ToLower(alphabet) + "1234567890"
 	shortLinkChars := ""
@@ -54,98 +74,105 @@ func generateShortLink(link string) (string, error) {
 			shortLinkChars += string(alphabet[rand.Intn(len(alphabet))])
 		}
 
-		_, err := baseFindLink(shortLinkChars)
-
-		fmt.Println("Err:", err.Error())
-		if err.Error() == "Link does not exist" {
+		err := baseAddLink(ctx, shortLinkChars, link)
+		if err == nil {
 			break
 		}
 
+		fmt.Println("Err:", err.Error())
+		if err.Error() != "Link already taken" {
+			return "", err
+		}
 	}
 	fmt.Println("exiting generate with", shortLinkChars)
 	return shortLinkChars, nil
 }
 
-func baseFindLink(shortLink string) (string, error) {
+func baseFindLink(ctx context.Context, shortLink string) (string, error) {
 	fmt.Println("baseFindLink(", shortLink, ")")
-	con, err := net.Dial("tcp", DATABASE_ADDRESS)
-
-	if err != nil {
-		return "", errors.New("Database Unreachable")
-	}
-
-	defer con.Close()
 
-	msg := "--file siteDB --query \"HGET linksHashtable " + shortLink + "\""
+	link, err := database.HGet(ctx, "linksHashtable", shortLink)
 
-	_, err = con.Write([]byte(msg))
-
-	if err != nil {
-		return "", err
-	}
-
-	reply := make([]byte, 512)
-
-	_, err = con.Read(reply)
-
-	if err != nil {
-		return "", err
-	}
-
-	cleanReply := strings.TrimSpace(string(reply))
-	cleanReply = strings.ReplaceAll(cleanReply, "\n", "")
-	// fmt.Println(":::::", []byte(cleanReply), ":::::")
-	if cleanReply[0:13] == "Key not found" {
+	if errors.Is(err, dbclient.ErrNil) {
 		return "", errors.New("Link does not exist")
-	} else {
-		return cleanReply, nil
 	}
+	return link, err
 }
 
-func baseAddLink(shortLink string, longLink string) error {
+// baseAddLink claims shortLink in one transaction: the code is watched
+// before it is checked, so when another request takes it in between EXEC
+// aborts and "Link already taken" comes back
+func baseAddLink(ctx context.Context, shortLink string, longLink string) error {
 	fmt.Println("baseAddLink(", shortLink, ",", longLink, ")")
-	con, err := net.Dial("tcp", DATABASE_ADDRESS)
-
-	if err != nil {
-		return errors.New("Database Unreachable")
-	}
 
-	defer con.Close()
-
-	msg := "--file siteDB --query \"HSET linksHashtable " + shortLink + " " + longLink + "\""
+	err := database.Tx(ctx, func(tx *dbclient.Tx) error {
+		err := tx.Watch(ctx, "linksHashtable", shortLink)
+		if err != nil {
+			return err
+		}
 
-	_, err = con.Write([]byte(msg))
+		_, err = tx.HGet(ctx, "linksHashtable", shortLink)
+		if err == nil {
+			return errors.New("Link already taken")
+		}
+		if !errors.Is(err, dbclient.ErrNil) {
+			return err
+		}
 
-	if err != nil {
+		tx.Queue("HSET", "linksHashtable", shortLink, longLink)
+		_, err = tx.Exec(ctx)
 		return err
-	}
+	})
 
-	return nil
+	if errors.Is(err, dbclient.ErrTxAborted) {
+		return errors.New("Link already taken")
+	}
+	return err
 }
 
-func initializeBase() error {
-	con, err := net.Dial("tcp", DATABASE_ADDRESS)
+// databaseOptions is how the database is dialed, over TLS when
+// DATABASE_TLS_ADDRESS is set
+func databaseOptions() (dbclient.Options, error) {
+	options := dbclient.Options{
+		Address:  DATABASE_ADDRESS,
+		User:     DATABASE_USER,
+		Password: DATABASE_PASSWORD,
+		Database: "siteDB",
+	}
 
-	if err != nil {
-		return err
+	if DATABASE_TLS_ADDRESS != "" {
+		config, err := dbclient.LoadTLS(DATABASE_TLS_CA, DATABASE_TLS_CERT, DATABASE_TLS_KEY)
+		if err != nil {
+			return options, err
+		}
+		options.Address = DATABASE_TLS_ADDRESS
+		options.TLSConfig = config
 	}
+	return options, nil
+}
 
-	defer con.Close()
+func initializeBase() error {
+	return database.HSet(context.Background(), "linksHashtable", "_test", "initializationkey")
+}
 
-	msg := "--file siteDB --query \"HSET linksHashtable _test initializationkey\""
+func main() {
+	rand.Seed(time.Now().UnixNano())
 
-	_, err = con.Write([]byte(msg))
+	DATABASE_USER = os.Getenv("DATABASE_USER")
+	DATABASE_PASSWORD = os.Getenv("DATABASE_PASSWORD")
+	DATABASE_TLS_ADDRESS = os.Getenv("DATABASE_TLS_ADDRESS")
+	DATABASE_TLS_CA = os.Getenv("DATABASE_TLS_CA")
+	DATABASE_TLS_CERT = os.Getenv("DATABASE_TLS_CERT")
+	DATABASE_TLS_KEY = os.Getenv("DATABASE_TLS_KEY")
 
+	options, err := databaseOptions()
 	if err != nil {
-		return err
+		fmt.Println("Could not set up TLS:", err)
+		return
 	}
+	database = dbclient.New(options)
 
-	return nil
-}
-
-func main() {
-	rand.Seed(time.Now().UnixNano())
-	err := initializeBase()
+	err = initializeBase()
 
 	if err != nil {
 		fmt.Println(err)
@@ -167,9 +194,7 @@ func connectionHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		shortURL, _ := generateShortLink(longUrl)
-
-		err := baseAddLink(shortURL, longUrl)
+		shortURL, err := generateShortLink(r.Context(), longUrl)
 
 		if err != nil {
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -181,7 +206,7 @@ func connectionHandler(w http.ResponseWriter, r *http.Request) {
 	} else if r.Method == http.MethodGet {
 		shortUrl := r.URL.Path[1:]
 
-		result, err := baseFindLink(shortUrl)
+		result, err := baseFindLink(r.Context(), shortUrl)
 
 		fmt.Println("result <<<", result, ">>> error: <<<", err, ">>>")
 
@@ -197,8 +222,7 @@ func connectionHandler(w http.ResponseWriter, r *http.Request) {
 
 		outLink := ""
 
-		if result[0:4] != "http" {
-			fmt.Println(result[0:4])
+		if !strings.HasPrefix(result, "http") {
 			outLink = "http://" + result
 		} else {
 			outLink = result
@@ -209,7 +233,7 @@ func connectionHandler(w http.ResponseWriter, r *http.Request) {
 
 		host, _, _ := net.SplitHostPort(r.RemoteAddr)
 
-		sendStats(shortUrl, outLink, host)
+		sendStats(r.Context(), shortUrl, outLink, host)
 
 		http.Redirect(w, r, outLink, http.StatusSeeOther)
 
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"./dbclient"
+)
+
+// testCertificate signs a certificate for 127.0.0.1 with parent, or
+// makes a CA when parent is nil. It gives the certificate, its key and
+// both as PEM.
+func testCertificate(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		template.KeyUsage = x509.KeyUsageCertSign
+		template.ExtKeyUsage = nil
+		template.BasicConstraintsValid = true
+		template.IsCA = true
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// fakeDatabase accepts TLS clients with a certificate of its CA, answers
+// every command with +OK and keeps what it was sent
+type fakeDatabase struct {
+	mutex    sync.Mutex
+	commands []string
+}
+
+func (fake *fakeDatabase) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		command, err := readTestCommand(reader)
+		if err != nil {
+			return
+		}
+		fake.mutex.Lock()
+		fake.commands = append(fake.commands, strings.Join(command, " "))
+		fake.mutex.Unlock()
+		conn.Write([]byte("+OK\r\n"))
+	}
+}
+
+func (fake *fakeDatabase) received() []string {
+	fake.mutex.Lock()
+	defer fake.mutex.Unlock()
+	return append([]string{}, fake.commands...)
+}
+
+func readTestCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "*")))
+	if err != nil {
+		return nil, err
+	}
+	command := []string{}
+	for i := 0; i < count; i++ {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, "$")))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		command = append(command, string(data[:length]))
+	}
+	return command, nil
+}
+
+func writeTestFile(t *testing.T, name string, content []byte) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// useDatabaseSettings sets the variables main takes from the environment
+// until the test ends
+func useDatabaseSettings(t *testing.T, address string, ca string, certificate string, key string) {
+	settings := []*string{&DATABASE_USER, &DATABASE_PASSWORD, &DATABASE_TLS_ADDRESS, &DATABASE_TLS_CA, &DATABASE_TLS_CERT, &DATABASE_TLS_KEY}
+	values := []string{"web", "secret", address, ca, certificate, key}
+	for i, setting := range settings {
+		saved := *setting
+		*setting = values[i]
+		t.Cleanup(func() { *setting = saved })
+	}
+}
+
+func TestDatabaseTLSDial(t *testing.T) {
+	ca, caKey, caPEM, _ := testCertificate(t, nil, nil, 0)
+	_, _, serverPEM, serverKeyPEM := testCertificate(t, ca, caKey, x509.ExtKeyUsageServerAuth)
+	_, _, clientPEM, clientKeyPEM := testCertificate(t, ca, caKey, x509.ExtKeyUsageClientAuth)
+
+	serverCertificate, err := tls.X509KeyPair(serverPEM, serverKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := x509.NewCertPool()
+	clients.AddCert(ca)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientCAs:    clients,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	fake := &fakeDatabase{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fake.serve(conn)
+		}
+	}()
+
+	caFile := writeTestFile(t, "ca.pem", caPEM)
+	address := listener.Addr().String()
+
+	// without a client certificate the server hangs up
+	useDatabaseSettings(t, address, caFile, "", "")
+	options, err := databaseOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	options.DialTimeout = time.Second
+	database = dbclient.New(options)
+	if err := initializeBase(); err == nil {
+		t.Fatal("the database accepted a client without a certificate")
+	}
+	database.Close()
+
+	useDatabaseSettings(t, address, caFile, writeTestFile(t, "cert.pem", clientPEM), writeTestFile(t, "key.pem", clientKeyPEM))
+	options, err = databaseOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if options.Address != address || options.TLSConfig == nil {
+		t.Fatalf("options dial %s, TLS: %v", options.Address, options.TLSConfig != nil)
+	}
+	database = dbclient.New(options)
+	defer database.Close()
+	if err := initializeBase(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"AUTH web secret", "SELECT siteDB", "HSET linksHashtable _test initializationkey"}
+	got := fake.received()
+	if len(got) != len(want) {
+		t.Fatalf("the database got %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("the database got %q, want %q", got, want)
+		}
+	}
+}
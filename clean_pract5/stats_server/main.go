@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,6 +10,8 @@ import (
 	"net/http"
 	"os"
 	"time"
+
+	"../http_server/dbclient"
 )
 
 type connectionReport struct {
@@ -31,23 +34,98 @@ type Payload struct {
 	Dimensions []string `json:"Dimensions"`
 }
 
-func newRedirectHandler(w http.ResponseWriter, r *http.Request) {
-	var reportData connectionReport
-	err := json.NewDecoder(r.Body).Decode(&reportData)
+var DATABASE_ADDRESS = "database_server:6379"
+
+// login for a database server started with a users file, taken from the
+// environment
+var DATABASE_USER = ""
+var DATABASE_PASSWORD = ""
+
+// TLS connection to the database, taken from the environment like in
+// http_server: with DATABASE_TLS_ADDRESS set the database is dialed there
+// over TLS, DATABASE_TLS_CA verifies its certificate and
+// DATABASE_TLS_CERT with DATABASE_TLS_KEY is the client certificate.
+var DATABASE_TLS_ADDRESS = ""
+var DATABASE_TLS_CA = ""
+var DATABASE_TLS_CERT = ""
+var DATABASE_TLS_KEY = ""
+
+// http_server publishes a connectionReport here for every redirect
+var CLICKS_CHANNEL = "clicks"
+
+// databaseOptions is how the database is dialed, over TLS when
+// DATABASE_TLS_ADDRESS is set
+func databaseOptions() (dbclient.Options, error) {
+	options := dbclient.Options{
+		Address:  DATABASE_ADDRESS,
+		User:     DATABASE_USER,
+		Password: DATABASE_PASSWORD,
+	}
+
+	if DATABASE_TLS_ADDRESS != "" {
+		config, err := dbclient.LoadTLS(DATABASE_TLS_CA, DATABASE_TLS_CERT, DATABASE_TLS_KEY)
+		if err != nil {
+			return options, err
+		}
+		options.Address = DATABASE_TLS_ADDRESS
+		options.TLSConfig = config
+	}
+	return options, nil
+}
+
+// consumeClicks stays subscribed to the clicks channel, reconnecting
+// whenever the database goes away. Clicks published while we are not
+// connected are lost, pub/sub does not keep them. A refused login or
+// subscription will not change by trying again, it ends the consumer.
+func consumeClicks(database *dbclient.Client) {
+	for {
+		err := subscribeClicks(database)
+		if refused(err) {
+			fmt.Println("Clicks subscription refused by the database:", err)
+			return
+		}
+		fmt.Println("Clicks subscription lost:", err)
+		time.Sleep(time.Second)
+	}
+}
+
+// refused tells whether the database turned down our login or the
+// subscription itself
+func refused(err error) bool {
+	switch dbclient.ErrorCode(err) {
+	case dbclient.CodeWrongPass, dbclient.CodeNoAuth, dbclient.CodeNoPerm:
+		return true
+	}
+	return false
+}
+
+func subscribeClicks(database *dbclient.Client) error {
+	subscription, err := database.Subscribe(context.Background(), CLICKS_CHANNEL)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+		return err
 	}
+	defer subscription.Close()
+	fmt.Println("Subscribed to", CLICKS_CHANNEL)
 
-	statConnections(reportData.OutLink, reportData.ShortUrl, reportData.Host)
+	for {
+		message, err := subscription.Receive(context.Background())
+		if err != nil {
+			return err
+		}
 
-	fmt.Printf("Received report: %+v\n", reportData)
-	fmt.Println(reportData.ShortUrl)
-	fmt.Println(reportData.OutLink)
-	fmt.Println(reportData.Host)
+		var reportData connectionReport
+		err = json.Unmarshal([]byte(message.Payload), &reportData)
+		if err != nil {
+			fmt.Println("Bad click event:", err)
+			continue
+		}
+
+		statConnections(reportData.OutLink, reportData.ShortUrl, reportData.Host)
 
-	return
+		fmt.Printf("Received report: %+v\n", reportData)
+	}
 }
+
 func reportHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -105,9 +183,25 @@ func reportHandler(w http.ResponseWriter, r *http.Request) {
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
+	DATABASE_USER = os.Getenv("DATABASE_USER")
+	DATABASE_PASSWORD = os.Getenv("DATABASE_PASSWORD")
+	DATABASE_TLS_ADDRESS = os.Getenv("DATABASE_TLS_ADDRESS")
+	DATABASE_TLS_CA = os.Getenv("DATABASE_TLS_CA")
+	DATABASE_TLS_CERT = os.Getenv("DATABASE_TLS_CERT")
+	DATABASE_TLS_KEY = os.Getenv("DATABASE_TLS_KEY")
+
+	options, err := databaseOptions()
+	if err != nil {
+		fmt.Println("Could not set up TLS:", err)
+		return
+	}
+	database := dbclient.New(options)
+	defer database.Close()
+
 	fmt.Println("Stats server up at 127.0.0.1:6565")
 
-	http.HandleFunc("/", newRedirectHandler)
+	go consumeClicks(database)
+
 	http.HandleFunc("/report", reportHandler)
 
 	log.Fatal(http.ListenAndServe(":6565", nil))
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"../http_server/dbclient"
+)
+
+// fakeDatabase answers every command of its clients with the reply given
+// for its name, a command without one closes the connection. With hangUp
+// it closes the connection after the first reply.
+func fakeDatabase(t *testing.T, replies map[string]string, hangUp bool) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					args, err := readCommand(reader)
+					if err != nil {
+						return
+					}
+					reply, ok := replies[strings.ToUpper(args[0])]
+					if !ok {
+						return
+					}
+					conn.Write([]byte(reply))
+					if hangUp {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := []string{}
+	for i := 0; i < count; i++ {
+		if _, err := reader.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		value, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, strings.TrimSuffix(value, "\r\n"))
+	}
+	return args, nil
+}
+
+func TestSubscriptionRefused(t *testing.T) {
+	cases := []struct {
+		name    string
+		user    string
+		replies map[string]string
+		message string
+	}{
+		{"wrong password", "stats", map[string]string{"AUTH": "-WRONGPASS invalid username-password pair\r\n"}, "WRONGPASS invalid username-password pair"},
+		{"no login", "", map[string]string{"SUBSCRIBE": "-NOAUTH Authentication required\r\n"}, "NOAUTH Authentication required"},
+		{"no permission", "stats", map[string]string{"AUTH": "+OK\r\n", "SUBSCRIBE": "-NOPERM no permission for SUBSCRIBE\r\n"}, "NOPERM no permission for SUBSCRIBE"},
+	}
+	for _, c := range cases {
+		database := dbclient.New(dbclient.Options{Address: fakeDatabase(t, c.replies, false), User: c.user, Password: "secret"})
+		err := subscribeClicks(database)
+		database.Close()
+
+		if !refused(err) {
+			t.Errorf("%s: %v is retried", c.name, err)
+		}
+		if err == nil || err.Error() != c.message {
+			t.Errorf("%s: error %v, want the reply %q", c.name, err, c.message)
+		}
+	}
+}
+
+func TestSubscriptionLostIsRetried(t *testing.T) {
+	// the connection closes after the subscription was confirmed
+	address := fakeDatabase(t, map[string]string{"SUBSCRIBE": "*3\r\n$9\r\nsubscribe\r\n$6\r\nclicks\r\n:1\r\n"}, true)
+	database := dbclient.New(dbclient.Options{Address: address})
+	defer database.Close()
+
+	err := subscribeClicks(database)
+	if err == nil || refused(err) {
+		t.Fatalf("a lost connection gave %v", err)
+	}
+}